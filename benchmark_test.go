@@ -0,0 +1,85 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// Benchmarks EnsureToken for a cached token.
+func Benchmark_Cache_EnsureToken_Hit(b *testing.B) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// Benchmarks the cache miss path via ForceRefresh, which fetches and
+// parses the token on every call, even though it is cached.
+func Benchmark_Cache_EnsureToken_Miss(b *testing.B) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	token, err := getTokenFunction()(context.Background())
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return token, nil
+		}),
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.ForceRefresh(context.Background()); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// Benchmarks EnsureToken of a mapped cache for a cached token.
+func Benchmark_CacheMap_EnsureToken_Hit(b *testing.B) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+	)
+
+	if _, err := cacheMap.EnsureToken(context.Background(), "key"); err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cacheMap.EnsureToken(context.Background(), "key"); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
@@ -1,21 +1,70 @@
 package jwt
 
 import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// farFuture is used as the expiry of tokens without exp claim, if
+// TreatNoExpAsValid is enabled.
+var farFuture = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
 var (
 	// ErrNotImplemented is the default behavior for the cache, if the
 	// token function is not supplied.
 	ErrNotImplemented = errors.New("not implemented")
+
+	// ErrTokenFunctionPanic is matched by the TokenFunctionPanicError,
+	// which is returned if the token function panics.
+	ErrTokenFunctionPanic = errors.New("token function panicked")
+
+	// ErrNoMatchingToken is returned by EnsureTokenMatching, if neither
+	// the cached nor a freshly fetched token satisfy the predicate.
+	ErrNoMatchingToken = errors.New("no token matching the predicate")
+
+	// ErrTokenTooShortLived is returned by EnsureTokenForContext, if not
+	// even a freshly fetched token is valid till the context deadline.
+	ErrTokenTooShortLived = errors.New("token is not valid till the context deadline")
 )
 
+// TokenFunctionPanicError is returned if the token function panics,
+// and carries the recovered value. It matches ErrTokenFunctionPanic,
+// and unwraps to the recovered value, if that is an error.
+type TokenFunctionPanicError struct {
+	Value interface{}
+}
+
+// Error returns a description of the panic.
+func (err *TokenFunctionPanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrTokenFunctionPanic, err.Value)
+}
+
+// Is reports whether the target is ErrTokenFunctionPanic.
+func (err *TokenFunctionPanicError) Is(target error) bool {
+	return target == ErrTokenFunctionPanic
+}
+
+// Unwrap returns the recovered value, if it is an error.
+func (err *TokenFunctionPanicError) Unwrap() error {
+	if wrapped, ok := err.Value.(error); ok {
+		return wrapped
+	}
+
+	return nil
+}
+
 // LoggerContract defines the logging methods required by the cache.
 // This allows to use different kinds of logging libraries.
 type LoggerContract interface {
@@ -25,15 +74,104 @@ type LoggerContract interface {
 
 // Cache is a simple caching implementation to reuse JWTs till they expire.
 type Cache struct {
-	jwt      string
-	validity time.Time
+	// Accessed atomically, and thus first for 64-bit alignment
+	refreshCount uint64
+	hitCount     uint64
+	missCount    uint64
+	errorCount   uint64
+	lockHolds    uint64
+	lockHoldSum  uint64
+	lockHoldMax  uint64
+
+	jwt            string
+	parsed         jwt.Token
+	validity       time.Time
+	validFrom      time.Time
+	expiration     time.Time
+	pinnedUntil    time.Time
+	lock           *sync.RWMutex
+	refreshLock    chan struct{}
+	noExpLogged    bool
+	lastRefresh    time.Time
+	lastNonce      string
+	lastTokenHash  [sha256.Size]byte
+	tokenChanged   bool
+	lockedAt       time.Time
+	issuedAt       time.Time
+	storedWall     time.Time
+	storedMono     time.Duration
+	lastFetch      FetchStats
+	invalidated    bool
+	rejected       bool
+	warmedUp       bool
+	headroomLogged bool
+
+	metricsLock     sync.Mutex
+	metricsBaseline Metrics
 
-	name             string
-	logger           LoggerContract
-	headroom         time.Duration
-	tokenFunc        func(ctx context.Context) (string, error)
-	parseOptions     []jwt.ParseOption
-	rejectUnparsable bool
+	forceLock sync.Mutex
+	forceCall *refreshCall
+
+	eagerLock       sync.Mutex
+	eagerStop       func() bool
+	eagerGeneration uint64
+
+	name                  string
+	logger                LoggerContract
+	headroom              time.Duration
+	tokenFunc             func(ctx context.Context) (string, error)
+	parseOptions          []jwt.ParseOption
+	rejectUnparsable      bool
+	events                eventSink
+	requiredScopes        []string
+	now                   func() time.Time
+	observer              ObserverContract
+	correlationIDFunc     func(ctx context.Context) string
+	secondary             *Cache
+	limiter               *refreshLimiter
+	allowedKeyIDs         []string
+	scopeClaim            string
+	noncePolicy           NoncePolicy
+	shouldCache           func(token jwt.Token) bool
+	maxTokenAge           time.Duration
+	claimValidators       []ClaimValidator
+	aggregateValidation   bool
+	normalizeClaimKeys    bool
+	allowedAlgorithms     []jwa.SignatureAlgorithm
+	warmupFunc            func(ctx context.Context) (string, error)
+	logFingerprint        bool
+	lifetimeFraction      float64
+	treatNoExpAsValid     bool
+	revalidateOnAccess    bool
+	expectedSubject       string
+	minRemaining          time.Duration
+	strictExpiry          bool
+	maxTTL                time.Duration
+	keys                  *keySetHolder
+	keyLookup             KeyLookupFunc
+	monotonic             func() time.Duration
+	clockJumpThreshold    time.Duration
+	acceptFunc            func(token jwt.Token) (bool, error)
+	newTimer              func(d time.Duration, f func()) func() bool
+	eagerRefreshMargin    time.Duration
+	requireAllAudiences   bool
+	expectedAudiences     []string
+	recorder              RecorderContract
+	refreshKeysOnFailure  bool
+	maxPayloadBytes       int
+	maxHeaderBytes        int
+	serveUnexpiredOnError bool
+	allowedIssuers        []string
+	validityRewriter      func(computed time.Time, token jwt.Token) time.Time
+	verifier              VerifierContract
+	recordLockStats       bool
+	retainClaims          bool
+	logClaims             []string
+	logRounding           time.Duration
+	issuedAfter           time.Time
+	closeCtx              context.Context
+	closeCancel           context.CancelFunc
+	closeOnce             sync.Once
 }
 
 // NewCache returns a new JWT cache.
@@ -48,6 +186,13 @@ func NewCache(opts ...Option) *Cache {
 		},
 		parseOptions:     nil,
 		rejectUnparsable: false,
+		now:              time.Now,
+		scopeClaim:       "scope",
+		retainClaims:     true,
+		recorder:         NoopRecorder{},
+		newTicker:        newTicker,
+		newTimer:         newTimer,
+		monotonic:        monotonic,
 	}
 
 	//apply opts
@@ -55,23 +200,128 @@ func NewCache(opts ...Option) *Cache {
 		opt(config)
 	}
 
-	return &Cache{
-		name:             config.name,
-		logger:           config.logger,
-		headroom:         config.headroom,
-		tokenFunc:        config.tokenFunc,
-		parseOptions:     config.parseOptions,
-		rejectUnparsable: config.rejectUnparsable,
+	cache := &Cache{
+		lock:        &sync.RWMutex{},
+		refreshLock: make(chan struct{}, 1),
+
+		name:                  config.name,
+		logger:                config.logger,
+		headroom:              config.headroom,
+		tokenFunc:             config.tokenFunc,
+		parseOptions:          config.parseOptions,
+		rejectUnparsable:      config.rejectUnparsable,
+		events:                config.events,
+		requiredScopes:        config.requiredScopes,
+		now:                   config.now,
+		observer:              newObserverChain(config.observers),
+		correlationIDFunc:     config.correlationIDFunc,
+		secondary:             config.secondary,
+		allowedKeyIDs:         config.allowedKeyIDs,
+		scopeClaim:            config.scopeClaim,
+		noncePolicy:           config.noncePolicy,
+		shouldCache:           config.shouldCache,
+		maxTokenAge:           config.maxTokenAge,
+		claimValidators:       config.claimValidators,
+		aggregateValidation:   config.aggregateValidation,
+		normalizeClaimKeys:    config.normalizeClaimKeys,
+		allowedAlgorithms:     config.allowedAlgorithms,
+		warmupFunc:            config.warmupFunc,
+		logFingerprint:        config.logFingerprint,
+		lifetimeFraction:      config.lifetimeFraction,
+		treatNoExpAsValid:     config.treatNoExpAsValid,
+		revalidateOnAccess:    config.revalidateOnAccess,
+		expectedSubject:       config.expectedSubject,
+		minRemaining:          config.minRemaining,
+		strictExpiry:          config.strictExpiry,
+		maxTTL:                config.maxTTL,
+		keys:                  newKeySetHolder(config.keySetLoader, config.sharedKeys),
+		keyLookup:             config.keyLookup,
+		monotonic:             config.monotonic,
+		clockJumpThreshold:    config.clockJumpThreshold,
+		acceptFunc:            config.acceptFunc,
+		newTimer:              config.newTimer,
+		eagerRefreshMargin:    config.eagerRefreshMargin,
+		requireAllAudiences:   config.requireAllAudiences,
+		expectedAudiences:     config.expectedAudiences,
+		recorder:              config.recorder,
+		refreshKeysOnFailure:  config.refreshKeysOnFailure,
+		maxPayloadBytes:       config.maxPayloadBytes,
+		maxHeaderBytes:        config.maxHeaderBytes,
+		serveUnexpiredOnError: config.serveUnexpiredOnError,
+		allowedIssuers:        config.allowedIssuers,
+		validityRewriter:      config.validityRewriter,
+		verifier:              config.verifier,
+		recordLockStats:       config.recordLockStats,
+		retainClaims:          config.retainClaims,
+		logClaims:             config.logClaims,
+		logRounding:           config.logRounding,
+		issuedAfter:           config.issuedAfter,
+	}
+	cache.closeCtx, cache.closeCancel = context.WithCancel(context.Background())
+
+	if config.heartbeatInterval > 0 {
+		go cache.heartbeat(config.newTicker(config.heartbeatInterval))
 	}
+
+	return cache
 }
 
 type config struct {
-	name             string
-	logger           LoggerContract
-	headroom         time.Duration
-	tokenFunc        func(ctx context.Context) (string, error)
-	parseOptions     []jwt.ParseOption
-	rejectUnparsable bool
+	name                  string
+	logger                LoggerContract
+	headroom              time.Duration
+	tokenFunc             func(ctx context.Context) (string, error)
+	parseOptions          []jwt.ParseOption
+	rejectUnparsable      bool
+	events                eventSink
+	requiredScopes        []string
+	now                   func() time.Time
+	observers             []ObserverContract
+	correlationIDFunc     func(ctx context.Context) string
+	secondary             *Cache
+	allowedKeyIDs         []string
+	scopeClaim            string
+	noncePolicy           NoncePolicy
+	shouldCache           func(token jwt.Token) bool
+	maxTokenAge           time.Duration
+	claimValidators       []ClaimValidator
+	aggregateValidation   bool
+	normalizeClaimKeys    bool
+	allowedAlgorithms     []jwa.SignatureAlgorithm
+	warmupFunc            func(ctx context.Context) (string, error)
+	logFingerprint        bool
+	lifetimeFraction      float64
+	treatNoExpAsValid     bool
+	revalidateOnAccess    bool
+	expectedSubject       string
+	minRemaining          time.Duration
+	strictExpiry          bool
+	maxTTL                time.Duration
+	keySetLoader          func() (jwk.Set, error)
+	sharedKeys            *SharedKeys
+	heartbeatInterval     time.Duration
+	newTicker             func(d time.Duration) (<-chan time.Time, func())
+	newTimer              func(d time.Duration, f func()) func() bool
+	monotonic             func() time.Duration
+	issuedAfter           time.Time
+	logRounding           time.Duration
+	logClaims             []string
+	retainClaims          bool
+	recordLockStats       bool
+	verifier              VerifierContract
+	validityRewriter      func(computed time.Time, token jwt.Token) time.Time
+	allowedIssuers        []string
+	serveUnexpiredOnError bool
+	maxHeaderBytes        int
+	maxPayloadBytes       int
+	refreshKeysOnFailure  bool
+	recorder              RecorderContract
+	expectedAudiences     []string
+	requireAllAudiences   bool
+	eagerRefreshMargin    time.Duration
+	acceptFunc            func(token jwt.Token) (bool, error)
+	clockJumpThreshold    time.Duration
+	keyLookup             KeyLookupFunc
 }
 
 // Option represents an option for the cache.
@@ -102,6 +352,121 @@ func Headroom(headroom time.Duration) Option {
 	}
 }
 
+// MinRemainingToServe sets the validity a cached token must have left to be
+// served by EnsureToken - otherwise, a new token is fetched. In contrast to
+// the headroom, this does not change the stored validity of the token, but
+// is evaluated on every access.
+//
+// The default is 0, which serves tokens till their validity passes.
+func MinRemainingToServe(minRemaining time.Duration) Option {
+	return func(c *config) {
+		c.minRemaining = minRemaining
+	}
+}
+
+// RefreshAtLifetimeFraction sets the fraction (between 0 and 1) of the
+// token lifetime, after which the token is refreshed. The validity of a
+// token is then computed as iat + fraction * (exp - iat), instead of
+// exp - headroom. Tokens without an iat claim, and tokens without an exp
+// claim accepted via TreatNoExpAsValid, fall back to the headroom.
+//
+// The default is 0, which uses the headroom only.
+func RefreshAtLifetimeFraction(fraction float64) Option {
+	return func(c *config) {
+		c.lifetimeFraction = fraction
+	}
+}
+
+// LogDurationRounding sets the precision, to which the caching duration
+// is rounded in the refresh log, e.g. time.Second. This avoids noisy
+// sub-second durations, as caused by RefreshAtLifetimeFraction.
+// The default is 0, which does not round.
+func LogDurationRounding(rounding time.Duration) Option {
+	return func(c *config) {
+		c.logRounding = rounding
+	}
+}
+
+// LogClaims sets the names of claims, which are logged along with the
+// refresh log of a new token, e.g. for auditing the sub or scope of
+// refreshed tokens. Loggers supporting structured fields (such as logrus)
+// receive the claims as fields. Take care to not configure sensitive claims.
+// The default is no claims.
+func LogClaims(names ...string) Option {
+	return func(c *config) {
+		c.logClaims = names
+	}
+}
+
+// RetainClaims sets whether the parsed claims of the cached token are
+// retained. Disabling this lowers the memory footprint for very large
+// tokens, as only the exp, iat and nbf claims are kept. Claim then reports
+// no claims, and EnsureTokenSnapshot and EnsureTokenMatching parse the
+// cached token again on every call.
+// The default is true.
+func RetainClaims(retain bool) Option {
+	return func(c *config) {
+		c.retainClaims = retain
+	}
+}
+
+// RecordLockStats sets whether the time spent holding the internal lock
+// is recorded, for diagnosing contention (e.g. caused by slow callbacks).
+// Only exclusive holds (e.g. storing a new token) are recorded, while the
+// shared holds of serving cached tokens are not, to keep the hit path
+// cheap. The statistics are available via LockStats and WriteMetrics.
+// The default is false.
+func RecordLockStats(record bool) Option {
+	return func(c *config) {
+		c.recordLockStats = record
+	}
+}
+
+// ValidityRewriter sets a function, which adjusts the validity computed
+// for a new token (from its exp claim and the headroom), e.g. for quirks
+// of specific providers. The validity can only be shortened - returning
+// a later validity than the computed one has no effect. If claims are not
+// retained via RetainClaims, SetHeadroom does not re-apply the function.
+// The default is no rewriter.
+func ValidityRewriter(rewriter func(computed time.Time, token jwt.Token) time.Time) Option {
+	return func(c *config) {
+		c.validityRewriter = rewriter
+	}
+}
+
+// ServeWithinRealExpiryOnError sets whether the cached token is served if
+// refreshing it fails, as long as it is not yet expired as per its exp
+// claim. This turns the headroom into a safety buffer during outages of
+// the issuer, without ever serving actually expired tokens.
+// The default is false.
+func ServeWithinRealExpiryOnError(serve bool) Option {
+	return func(c *config) {
+		c.serveUnexpiredOnError = serve
+	}
+}
+
+// MaxHeaderBytes sets the maximum size of the (still encoded) header
+// segment of a token. Tokens with a larger header are rejected with
+// ErrSegmentTooLarge before being decoded, which defends against
+// pathological tokens.
+// The default is 0, which does not limit the size.
+func MaxHeaderBytes(maxBytes int) Option {
+	return func(c *config) {
+		c.maxHeaderBytes = maxBytes
+	}
+}
+
+// MaxPayloadBytes sets the maximum size of the (still encoded) payload
+// segment of a token. Tokens with a larger payload are rejected with
+// ErrSegmentTooLarge before being decoded, which defends against
+// pathological tokens.
+// The default is 0, which does not limit the size.
+func MaxPayloadBytes(maxBytes int) Option {
+	return func(c *config) {
+		c.maxPayloadBytes = maxBytes
+	}
+}
+
 // TokenFunction set the function which is called to retrieve a new
 // JWT when required.
 // The default always returns an error with "not implemented".
@@ -121,9 +486,24 @@ func ParseOptions(parseOptions ...jwt.ParseOption) Option {
 	}
 }
 
+// NormalizeClaimKeys sets whether registered claims with non-conforming
+// key casing (e.g. "Exp" instead of "exp") are accepted, for legacy
+// issuers. Such claims are moved to their registered key after parsing,
+// if the registered key itself is not set. Note that validation done by
+// the parser itself (see ParseOptions) still only sees the original keys.
+//
+// The default is false, as this is not standard conforming.
+func NormalizeClaimKeys(normalize bool) Option {
+	return func(c *config) {
+		c.normalizeClaimKeys = normalize
+	}
+}
+
 // RejectUnparsable sets if the cache should reject (and return
 // the accompanying error) token which are not parsable.
 // Note, unparsable can mean a failed signature check.
+// Structurally broken tokens are reported with ErrMalformedToken,
+// ErrMalformedEncoding or ErrMalformedJSON.
 //
 // The default is false.
 func RejectUnparsable(rejectUnparsable bool) Option {
@@ -132,57 +512,1486 @@ func RejectUnparsable(rejectUnparsable bool) Option {
 	}
 }
 
+// Events sets a channel on which cache lifecycle events (hit, miss,
+// refresh and error) are emitted. The channel should be buffered, and
+// the policy defines what happens if it is full: DropEvents discards
+// the event, while BlockEvents waits till the event is delivered or
+// the context passed to EnsureToken is done.
+//
+// The default is no channel, so no events are emitted.
+func Events(events chan<- Event, policy EventPolicy) Option {
+	return func(c *config) {
+		c.events = eventSink{events: events, policy: policy}
+	}
+}
+
+// RequiredScopes sets the scopes a token must carry in its scope
+// claim (either as a space-delimited string, or an array of strings).
+// The name of the claim can be changed via ScopeClaim.
+// Tokens missing any of these scopes are rejected with ErrMissingScopes,
+// and are not cached.
+// Note, this check only applies to parsable tokens - use RejectUnparsable
+// to reject all others.
+//
+// The default is empty.
+func RequiredScopes(scopes ...string) Option {
+	return func(c *config) {
+		c.requiredScopes = scopes
+	}
+}
+
+// AllowedIssuers sets the issuers a token may be issued by. The iss claim
+// of every token is checked against this list, and tokens of an unknown
+// (or missing) issuer are rejected with ErrIssuerNotAllowed, before being
+// cached. This allows accepting tokens of several issuers in one cache.
+//
+// The default is empty, which allows all issuers.
+func AllowedIssuers(issuers ...string) Option {
+	return func(c *config) {
+		c.allowedIssuers = issuers
+	}
+}
+
+// ExpectedSubject sets the subject, which the sub claim of every token must
+// match. Tokens for another subject are rejected with ErrUnexpectedSubject,
+// before being cached. This catches tokens issued for the wrong identity.
+//
+// The default is empty, which accepts any subject.
+func ExpectedSubject(subject string) Option {
+	return func(c *config) {
+		c.expectedSubject = subject
+	}
+}
+
+// ExpectedAudience sets the audiences, which the aud claim of every token
+// is checked against. As the aud claim may hold several audiences, a token
+// is accepted if any of them is expected, unless RequireAllAudiences is
+// enabled. Other tokens are rejected with ErrUnexpectedAudience, before
+// being cached.
+//
+// The default is empty, which accepts any audience.
+func ExpectedAudience(audiences ...string) Option {
+	return func(c *config) {
+		c.expectedAudiences = audiences
+	}
+}
+
+// RequireAllAudiences sets whether the aud claim of every token must
+// contain all audiences set via ExpectedAudience, instead of any of them.
+//
+// The default is false.
+func RequireAllAudiences(requireAllAudiences bool) Option {
+	return func(c *config) {
+		c.requireAllAudiences = requireAllAudiences
+	}
+}
+
+// StrictExpiry sets whether the expiry of every token is strictly
+// validated: The exp claim must be present (ErrMissingExpiry), positive
+// (ErrInvalidExpiry), after the iat claim (ErrExpiryBeforeIssuedAt), and -
+// if maxTTL is larger than 0 - at most maxTTL in the future
+// (ErrExpiryTooFar). Tokens violating any of these are rejected.
+//
+// The default is false, which does not validate the expiry strictly.
+func StrictExpiry(strict bool, maxTTL time.Duration) Option {
+	return func(c *config) {
+		c.strictExpiry = strict
+		c.maxTTL = maxTTL
+	}
+}
+
+// ScopeClaim sets the name of the claim the RequiredScopes are read
+// from, as providers differ in their convention (e.g. "scope", "scp"
+// or "scopes").
+//
+// The default is "scope".
+func ScopeClaim(name string) Option {
+	return func(c *config) {
+		c.scopeClaim = name
+	}
+}
+
+// Clock sets the function used to retrieve the current time, when
+// checking the validity of the cached token. This is mostly useful
+// for testing.
+//
+// The default is time.Now.
+func Clock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+// ClockJumpThreshold enables detecting jumps of the wall clock (e.g. on VM
+// resume or NTP steps), by comparing the wall and monotonic time elapsed
+// since the token was cached. If they differ by more than the threshold,
+// the validity of the cached token is re-evaluated against the monotonic
+// time elapsed - and the token is dropped, if it is now expired.
+//
+// Note that the wall time is read via Clock, while the monotonic time is
+// always read from the system. Combined with a fake clock (e.g. in tests),
+// every deviation of the fake clock from the system time is detected as
+// a jump - so the detection should only be enabled with the real clock.
+//
+// The default is 0, which disables the detection.
+func ClockJumpThreshold(threshold time.Duration) Option {
+	return func(c *config) {
+		c.clockJumpThreshold = threshold
+	}
+}
+
+// Observer registers observers, which are notified about the refresh
+// lifecycle of the cache. The option can be used multiple times, and
+// observers are invoked in registration order. See ObserverContract for
+// the invocation guarantees.
+//
+// The default is no observer.
+func Observer(observers ...ObserverContract) Option {
+	return func(c *config) {
+		c.observers = append(c.observers, observers...)
+	}
+}
+
+// Recorder sets the recorder, which is notified about hits, misses,
+// refreshes and errors of the cache. This allows adapting any metrics
+// backend, without this package depending on it.
+// The default is the NoopRecorder.
+func Recorder(recorder RecorderContract) Option {
+	return func(c *config) {
+		c.recorder = recorder
+	}
+}
+
+// CorrelationID sets a function which extracts a correlation ID (e.g. a
+// request or trace ID) from the context passed to EnsureToken. The ID is
+// included in refresh log messages and emitted events, which allows tying
+// token fetches to the request which triggered them.
+//
+// The default is no function, so no correlation ID is used.
+func CorrelationID(correlationIDFunc func(ctx context.Context) string) Option {
+	return func(c *config) {
+		c.correlationIDFunc = correlationIDFunc
+	}
+}
+
+// Secondary sets a secondary cache (e.g. using a token endpoint in a
+// different region), which is used by EnsureToken if refreshing the token
+// fails. The secondary cache tracks the validity of its token on its own.
+// If the secondary cache fails as well, the original error is returned.
+//
+// The default is no secondary cache.
+func Secondary(secondary *Cache) Option {
+	return func(c *config) {
+		c.secondary = secondary
+	}
+}
+
+// AllowedKeyIDs sets the key IDs a token may be signed with. The kid
+// header of every token is checked against this list before parsing, and
+// tokens with an unknown (or missing) kid are rejected with
+// ErrKeyIDNotAllowed. This limits the exposure to unexpected keys.
+//
+// The default is empty, which allows all key IDs.
+func AllowedKeyIDs(keyIDs ...string) Option {
+	return func(c *config) {
+		c.allowedKeyIDs = keyIDs
+	}
+}
+
+// ClaimValidators registers validators, which check the claims of every
+// freshly parsed token. A token is only accepted if all validators pass.
+// The option can be used multiple times, and validators are invoked in
+// registration order - after the built-in validation rules. By default,
+// the first failure is returned (see AggregateValidationErrors).
+//
+// The default is no validator.
+func ClaimValidators(validators ...ClaimValidator) Option {
+	return func(c *config) {
+		c.claimValidators = append(c.claimValidators, validators...)
+	}
+}
+
+// AggregateValidationErrors sets whether all claim validators are invoked
+// even if one fails, returning all failures as ValidationErrors. Otherwise,
+// the first failure is returned as is.
+//
+// The default is false.
+func AggregateValidationErrors(aggregate bool) Option {
+	return func(c *config) {
+		c.aggregateValidation = aggregate
+	}
+}
+
+// MaxTokenAge sets the maximum age of a token, as derived from its iat
+// claim. Tokens issued longer ago are rejected with ErrTokenTooOld, even
+// if their exp claim is still valid. Tokens without an iat claim are
+// not checked.
+//
+// The default is 0, which does not limit the token age.
+func MaxTokenAge(maxTokenAge time.Duration) Option {
+	return func(c *config) {
+		c.maxTokenAge = maxTokenAge
+	}
+}
+
+// NotBeforeIssuedAt rejects tokens issued before the given cutoff with
+// ErrIssuedBeforeCutoff, as derived from their iat claim. This allows a
+// mass revocation of tokens by issuance time. Tokens without an iat claim
+// are rejected, too. Unlike the nbf claim, the cutoff is set by the client.
+//
+// The default is the zero time, which does not check the iat claim.
+func NotBeforeIssuedAt(cutoff time.Time) Option {
+	return func(c *config) {
+		c.issuedAfter = cutoff
+	}
+}
+
+// TreatNoExpAsValid sets whether tokens without an exp claim are cached
+// indefinitely, instead of not being cached at all. This is only meant for
+// trusted internal issuers, which deliberately omit exp: such a token is
+// never refreshed by EnsureToken, even if it was revoked in the meantime -
+// only ForceRefresh or Invalidate replace it.
+//
+// The default is false.
+func TreatNoExpAsValid(treatNoExpAsValid bool) Option {
+	return func(c *config) {
+		c.treatNoExpAsValid = treatNoExpAsValid
+	}
+}
+
+// Verifier sets a verifier, to which the verification of the signature of
+// every fetched token is delegated before parsing - e.g. to a KMS or HSM,
+// which does not expose its keys. Tokens failing verification are treated
+// as unparsable, so combine with RejectUnparsable.
+// The default is no verifier.
+func Verifier(verifier VerifierContract) Option {
+	return func(c *config) {
+		c.verifier = verifier
+	}
+}
+
+// KeySet sets a function, which loads the key set tokens are verified
+// against - e.g. a static JWKS via jwk.Parse. The key of a token is chosen
+// by its kid header, as with jwt.WithKeySet. The key set is loaded on first
+// use, and only reloaded via RefreshKeys, which decouples key refreshes
+// from token refreshes. Combine with RejectUnparsable, so that tokens
+// failing verification are not returned.
+//
+// The default is nil, which does not verify tokens against a key set.
+func KeySet(load func() (jwk.Set, error)) Option {
+	return func(c *config) {
+		c.keySetLoader = load
+	}
+}
+
+// SharedKeySet sets a key set shared with other caches (see NewSharedKeys),
+// which tokens are verified against like with KeySet. The shared key set is
+// loaded once for all caches, and RefreshKeys on any of them reloads it for
+// all. It takes precedence over KeySet.
+//
+// The default is nil, which does not share a key set.
+func SharedKeySet(keys *SharedKeys) Option {
+	return func(c *config) {
+		c.sharedKeys = keys
+	}
+}
+
+// RefreshKeysOnVerificationFailure sets whether the key set configured via
+// the KeySet option is reloaded once, if a token fails verification - and
+// the token is parsed again with the reloaded key set. This gracefully
+// handles tokens signed with rotated keys, without waiting for RefreshKeys.
+// The default is false.
+func RefreshKeysOnVerificationFailure(refresh bool) Option {
+	return func(c *config) {
+		c.refreshKeysOnFailure = refresh
+	}
+}
+
+// AcceptFunc sets a final gate, which is consulted for every token after
+// it passed all other validation, e.g. for applying business rules such as
+// required entitlements. If it returns false, the token is discarded and
+// ErrTokenNotAccepted is returned. If it returns an error, the token is
+// discarded and the error is returned as is. Unlike ShouldCache, the token
+// is never returned to the caller. The gate is not consulted for tokens
+// which could not be parsed.
+//
+// The default is nil, which accepts all tokens.
+func AcceptFunc(accept func(token jwt.Token) (bool, error)) Option {
+	return func(c *config) {
+		c.acceptFunc = accept
+	}
+}
+
+// ShouldCache sets a predicate, which decides whether a freshly parsed
+// token is cached. If the predicate returns false, the token is returned
+// to the caller, but not cached - similar to tokens without an exp claim.
+// The predicate is not consulted for tokens which could not be parsed.
+//
+// The default is nil, which caches all tokens with an exp claim.
+func ShouldCache(shouldCache func(token jwt.Token) bool) Option {
+	return func(c *config) {
+		c.shouldCache = shouldCache
+	}
+}
+
+// NonceTracking enables tracking of the nonce claim of fetched tokens.
+// The cache records the nonce of the last token, and reports (NonceReport)
+// or rejects (NonceReject) a token repeating it. Tokens without a nonce
+// claim are not tracked. Note that nonces are tracked per cache.
+//
+// The default is NonceIgnore, which does not track nonces.
+func NonceTracking(policy NoncePolicy) Option {
+	return func(c *config) {
+		c.noncePolicy = policy
+	}
+}
+
+// RevalidateOnEveryAccess sets whether cached tokens are parsed (with the
+// configured parse options, e.g. for signature verification) and validated
+// again on every access, instead of only once after being fetched. A token
+// failing revalidation is dropped, and a new token is fetched. This comes at
+// a CPU cost, and is meant as a temporary strict mode (e.g. during an
+// incident).
+//
+// The default is false.
+func RevalidateOnEveryAccess(revalidate bool) Option {
+	return func(c *config) {
+		c.revalidateOnAccess = revalidate
+	}
+}
+
+// LogFingerprint sets whether refresh logs include a short fingerprint of
+// the token (the first 8 hex digits of its SHA-256 hash), which allows
+// correlating tokens in audits. The raw token is never logged.
+//
+// The default is false.
+func LogFingerprint(logFingerprint bool) Option {
+	return func(c *config) {
+		c.logFingerprint = logFingerprint
+	}
+}
+
+// Warmup sets a function, which provides the token for the very first
+// miss of EnsureToken, instead of the token function - e.g. to seed the
+// cache from a persisted token. The token is handled like a token provided
+// by the token function. Warmup runs at most once, and not at all if a
+// token was cached before (e.g. via ForceRefresh or SetTokenIfNewer). If it
+// fails, or provides a token which cannot be served (e.g. an expired one),
+// the token function is invoked as usual.
+//
+// The default is nil, which does not warm up the cache.
+func Warmup(warmupFunc func(ctx context.Context) (string, error)) Option {
+	return func(c *config) {
+		c.warmupFunc = warmupFunc
+	}
+}
+
+// AllowedAlgorithms sets the algorithms a token may be signed with. The alg
+// header of every token is checked against this list before parsing, and
+// tokens with another algorithm are rejected with ErrAlgorithmNotAllowed.
+// Unsigned tokens (alg "none") are always rejected, even if listed. Note
+// that this does not verify the signature itself (see ParseOptions and
+// VerifyWithKeyLookup).
+//
+// The default is empty, which allows all algorithms.
+func AllowedAlgorithms(algorithms ...jwa.SignatureAlgorithm) Option {
+	return func(c *config) {
+		c.allowedAlgorithms = algorithms
+	}
+}
+
+// VerifyWithKeyLookup verifies the signature of every token with the key
+// returned by the given lookup, for the algorithm and key ID of the token
+// header. The algorithm is thus detected from the token, but must be
+// allowed via AllowedAlgorithms - with an empty allowlist, every token is
+// rejected with ErrAlgorithmNotAllowed. Unsigned tokens (alg "none") are
+// always rejected. If set, the lookup takes precedence over a key set. As
+// for other parse failures, tokens failing verification are only returned
+// as error in combination with RejectUnparsable.
+//
+// The default is nil, which verifies via ParseOptions only.
+func VerifyWithKeyLookup(lookup KeyLookupFunc) Option {
+	return func(c *config) {
+		c.keyLookup = lookup
+	}
+}
+
+// HeartbeatInterval enables a background goroutine, which logs the status
+// of the cache at the given interval, for confirming liveness of long-lived
+// processes. The goroutine is stopped via Close.
+// The default is 0, which disables the heartbeat.
+func HeartbeatInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.heartbeatInterval = interval
+	}
+}
+
+// EagerRefresh enables refreshing the token proactively, the given margin
+// before the validity of the cached token ends. After each refresh, a single
+// timer is scheduled based on the validity of the new token, which is thus
+// replaced before callers ever encounter it as expired. If the validity ends
+// within the margin, no timer is scheduled. A failed eager refresh keeps the
+// cached token, which is then refreshed on access as usual. The timer is
+// rescheduled by SetHeadroom and SetTokenIfNewer, and stopped via
+// Invalidate or Close.
+// The default is 0, which disables eager refreshes.
+func EagerRefresh(margin time.Duration) Option {
+	return func(c *config) {
+		c.eagerRefreshMargin = margin
+	}
+}
+
 // EnsureToken returns either the cached token if existing and still valid,
 // or calls the internal token function to fetch a new token. If an error
 // occurs in the latter case, it is passed trough.
+//
+// EnsureToken is safe for concurrent use. Concurrent callers encountering
+// an invalid token wait for a single invocation of the token function.
 func (jwtCache *Cache) EnsureToken(ctx context.Context) (string, error) {
-	// Do we have a cached jwt, and its still valid?
-	if jwtCache.jwt != "" && time.Now().Before(jwtCache.validity) {
-		return jwtCache.jwt, nil
+	state, err := jwtCache.ensure(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	token, err := jwtCache.tokenFunc(ctx)
+	return state.token, nil
+}
+
+// ForceRefresh calls the internal token function to fetch a new token,
+// regardless of the validity of the currently cached token. If an error
+// occurs, it is passed trough, and the currently cached token is kept.
+//
+// Concurrent calls are coalesced into a single invocation of the token
+// function, and all callers receive its result. Thus, if the context of
+// the first caller is done, all concurrent callers receive its error.
+func (jwtCache *Cache) ForceRefresh(ctx context.Context) (string, error) {
+	state, err := jwtCache.forceRefresh(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	// Work with the parsed token - but don't fail, if we encounter an error
-	parsedToken, err := jwt.ParseString(token, jwtCache.parseOptions...)
-	if err != nil && jwtCache.rejectUnparsable {
-		return "", fmt.Errorf("failed to parse token: %w", err)
-	}
+	return state.token, nil
+}
 
-	if err == nil {
-		// Note: According to https://tools.ietf.org/html/rfc7519,
+// refreshCall is a forced refresh in flight, shared by concurrent callers.
+type refreshCall struct {
+	done  chan struct{}
+	state tokenState
+	err   error
+}
+
+// forceRefresh refreshes the token, regardless of the validity of the
+// currently cached token. Concurrent calls are coalesced into a single
+// refresh, the result of which all callers receive - as the token is
+// freshly provided by the token function either way.
+func (jwtCache *Cache) forceRefresh(ctx context.Context) (tokenState, error) {
+	jwtCache.forceLock.Lock()
+	if call := jwtCache.forceCall; call != nil {
+		jwtCache.forceLock.Unlock()
+
+		select {
+		case <-call.done:
+			return call.state, call.err
+		case <-ctx.Done():
+			return tokenState{}, ctx.Err()
+		}
+	}
+
+	call := &refreshCall{done: make(chan struct{})}
+	jwtCache.forceCall = call
+	jwtCache.forceLock.Unlock()
+
+	defer func() {
+		jwtCache.forceLock.Lock()
+		jwtCache.forceCall = nil
+		jwtCache.forceLock.Unlock()
+
+		close(call.done)
+	}()
+
+	if err := jwtCache.acquireRefresh(ctx); err != nil {
+		call.err = err
+		return tokenState{}, err
+	}
+	defer jwtCache.releaseRefresh()
+
+	call.state, call.err = jwtCache.refresh(ctx, RefreshForced)
+	return call.state, call.err
+}
+
+// EnsureTokenMatching behaves like EnsureToken, but only returns the
+// token if its claims satisfy the given predicate. Otherwise, a new token
+// is fetched via ForceRefresh, and checked once more. If that token does
+// not match either, ErrNoMatchingToken is returned. Tokens which could not
+// be parsed never match.
+func (jwtCache *Cache) EnsureTokenMatching(ctx context.Context, pred func(token jwt.Token) bool) (string, error) {
+	state, err := jwtCache.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed := jwtCache.parsedOf(state); parsed != nil && pred(parsed) {
+		return state.token, nil
+	}
+
+	state, err = jwtCache.forceRefresh(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if state.parsed != nil && pred(state.parsed) {
+		return state.token, nil
+	}
+
+	return "", ErrNoMatchingToken
+}
+
+// EnsureTokenForContext behaves like EnsureToken, but ensures that the
+// returned token stays valid (as per its validity, including headroom)
+// till the deadline of the given context - so that the token does not
+// expire during the operation bound by the context. If the cached token
+// expires earlier, a new token is fetched via ForceRefresh. If that token
+// expires before the deadline too, ErrTokenTooShortLived is returned.
+// Contexts without deadline, as well as tokens which are not cached
+// (and thus have no known validity), are handled like EnsureToken.
+func (jwtCache *Cache) EnsureTokenForContext(ctx context.Context) (string, error) {
+	state, err := jwtCache.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok || coversDeadline(state, deadline) {
+		return state.token, nil
+	}
+
+	state, err = jwtCache.forceRefresh(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if !coversDeadline(state, deadline) {
+		return "", fmt.Errorf("%w: valid till %s, but deadline is %s", ErrTokenTooShortLived, state.validity, deadline)
+	}
+
+	return state.token, nil
+}
+
+// coversDeadline reports whether the token of the given state
+// is valid till the given deadline, if its validity is known.
+func coversDeadline(state tokenState, deadline time.Time) bool {
+	return state.validity.IsZero() || !state.validity.Before(deadline)
+}
+
+// WaitUntilExpiry blocks till the validity of the cached token passes,
+// or the context is done (in which case the context error is returned).
+// If no token is cached, it returns immediately.
+func (jwtCache *Cache) WaitUntilExpiry(ctx context.Context) error {
+	jwtCache.lock.RLock()
+	cached := jwtCache.jwt != ""
+	validity := jwtCache.validity
+	jwtCache.lock.RUnlock()
+
+	if !cached {
+		return nil
+	}
+
+	remaining := validity.Sub(jwtCache.now().Round(0))
+	if remaining <= 0 {
+		return nil
+	}
+
+	expired := make(chan struct{})
+	stop := jwtCache.newTimer(remaining, func() { close(expired) })
+	defer stop()
+
+	select {
+	case <-expired:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetTokenIfNewer caches the given token (e.g. obtained from another
+// source), if it expires later than the currently cached token - or if no
+// token is cached. The token is checked and validated like a token provided
+// by the token function, and errors are returned as is. Tokens without an
+// exp claim, or tokens rejected via ShouldCache are never adopted. Returns
+// whether the token was adopted.
+func (jwtCache *Cache) SetTokenIfNewer(token string) (bool, error) {
+	if err := jwtCache.validateSegmentSizes(token); err != nil {
+		return false, err
+	}
+
+	if err := jwtCache.validateHeader(token); err != nil {
+		return false, err
+	}
+
+	parsedToken, err := jwtCache.parse(token)
+	if err != nil {
+		return false, err
+	}
+
+	if err := jwtCache.validate(parsedToken); err != nil {
+		return false, err
+	}
+
+	exp := parsedToken.Expiration()
+	if exp.IsZero() || (jwtCache.shouldCache != nil && !jwtCache.shouldCache(parsedToken)) {
+		return false, nil
+	}
+
+	jwtCache.lockState()
+
+	if jwtCache.jwt != "" && !exp.After(jwtCache.expiration) {
+		jwtCache.unlockState()
+		return false, nil
+	}
+
+	jwtCache.store(token, parsedToken, parsedToken.IssuedAt(), exp)
+	jwtCache.invalidated = false
+
+	validity := jwtCache.validity
+	jwtCache.unlockState()
+
+	jwtCache.scheduleEagerRefresh(validity)
+
+	return true, nil
+}
+
+// HasToken reports whether the cache holds a token - regardless of
+// whether it is still valid. This distinguishes a cache which was never
+// initialized (or was invalidated) from a cache with an expired token.
+func (jwtCache *Cache) HasToken() bool {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	return jwtCache.jwt != ""
+}
+
+// HasValidToken reports whether the cache holds a token, which would be
+// served by EnsureToken without invoking the token function.
+func (jwtCache *Cache) HasValidToken() bool {
+	_, ok := jwtCache.cachedState()
+	return ok
+}
+
+// ValidFrom returns the point in time the cached token becomes usable,
+// as defined by its nbf claim. If no token is cached, or the cached token
+// has no nbf claim, false is returned.
+func (jwtCache *Cache) ValidFrom() (time.Time, bool) {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	if jwtCache.jwt == "" || jwtCache.validFrom.IsZero() {
+		return time.Time{}, false
+	}
+
+	return jwtCache.validFrom, true
+}
+
+// Pin prevents the cached token from being refreshed by EnsureToken for
+// up to the given duration, e.g. during a critical operation. While pinned,
+// the token is served even if its validity passed (e.g. it entered the
+// headroom window) - but never past its actual expiry. A pinned token is
+// not refreshed via EagerRefresh either.
+func (jwtCache *Cache) Pin(d time.Duration) {
+	jwtCache.lockState()
+	defer jwtCache.unlockState()
+
+	jwtCache.pinnedUntil = jwtCache.now().Round(0).Add(d)
+}
+
+// Unpin releases a pin set via Pin.
+func (jwtCache *Cache) Unpin() {
+	jwtCache.lockState()
+	defer jwtCache.unlockState()
+
+	jwtCache.pinnedUntil = time.Time{}
+}
+
+// SetHeadroom replaces the headroom set via the Headroom option at runtime.
+// The validity of the currently cached token is recomputed with the new
+// headroom, so that it applies immediately.
+func (jwtCache *Cache) SetHeadroom(headroom time.Duration) {
+	jwtCache.lockState()
+
+	jwtCache.headroom = headroom
+	jwtCache.headroomLogged = false
+
+	if jwtCache.jwt != "" {
+		jwtCache.validity = jwtCache.validityFor(jwtCache.issuedAt, jwtCache.expiration)
+		if jwtCache.parsed != nil {
+			jwtCache.validity = jwtCache.rewriteValidity(jwtCache.validity, jwtCache.parsed)
+		}
+	}
+
+	validity := jwtCache.validity
+	jwtCache.unlockState()
+
+	jwtCache.scheduleEagerRefresh(validity)
+}
+
+// Invalidate drops the cached token (and any pin), so that the next call
+// to EnsureToken fetches a new token - e.g. after the token was revoked.
+// Concurrent calls to EnsureToken either observe the token before, or no
+// token after the invalidation, but never a partially cleared token.
+func (jwtCache *Cache) Invalidate() {
+	jwtCache.lockState()
+	jwtCache.invalidateLocked()
+	jwtCache.rejected = false
+	jwtCache.unlockState()
+
+	jwtCache.stopEagerRefresh()
+}
+
+// invalidateLocked drops the cached token. The caller must hold the lock.
+func (jwtCache *Cache) invalidateLocked() {
+	jwtCache.jwt = ""
+	jwtCache.parsed = nil
+	jwtCache.validity = time.Time{}
+	jwtCache.validFrom = time.Time{}
+	jwtCache.expiration = time.Time{}
+	jwtCache.pinnedUntil = time.Time{}
+	jwtCache.invalidated = true
+}
+
+// SameToken reports whether both caches currently hold the same token.
+// Caches which hold no token are never considered equal. This is mostly
+// useful for testing, or verifying blue/green deployments.
+func SameToken(a, b *Cache) bool {
+	a.lock.RLock()
+	aToken := a.jwt
+	a.lock.RUnlock()
+
+	b.lock.RLock()
+	bToken := b.jwt
+	b.lock.RUnlock()
+
+	return aToken != "" && aToken == bToken
+}
+
+// LastTokenChanged reports whether the most recent refresh provided a
+// different token than the refresh before, e.g. for monitoring rotations.
+// It reports false, if not at least two refreshes happened. Only hashes of
+// the tokens are kept for the comparison.
+func (jwtCache *Cache) LastTokenChanged() bool {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	return jwtCache.tokenChanged
+}
+
+// Now returns the current time, as seen by the cache via the Clock option.
+// Validity comparisons done by the cache are based on this time, so tests
+// and callers can reason about them consistently.
+func (jwtCache *Cache) Now() time.Time {
+	return jwtCache.now()
+}
+
+// LastRefreshTime returns the point in time the token function last
+// successfully provided a token. In contrast to the iat claim (which is
+// set by the issuer), this reflects when the cache itself fetched the
+// token. If no token was fetched yet, false is returned.
+func (jwtCache *Cache) LastRefreshTime() (time.Time, bool) {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	return jwtCache.lastRefresh, !jwtCache.lastRefresh.IsZero()
+}
+
+// RefreshCount returns the number of times a new token was successfully
+// provided by the token function, since the cache was created. Tokens
+// served from the cache do not count.
+func (jwtCache *Cache) RefreshCount() uint64 {
+	return atomic.LoadUint64(&jwtCache.refreshCount)
+}
+
+// FetchStats describes a single invocation of the token function.
+type FetchStats struct {
+	// Start is the point in time the token function was invoked.
+	Start time.Time
+
+	// Duration is the time it took to fetch and process the token.
+	Duration time.Duration
+
+	// Success reports whether the token was provided and accepted.
+	Success bool
+
+	// Reason is the reason the token function was invoked.
+	Reason RefreshReason
+}
+
+// LastFetchStats returns the stats of the most recent invocation of the
+// token function, regardless of whether it succeeded. If the token function
+// was not invoked yet, false is returned.
+func (jwtCache *Cache) LastFetchStats() (FetchStats, bool) {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	return jwtCache.lastFetch, !jwtCache.lastFetch.Start.IsZero()
+}
+
+// tokenState is a consistent view of a token, as captured under lock.
+type tokenState struct {
+	token     string
+	parsed    jwt.Token
+	validity  time.Time
+	fromCache bool
+	notCached NotCachedReason
+}
+
+// RefreshReason describes why the token function was invoked.
+type RefreshReason int
+
+const (
+	// RefreshInitial means that no token was fetched (or set via
+	// SetTokenIfNewer) yet.
+	RefreshInitial RefreshReason = iota
+
+	// RefreshExpired means that the cached token expired (with headroom).
+	RefreshExpired
+
+	// RefreshNotYetValid means that the nbf claim of the cached token is
+	// still in the future.
+	RefreshNotYetValid
+
+	// RefreshNotCached means that the previous token was not cached (e.g.
+	// as it had no exp claim).
+	RefreshNotCached
+
+	// RefreshForced means that the refresh was forced via ForceRefresh.
+	RefreshForced
+
+	// RefreshInvalidated means that the cached token was dropped via
+	// Invalidate.
+	RefreshInvalidated
+
+	// RefreshWarmup means that the token was provided by the Warmup
+	// function, instead of the token function.
+	RefreshWarmup
+
+	// RefreshEager means that the token was refreshed proactively, before
+	// the validity of the cached token ended. See EagerRefresh.
+	RefreshEager
+
+	// RefreshRejected means that the previous token was rejected - either
+	// the cached token failed revalidation (see RevalidateOnEveryAccess) or
+	// was revoked (see EnsureTokenWithRevoke), or the previously fetched
+	// token failed any check (e.g. its size, header, parsing with
+	// RejectUnparsable, nonce or claim validation, including the
+	// AcceptFunc).
+	RefreshRejected
+
+	// RefreshPinExpired means that the cached token was served past its
+	// validity via Pin, and the pin lapsed.
+	RefreshPinExpired
+)
+
+// String returns a human readable representation of the reason.
+func (reason RefreshReason) String() string {
+	switch reason {
+	case RefreshInitial:
+		return "initial"
+	case RefreshExpired:
+		return "expired"
+	case RefreshNotYetValid:
+		return "not yet valid"
+	case RefreshNotCached:
+		return "not cached"
+	case RefreshForced:
+		return "forced"
+	case RefreshInvalidated:
+		return "invalidated"
+	case RefreshWarmup:
+		return "warmup"
+	case RefreshEager:
+		return "eager"
+	case RefreshRejected:
+		return "rejected"
+	case RefreshPinExpired:
+		return "pin expired"
+	default:
+		return "unknown"
+	}
+}
+
+// LastRefreshReason returns the reason the token function was most
+// recently invoked for, as also reported by LastFetchStats. If the token
+// function was not invoked yet, false is returned.
+func (jwtCache *Cache) LastRefreshReason() (RefreshReason, bool) {
+	stats, ok := jwtCache.LastFetchStats()
+	return stats.Reason, ok
+}
+
+// ensure returns either the cached token state if existing and still
+// valid, or the state of a freshly fetched token.
+func (jwtCache *Cache) ensure(ctx context.Context) (tokenState, error) {
+	jwtCache.detectClockJump()
+
+	// Do we have a cached jwt, and its still valid?
+	if state, ok := jwtCache.cachedState(); ok && jwtCache.revalidate(state) {
+		jwtCache.emit(ctx, EventHit, nil)
+		jwtCache.observer.OnCacheHit()
+		return state, nil
+	}
+
+	if err := jwtCache.acquireRefresh(ctx); err != nil {
+		return tokenState{}, err
+	}
+	defer jwtCache.releaseRefresh()
+
+	// Another caller might have refreshed the token while we waited
+	if state, ok := jwtCache.cachedState(); ok && jwtCache.revalidate(state) {
+		jwtCache.emit(ctx, EventHit, nil)
+		jwtCache.observer.OnCacheHit()
+		return state, nil
+	}
+
+	jwtCache.emit(ctx, EventMiss, nil)
+
+	if jwtCache.warmupDue() {
+		state, err := jwtCache.refresh(ctx, RefreshWarmup)
+		if err != nil {
+			jwtCache.logger.Infof("Error while warming up %s, falling back to token function: %s", jwtCache.name, err)
+		} else if cachedState, ok := jwtCache.cachedState(); ok && cachedState.token == state.token {
+			return state, nil
+		} else {
+			jwtCache.logger.Infof("Warmup token of %s cannot be served, falling back to token function", jwtCache.name)
+		}
+	}
+
+	state, err := jwtCache.refresh(ctx, jwtCache.missReason())
+	if err != nil && jwtCache.serveUnexpiredOnError {
+		if unexpiredState, ok := jwtCache.unexpiredState(); ok {
+			jwtCache.logger.Infof("Error while refreshing %s, serving cached token till its expiry: %s", jwtCache.name, err)
+			return unexpiredState, nil
+		}
+	}
+
+	if err != nil && jwtCache.secondary != nil {
+		jwtCache.logger.Infof("Error while refreshing %s, falling back to secondary cache: %s", jwtCache.name, err)
+
+		if secondaryState, secondaryErr := jwtCache.secondary.ensure(ctx); secondaryErr == nil {
+			return secondaryState, nil
+		}
+	}
+
+	return state, err
+}
+
+// warmupDue reports whether the Warmup function is to be invoked, and
+// marks the warmup as done. The warmup runs at most once, and not at all
+// if a token was cached before.
+func (jwtCache *Cache) warmupDue() bool {
+	if jwtCache.warmupFunc == nil {
+		return false
+	}
+
+	jwtCache.lockState()
+	defer jwtCache.unlockState()
+
+	due := !jwtCache.warmedUp
+	jwtCache.warmedUp = true
+
+	return due
+}
+
+// cachedState returns the state of the cached token, if existing
+// and still valid.
+func (jwtCache *Cache) cachedState() (tokenState, bool) {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	// The monotonic clock reading is stripped, so that validities carrying
+	// one (e.g. via ValidityRewriter) are compared against the wall clock,
+	// like the exp claim they are derived from. Jumps of the wall clock are
+	// handled via ClockJumpThreshold.
+	if jwtCache.jwt != "" && jwtCache.servable(jwtCache.now().Round(0)) {
+		return tokenState{
+			token:     jwtCache.jwt,
+			parsed:    jwtCache.parsed,
+			validity:  jwtCache.validity,
+			fromCache: true,
+		}, true
+	}
+
+	return tokenState{}, false
+}
+
+// parsedOf returns the parsed token of the given state. If the claims
+// of cached tokens are not retained, the token is parsed again.
+func (jwtCache *Cache) parsedOf(state tokenState) jwt.Token {
+	if state.parsed != nil || !state.fromCache || jwtCache.retainClaims {
+		return state.parsed
+	}
+
+	parsedToken, err := jwtCache.parse(state.token)
+	if err != nil {
+		return nil
+	}
+
+	return parsedToken
+}
+
+// unexpiredState returns the cached token, if it is not yet expired as
+// per its exp claim - regardless of the headroom.
+func (jwtCache *Cache) unexpiredState() (tokenState, bool) {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	now := jwtCache.now().Round(0)
+	if jwtCache.jwt == "" || now.Before(jwtCache.validFrom) || !now.Before(jwtCache.expiration) {
+		return tokenState{}, false
+	}
+
+	return tokenState{
+		token:     jwtCache.jwt,
+		parsed:    jwtCache.parsed,
+		validity:  jwtCache.validity,
+		fromCache: true,
+	}, true
+}
+
+// store caches the given token. The caller must hold the lock.
+func (jwtCache *Cache) store(token string, parsedToken jwt.Token, iat time.Time, exp time.Time) {
+	jwtCache.jwt = token
+	jwtCache.parsed = nil
+	if jwtCache.retainClaims {
+		jwtCache.parsed = parsedToken
+	}
+	jwtCache.issuedAt = iat
+	jwtCache.storedWall = jwtCache.now().Round(0)
+	jwtCache.storedMono = jwtCache.monotonic()
+	jwtCache.warmedUp = true
+	jwtCache.noExpLogged = false
+	jwtCache.validity = jwtCache.rewriteValidity(jwtCache.validityFor(iat, exp), parsedToken)
+	jwtCache.validFrom = parsedToken.NotBefore()
+	jwtCache.expiration = exp
+}
+
+// validityFor computes the point in time, till which a token with the
+// given iat and exp claims is served from the cache.
+func (jwtCache *Cache) validityFor(iat time.Time, exp time.Time) time.Time {
+	if jwtCache.usesLifetimeFraction(iat, exp) {
+		lifetime := exp.Sub(iat)
+		return iat.Add(time.Duration(float64(lifetime) * jwtCache.lifetimeFraction))
+	}
+
+	return exp.Add(-jwtCache.headroom)
+}
+
+// usesLifetimeFraction reports whether the validity of a token with the
+// given iat and exp claims is computed via RefreshAtLifetimeFraction,
+// instead of the headroom. Tokens without exp (see TreatNoExpAsValid) are
+// excluded, as the fraction of their lifetime overflows a time.Duration.
+func (jwtCache *Cache) usesLifetimeFraction(iat time.Time, exp time.Time) bool {
+	return jwtCache.lifetimeFraction > 0 && jwtCache.lifetimeFraction <= 1 && !iat.IsZero() && !exp.Equal(farFuture)
+}
+
+// rewriteValidity applies the ValidityRewriter to the computed validity.
+// The rewritten validity is capped at the computed one, so that it can
+// only ever be shortened.
+func (jwtCache *Cache) rewriteValidity(computed time.Time, token jwt.Token) time.Time {
+	if jwtCache.validityRewriter == nil {
+		return computed
+	}
+
+	if rewritten := jwtCache.validityRewriter(computed, token); rewritten.Before(computed) {
+		return rewritten
+	}
+
+	return computed
+}
+
+// missReason determines why the cached token (if any) cannot be served.
+func (jwtCache *Cache) missReason() RefreshReason {
+	jwtCache.lock.RLock()
+	defer jwtCache.lock.RUnlock()
+
+	now := jwtCache.now().Round(0)
+
+	switch {
+	case jwtCache.rejected:
+		return RefreshRejected
+	case jwtCache.invalidated:
+		return RefreshInvalidated
+	case jwtCache.jwt == "" && jwtCache.lastRefresh.IsZero():
+		return RefreshInitial
+	case jwtCache.jwt == "":
+		return RefreshNotCached
+	case now.Before(jwtCache.validFrom):
+		return RefreshNotYetValid
+	case !jwtCache.pinnedUntil.IsZero() && !now.Before(jwtCache.pinnedUntil) && jwtCache.pinnedUntil.After(jwtCache.validity):
+		return RefreshPinExpired
+	default:
+		return RefreshExpired
+	}
+}
+
+// servable checks if the cached token may be served at the given
+// point in time. The caller must hold the lock.
+func (jwtCache *Cache) servable(now time.Time) bool {
+	// A token with a nbf claim in the future is not served from the cache
+	if now.Before(jwtCache.validFrom) {
+		return false
+	}
+
+	if now.Add(jwtCache.minRemaining).Before(jwtCache.validity) {
+		return true
+	}
+
+	// A pinned token is served past its validity, but never past its expiry
+	return now.Before(jwtCache.pinnedUntil) && now.Before(jwtCache.expiration)
+}
+
+// acquireRefresh waits till no other refresh is in progress,
+// or till the context is done.
+func (jwtCache *Cache) acquireRefresh(ctx context.Context) error {
+	select {
+	case jwtCache.refreshLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (jwtCache *Cache) releaseRefresh() {
+	<-jwtCache.refreshLock
+}
+
+// refresh fetches a new token via the token function, and caches it
+// if possible. The caller must hold the refresh lock.
+func (jwtCache *Cache) refresh(ctx context.Context, reason RefreshReason) (state tokenState, err error) {
+	if err := jwtCache.limiter.acquire(ctx); err != nil {
+		jwtCache.fail(ctx, err)
+		return tokenState{}, err
+	}
+	defer jwtCache.limiter.release()
+
+	jwtCache.observer.OnStart()
+
+	logName := jwtCache.name
+	if correlationID := jwtCache.correlationID(ctx); correlationID != "" {
+		logName += " (correlation ID " + correlationID + ")"
+	}
+
+	start := jwtCache.now()
+	defer func() {
+		duration := jwtCache.now().Sub(start)
+
+		jwtCache.lockState()
+		jwtCache.lastFetch = FetchStats{
+			Start:    start,
+			Duration: duration,
+			Success:  err == nil,
+			Reason:   reason,
+		}
+		jwtCache.unlockState()
+
+		if err == nil {
+			jwtCache.recorder.ObserveRefresh(duration)
+		}
+	}()
+
+	fetch := jwtCache.tokenFunc
+	if reason == RefreshWarmup {
+		fetch = jwtCache.warmupFunc
+	}
+
+	token, err := callTokenFunction(ctx, fetch)
+	if err != nil {
+		jwtCache.fail(ctx, err)
+		return tokenState{}, err
+	}
+
+	if jwtCache.logFingerprint {
+		logName += " (fingerprint " + fingerprint(token) + ")"
+	}
+
+	// Reject oversized tokens, and tokens signed with unexpected keys or
+	// algorithms early, before parsing
+	if err := jwtCache.validateSegmentSizes(token); err != nil {
+		jwtCache.reject(ctx, err)
+		return tokenState{}, err
+	}
+
+	if err := jwtCache.validateHeader(token); err != nil {
+		jwtCache.reject(ctx, err)
+		return tokenState{}, err
+	}
+
+	// Work with the parsed token - but don't fail, if we encounter an error
+	var validity time.Time
+	var notCached NotCachedReason
+
+	parsedToken, err := jwtCache.parse(token)
+	if err != nil && jwtCache.rejectUnparsable {
+		jwtCache.reject(ctx, err)
+		return tokenState{}, err
+	}
+
+	if err == nil {
+		if err := jwtCache.validate(parsedToken); err != nil {
+			jwtCache.reject(ctx, err)
+			return tokenState{}, err
+		}
+
+		if err := jwtCache.checkNonce(parsedToken, logName); err != nil {
+			jwtCache.reject(ctx, err)
+			return tokenState{}, err
+		}
+
+		cacheable := jwtCache.shouldCache == nil || jwtCache.shouldCache(parsedToken)
+		logger := jwtCache.claimLogger(parsedToken)
+
+		jwtCache.lockState()
+
+		// Note: According to https://tools.ietf.org/html/rfc7519,
 		// a "NumericDate" is defined as a UTC unix timestamp.
 		iat := parsedToken.IssuedAt()
 		exp := parsedToken.Expiration()
 
+		// Trusted tokens without exp never expire, if opted in
+		if exp.IsZero() && jwtCache.treatNoExpAsValid {
+			exp = farFuture
+		}
+
 		if exp.IsZero() {
 			jwtCache.jwt = ""
-			jwtCache.logger.Infof("New %s received. Not 'exp' header set, so not caching", jwtCache.name)
+			jwtCache.parsed = nil
+			notCached = ReasonNoExpiry
+
+			// Only log the first of consecutive tokens without exp on info
+			// level, so that an issuer never setting exp does not flood the logs
+			if jwtCache.noExpLogged {
+				logger.Debugf("New %s received. Not 'exp' header set, so not caching", logName)
+			} else {
+				logger.Infof("New %s received. Not 'exp' header set, so not caching", logName)
+				jwtCache.noExpLogged = true
+			}
+		} else if !cacheable {
+			jwtCache.jwt = ""
+			jwtCache.parsed = nil
+			notCached = ReasonShouldCache
+
+			logger.Debugf("New %s received. Rejected by cache predicate, so not caching", logName)
 		} else {
 			// Cache the new token (and leave some headroom)
-			jwtCache.jwt = token
-			jwtCache.validity = exp.Add(-jwtCache.headroom)
+			jwtCache.store(token, parsedToken, iat, exp)
+			validity = jwtCache.validity
+
+			// Warn once about a headroom larger than the token lifetime (or
+			// a lifetime fraction already passed), as such tokens are
+			// refreshed on every call
+			if !jwtCache.headroomLogged && !jwtCache.validity.After(jwtCache.now()) {
+				if jwtCache.usesLifetimeFraction(iat, exp) {
+					logger.Infof(
+						"New %s received with a remaining lifetime of %s, which already passed the lifetime fraction of %v. The token is refreshed on every call",
+						logName,
+						exp.Sub(jwtCache.now()).Round(time.Second),
+						jwtCache.lifetimeFraction,
+					)
+				} else {
+					logger.Infof(
+						"New %s received with a remaining lifetime of %s, which is not larger than the headroom of %s. The token is refreshed on every call",
+						logName,
+						exp.Sub(jwtCache.now()).Round(time.Second),
+						jwtCache.headroom,
+					)
+				}
+				jwtCache.headroomLogged = true
+			}
 
-			if !iat.IsZero() {
-				jwtCache.logger.Debugf(
+			if jwtCache.usesLifetimeFraction(iat, exp) {
+				// The headroom does not apply to the validity in this mode
+				logger.Debugf(
 					"New %s received. Caching for %s",
-					jwtCache.name,
-					jwtCache.validity.Sub(iat.Add(-jwtCache.headroom)),
+					logName,
+					jwtCache.roundForLog(jwtCache.validity.Sub(iat)),
+				)
+			} else if !iat.IsZero() {
+				logger.Debugf(
+					"New %s received. Caching for %s",
+					logName,
+					jwtCache.roundForLog(jwtCache.validity.Sub(iat.Add(-jwtCache.headroom))),
 				)
 			} else {
-				jwtCache.logger.Debugf(
+				logger.Debugf(
 					"New %s received. Caching till %s",
-					jwtCache.name,
-					jwtCache.validity.Add(-jwtCache.headroom),
+					logName,
+					jwtCache.validity.Add(-jwtCache.headroom).Round(jwtCache.logRounding),
 				)
 			}
 		}
+
+		jwtCache.unlockState()
 	} else {
-		jwtCache.logger.Debugf("Error while parsing %s: %s", jwtCache.name, err)
+		jwtCache.logger.Debugf("Error while parsing %s: %s", logName, err)
+		notCached = ReasonUnparsable
+	}
+
+	// Only record successful refreshes, so that rejected tokens neither
+	// count as refresh, nor as change of the token
+	tokenHash := sha256.Sum256([]byte(token))
+
+	jwtCache.lockState()
+	jwtCache.tokenChanged = !jwtCache.lastRefresh.IsZero() && tokenHash != jwtCache.lastTokenHash
+	jwtCache.lastTokenHash = tokenHash
+	jwtCache.lastRefresh = jwtCache.now()
+	jwtCache.invalidated = false
+	jwtCache.rejected = false
+	jwtCache.unlockState()
+
+	atomic.AddUint64(&jwtCache.refreshCount, 1)
+
+	jwtCache.emit(ctx, EventRefresh, nil)
+	jwtCache.observer.OnSuccess(validity)
+	jwtCache.scheduleEagerRefresh(validity)
+
+	state = tokenState{token: token, validity: validity, notCached: notCached}
+	if err == nil {
+		state.parsed = parsedToken
 	}
 
-	return token, nil
+	return state, nil
+}
+
+// roundForLog rounds the given duration as configured via
+// LogDurationRounding, for readable logs.
+func (jwtCache *Cache) roundForLog(d time.Duration) time.Duration {
+	if jwtCache.logRounding <= 0 {
+		return d
+	}
+
+	return d.Round(jwtCache.logRounding)
+}
+
+// claimLogger returns the logger for the refresh log of the given token,
+// which carries the claims configured via LogClaims. Loggers supporting
+// structured fields (such as logrus) receive them as fields, while all
+// other loggers receive them appended to the message.
+func (jwtCache *Cache) claimLogger(token jwt.Token) LoggerContract {
+	if len(jwtCache.logClaims) == 0 {
+		return jwtCache.logger
+	}
+
+	fields := logrus.Fields{}
+	pairs := make([]string, 0, len(jwtCache.logClaims))
+	for _, name := range jwtCache.logClaims {
+		if value, ok := token.Get(name); ok {
+			fields[name] = value
+			pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+		}
+	}
+
+	if fieldLogger, ok := jwtCache.logger.(logrus.FieldLogger); ok {
+		return fieldLogger.WithFields(fields)
+	}
+
+	return suffixLogger{logger: jwtCache.logger, suffix: strings.Join(pairs, ", ")}
+}
+
+// suffixLogger appends a suffix to every message of the wrapped logger.
+type suffixLogger struct {
+	logger LoggerContract
+	suffix string
+}
+
+func (logger suffixLogger) Infof(format string, args ...interface{}) {
+	logger.logger.Infof(format+" (%s)", append(args, logger.suffix)...)
+}
+
+func (logger suffixLogger) Debugf(format string, args ...interface{}) {
+	logger.logger.Debugf(format+" (%s)", append(args, logger.suffix)...)
+}
+
+// callTokenFunction invokes the given token function, and converts a
+// panic of it into a TokenFunctionPanicError.
+func callTokenFunction(ctx context.Context, tokenFunc func(ctx context.Context) (string, error)) (token string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			token, err = "", &TokenFunctionPanicError{Value: recovered}
+		}
+	}()
+
+	return tokenFunc(ctx)
+}
+
+// fail notifies about a failed refresh.
+func (jwtCache *Cache) fail(ctx context.Context, err error) {
+	jwtCache.emit(ctx, EventError, err)
+	jwtCache.observer.OnError(err)
+}
+
+// reject notifies about a failed refresh due to a rejected token, and
+// records the rejection for the reason of the next refresh.
+func (jwtCache *Cache) reject(ctx context.Context, err error) {
+	jwtCache.lockState()
+	jwtCache.rejected = true
+	jwtCache.unlockState()
+
+	jwtCache.fail(ctx, err)
+}
+
+func (jwtCache *Cache) emit(ctx context.Context, eventType EventType, err error) {
+	switch eventType {
+	case EventHit:
+		atomic.AddUint64(&jwtCache.hitCount, 1)
+		jwtCache.recorder.IncHit()
+	case EventMiss:
+		atomic.AddUint64(&jwtCache.missCount, 1)
+		jwtCache.recorder.IncMiss()
+	case EventError:
+		atomic.AddUint64(&jwtCache.errorCount, 1)
+		jwtCache.recorder.IncError()
+	}
+
+	jwtCache.events.emit(ctx, Event{
+		Type:          eventType,
+		Name:          jwtCache.name,
+		CorrelationID: jwtCache.correlationID(ctx),
+		Err:           err,
+	})
+}
+
+// correlationID extracts the correlation ID from the given context,
+// if configured.
+func (jwtCache *Cache) correlationID(ctx context.Context) string {
+	if jwtCache.correlationIDFunc == nil {
+		return ""
+	}
+
+	return jwtCache.correlationIDFunc(ctx)
+}
+
+// AuthorizationHeader returns the token as provided by EnsureToken, formatted
+// as a value for the HTTP Authorization header (e.g. "Bearer xyz"). If the
+// token function already returned a token with a "Bearer" prefix, the
+// prefix is not applied twice.
+func (jwtCache *Cache) AuthorizationHeader(ctx context.Context) (string, error) {
+	token, err := jwtCache.EnsureToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return bearer(token), nil
+}
+
+// bearer prefixes the given token with "Bearer ", if not already present.
+func bearer(token string) string {
+	const prefix = "Bearer "
+
+	if len(token) >= len(prefix) && strings.EqualFold(token[:len(prefix)], prefix) {
+		return prefix + token[len(prefix):]
+	}
+
+	return prefix + token
+}
+
+// fingerprint returns a short, non-reversible fingerprint of the given
+// token, for use in logs.
+func fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
 }
@@ -1,11 +1,14 @@
 package jwt
 
 import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -122,3 +125,728 @@ func Test_Option_RejectUnparsable(t *testing.T) {
 		t.Errorf("reject unparsable not correctly applied, got %t", options.rejectUnparsable)
 	}
 }
+
+// Tests that the Events option correctly applies.
+func Test_Option_Events(t *testing.T) {
+	// given
+	events := make(chan Event)
+	option := Events(events, BlockEvents)
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if options.events.events != events || options.events.policy != BlockEvents {
+		t.Errorf("events not correctly applied, got %v", options.events)
+	}
+}
+
+// Tests that the RequiredScopes option correctly applies.
+func Test_Option_RequiredScopes(t *testing.T) {
+	// given
+	option := RequiredScopes("read", "write")
+	options := &config{requiredScopes: []string{"admin"}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.requiredScopes) != 2 || options.requiredScopes[0] != "read" || options.requiredScopes[1] != "write" {
+		t.Errorf("required scopes not correctly applied, got %s", options.requiredScopes)
+	}
+}
+
+// Tests that the Clock option correctly applies.
+func Test_Option_Clock(t *testing.T) {
+	// given
+	fixed := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	option := Clock(func() time.Time { return fixed })
+	options := &config{now: time.Now}
+
+	// when
+	option(options)
+
+	// then
+	if now := options.now(); !now.Equal(fixed) {
+		t.Errorf("clock not correctly applied, got %s", now)
+	}
+}
+
+// Tests that the Observer option correctly applies.
+func Test_Option_Observer(t *testing.T) {
+	// given
+	first := &recordingObserver{}
+	second := &recordingObserver{}
+	options := &config{}
+
+	// when
+	Observer(first)(options)
+	Observer(second)(options)
+
+	// then
+	if len(options.observers) != 2 || options.observers[0] != first || options.observers[1] != second {
+		t.Errorf("observers not correctly applied, got %v", options.observers)
+	}
+}
+
+// Tests that the CorrelationID option correctly applies.
+func Test_Option_CorrelationID(t *testing.T) {
+	// given
+	option := CorrelationID(func(ctx context.Context) string {
+		return "some-id"
+	})
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if id := options.correlationIDFunc(context.Background()); id != "some-id" {
+		t.Errorf("correlation ID not correctly applied, got %s", id)
+	}
+}
+
+// Tests that the Secondary option correctly applies.
+func Test_Option_Secondary(t *testing.T) {
+	// given
+	secondary := NewCache()
+	option := Secondary(secondary)
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if options.secondary != secondary {
+		t.Errorf("secondary not correctly applied, got %v", options.secondary)
+	}
+}
+
+// Tests that the AllowedKeyIDs option correctly applies.
+func Test_Option_AllowedKeyIDs(t *testing.T) {
+	// given
+	option := AllowedKeyIDs("key-1", "key-2")
+	options := &config{allowedKeyIDs: []string{"key-3"}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedKeyIDs) != 2 || options.allowedKeyIDs[0] != "key-1" || options.allowedKeyIDs[1] != "key-2" {
+		t.Errorf("allowed key IDs not correctly applied, got %s", options.allowedKeyIDs)
+	}
+}
+
+// Tests that the ScopeClaim option correctly applies.
+func Test_Option_ScopeClaim(t *testing.T) {
+	// given
+	option := ScopeClaim("scp")
+	options := &config{scopeClaim: "scope"}
+
+	// when
+	option(options)
+
+	// then
+	if options.scopeClaim != "scp" {
+		t.Errorf("scope claim not correctly applied, got %s", options.scopeClaim)
+	}
+}
+
+// Tests that the NonceTracking option correctly applies.
+func Test_Option_NonceTracking(t *testing.T) {
+	// given
+	option := NonceTracking(NonceReject)
+	options := &config{noncePolicy: NonceIgnore}
+
+	// when
+	option(options)
+
+	// then
+	if options.noncePolicy != NonceReject {
+		t.Errorf("nonce policy not correctly applied, got %d", options.noncePolicy)
+	}
+}
+
+// Tests that the ShouldCache option correctly applies.
+func Test_Option_ShouldCache(t *testing.T) {
+	// given
+	called := false
+	option := ShouldCache(func(token jwt.Token) bool {
+		called = true
+		return false
+	})
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if options.shouldCache == nil {
+		t.Fatal("should cache predicate not correctly applied")
+	}
+
+	if options.shouldCache(jwt.New()) || !called {
+		t.Error("should cache predicate not correctly applied")
+	}
+}
+
+// Tests that the MaxTokenAge option correctly applies.
+func Test_Option_MaxTokenAge(t *testing.T) {
+	// given
+	option := MaxTokenAge(time.Hour)
+	options := &config{maxTokenAge: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxTokenAge != time.Hour {
+		t.Errorf("max token age not correctly applied, got %s", options.maxTokenAge)
+	}
+}
+
+// Tests that the ClaimValidators option correctly applies,
+// and appends to previously registered validators.
+func Test_Option_ClaimValidators(t *testing.T) {
+	// given
+	first := func(token jwt.Token) error { return errors.New("first") }
+	second := func(token jwt.Token) error { return errors.New("second") }
+	option := ClaimValidators(second)
+	options := &config{claimValidators: []ClaimValidator{first}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.claimValidators) != 2 ||
+		options.claimValidators[0](nil).Error() != "first" ||
+		options.claimValidators[1](nil).Error() != "second" {
+		t.Error("claim validators not correctly applied")
+	}
+}
+
+// Tests that the AggregateValidationErrors option correctly applies.
+func Test_Option_AggregateValidationErrors(t *testing.T) {
+	// given
+	option := AggregateValidationErrors(true)
+	options := &config{aggregateValidation: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.aggregateValidation {
+		t.Error("aggregate validation flag not correctly applied")
+	}
+}
+
+// Tests that the NormalizeClaimKeys option correctly applies.
+func Test_Option_NormalizeClaimKeys(t *testing.T) {
+	// given
+	option := NormalizeClaimKeys(true)
+	options := &config{normalizeClaimKeys: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.normalizeClaimKeys {
+		t.Error("normalize claim keys flag not correctly applied")
+	}
+}
+
+// Tests that the AllowedAlgorithms option correctly applies.
+func Test_Option_AllowedAlgorithms(t *testing.T) {
+	// given
+	option := AllowedAlgorithms(jwa.RS256, jwa.ES256)
+	options := &config{allowedAlgorithms: []jwa.SignatureAlgorithm{jwa.HS256}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedAlgorithms) != 2 || options.allowedAlgorithms[0] != jwa.RS256 || options.allowedAlgorithms[1] != jwa.ES256 {
+		t.Errorf("allowed algorithms not correctly applied, got %s", options.allowedAlgorithms)
+	}
+}
+
+// Tests that the VerifyWithKeyLookup option correctly applies.
+func Test_Option_VerifyWithKeyLookup(t *testing.T) {
+	// given
+	called := false
+	option := VerifyWithKeyLookup(func(alg jwa.SignatureAlgorithm, kid string) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	options := &config{keyLookup: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.keyLookup == nil {
+		t.Fatal("key lookup not correctly applied")
+	}
+
+	if _, _ = options.keyLookup(jwa.HS256, ""); !called {
+		t.Error("key lookup not correctly applied")
+	}
+}
+
+// Tests that the Warmup option correctly applies.
+func Test_Option_Warmup(t *testing.T) {
+	// given
+	option := Warmup(func(ctx context.Context) (string, error) {
+		return "warmup", nil
+	})
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if options.warmupFunc == nil {
+		t.Fatal("warmup function not correctly applied")
+	}
+
+	if token, _ := options.warmupFunc(context.Background()); token != "warmup" {
+		t.Error("warmup function not correctly applied")
+	}
+}
+
+// Tests that the LogFingerprint option correctly applies.
+func Test_Option_LogFingerprint(t *testing.T) {
+	// given
+	option := LogFingerprint(true)
+	options := &config{logFingerprint: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.logFingerprint {
+		t.Error("log fingerprint flag not correctly applied")
+	}
+}
+
+// Tests that the RefreshAtLifetimeFraction option correctly applies.
+func Test_Option_RefreshAtLifetimeFraction(t *testing.T) {
+	// given
+	option := RefreshAtLifetimeFraction(0.75)
+	options := &config{lifetimeFraction: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.lifetimeFraction != 0.75 {
+		t.Errorf("lifetime fraction not correctly applied, got %f", options.lifetimeFraction)
+	}
+}
+
+// Tests that the TreatNoExpAsValid option correctly applies.
+func Test_Option_TreatNoExpAsValid(t *testing.T) {
+	// given
+	option := TreatNoExpAsValid(true)
+	options := &config{treatNoExpAsValid: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.treatNoExpAsValid {
+		t.Error("treat no exp as valid flag not correctly applied")
+	}
+}
+
+// Tests that the RevalidateOnEveryAccess option correctly applies.
+func Test_Option_RevalidateOnEveryAccess(t *testing.T) {
+	// given
+	option := RevalidateOnEveryAccess(true)
+	options := &config{revalidateOnAccess: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.revalidateOnAccess {
+		t.Error("revalidate on every access flag not correctly applied")
+	}
+}
+
+// Tests that the ExpectedSubject option correctly applies.
+func Test_Option_ExpectedSubject(t *testing.T) {
+	// given
+	option := ExpectedSubject("billing-service")
+	options := &config{expectedSubject: ""}
+
+	// when
+	option(options)
+
+	// then
+	if options.expectedSubject != "billing-service" {
+		t.Errorf("expected subject not correctly applied, got %s", options.expectedSubject)
+	}
+}
+
+// Tests that the MinRemainingToServe option correctly applies.
+func Test_Option_MinRemainingToServe(t *testing.T) {
+	// given
+	option := MinRemainingToServe(time.Minute)
+	options := &config{minRemaining: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.minRemaining != time.Minute {
+		t.Errorf("min remaining not correctly applied, got %s", options.minRemaining)
+	}
+}
+
+// Tests that the StrictExpiry option correctly applies.
+func Test_Option_StrictExpiry(t *testing.T) {
+	// given
+	option := StrictExpiry(true, time.Hour)
+	options := &config{strictExpiry: false, maxTTL: 0}
+
+	// when
+	option(options)
+
+	// then
+	if !options.strictExpiry || options.maxTTL != time.Hour {
+		t.Errorf("strict expiry not correctly applied, got %t and %s", options.strictExpiry, options.maxTTL)
+	}
+}
+
+// Tests that the KeySet option correctly applies.
+func Test_Option_KeySet(t *testing.T) {
+	// given
+	set := jwk.NewSet()
+	option := KeySet(func() (jwk.Set, error) {
+		return set, nil
+	})
+	options := &config{}
+
+	// when
+	option(options)
+
+	// then
+	if options.keySetLoader == nil {
+		t.Fatal("key set loader not correctly applied")
+	}
+
+	if loaded, _ := options.keySetLoader(); loaded != set {
+		t.Error("key set loader not correctly applied")
+	}
+}
+
+// Tests that the HeartbeatInterval option correctly applies.
+func Test_Option_HeartbeatInterval(t *testing.T) {
+	// given
+	option := HeartbeatInterval(time.Minute)
+	options := &config{heartbeatInterval: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.heartbeatInterval != time.Minute {
+		t.Error("heartbeat interval not correctly applied")
+	}
+}
+
+// Tests that the NotBeforeIssuedAt option correctly applies.
+func Test_Option_NotBeforeIssuedAt(t *testing.T) {
+	// given
+	cutoff := time.Now()
+	option := NotBeforeIssuedAt(cutoff)
+	options := &config{issuedAfter: time.Time{}}
+
+	// when
+	option(options)
+
+	// then
+	if !options.issuedAfter.Equal(cutoff) {
+		t.Error("issuance cutoff not correctly applied")
+	}
+}
+
+// Tests that the LogDurationRounding option correctly applies.
+func Test_Option_LogDurationRounding(t *testing.T) {
+	// given
+	option := LogDurationRounding(time.Second)
+	options := &config{logRounding: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.logRounding != time.Second {
+		t.Error("log duration rounding not correctly applied")
+	}
+}
+
+// Tests that the LogClaims option correctly applies.
+func Test_Option_LogClaims(t *testing.T) {
+	// given
+	option := LogClaims("sub", "scope")
+	options := &config{logClaims: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.logClaims) != 2 || options.logClaims[0] != "sub" || options.logClaims[1] != "scope" {
+		t.Errorf("log claims not correctly applied, got %s", options.logClaims)
+	}
+}
+
+// Tests that the RetainClaims option correctly applies.
+func Test_Option_RetainClaims(t *testing.T) {
+	// given
+	option := RetainClaims(false)
+	options := &config{retainClaims: true}
+
+	// when
+	option(options)
+
+	// then
+	if options.retainClaims {
+		t.Error("retain claims flag not correctly applied")
+	}
+}
+
+// Tests that the RecordLockStats option correctly applies.
+func Test_Option_RecordLockStats(t *testing.T) {
+	// given
+	option := RecordLockStats(true)
+	options := &config{recordLockStats: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.recordLockStats {
+		t.Error("record lock stats flag not correctly applied")
+	}
+}
+
+// Tests that the Verifier option correctly applies.
+func Test_Option_Verifier(t *testing.T) {
+	// given
+	verifier := &fakeVerifier{}
+	option := Verifier(verifier)
+	options := &config{verifier: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.verifier != verifier {
+		t.Error("verifier not correctly applied")
+	}
+}
+
+// Tests that the ValidityRewriter option correctly applies.
+func Test_Option_ValidityRewriter(t *testing.T) {
+	// given
+	fixed := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	option := ValidityRewriter(func(computed time.Time, token jwt.Token) time.Time { return fixed })
+	options := &config{validityRewriter: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.validityRewriter == nil || !options.validityRewriter(time.Now(), nil).Equal(fixed) {
+		t.Error("validity rewriter not correctly applied")
+	}
+}
+
+// Tests that the AllowedIssuers option correctly applies.
+func Test_Option_AllowedIssuers(t *testing.T) {
+	// given
+	option := AllowedIssuers("issuer-a", "issuer-b")
+	options := &config{allowedIssuers: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedIssuers) != 2 || options.allowedIssuers[0] != "issuer-a" || options.allowedIssuers[1] != "issuer-b" {
+		t.Errorf("allowed issuers not correctly applied, got %s", options.allowedIssuers)
+	}
+}
+
+// Tests that the ServeWithinRealExpiryOnError option correctly applies.
+func Test_Option_ServeWithinRealExpiryOnError(t *testing.T) {
+	// given
+	option := ServeWithinRealExpiryOnError(true)
+	options := &config{serveUnexpiredOnError: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.serveUnexpiredOnError {
+		t.Error("serve within real expiry flag not correctly applied")
+	}
+}
+
+// Tests that the MaxHeaderBytes option correctly applies.
+func Test_Option_MaxHeaderBytes(t *testing.T) {
+	// given
+	option := MaxHeaderBytes(1024)
+	options := &config{maxHeaderBytes: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxHeaderBytes != 1024 {
+		t.Error("max header bytes not correctly applied")
+	}
+}
+
+// Tests that the MaxPayloadBytes option correctly applies.
+func Test_Option_MaxPayloadBytes(t *testing.T) {
+	// given
+	option := MaxPayloadBytes(1024)
+	options := &config{maxPayloadBytes: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxPayloadBytes != 1024 {
+		t.Error("max payload bytes not correctly applied")
+	}
+}
+
+// Tests that the RefreshKeysOnVerificationFailure option correctly applies.
+func Test_Option_RefreshKeysOnVerificationFailure(t *testing.T) {
+	// given
+	option := RefreshKeysOnVerificationFailure(true)
+	options := &config{refreshKeysOnFailure: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.refreshKeysOnFailure {
+		t.Error("refresh keys on verification failure flag not correctly applied")
+	}
+}
+
+// Tests that the Recorder option correctly applies.
+func Test_Option_Recorder(t *testing.T) {
+	// given
+	recorder := &fakeRecorder{}
+	option := Recorder(recorder)
+	options := &config{recorder: NoopRecorder{}}
+
+	// when
+	option(options)
+
+	// then
+	if options.recorder != recorder {
+		t.Error("recorder not correctly applied")
+	}
+}
+
+// Tests that the ExpectedAudience option correctly applies.
+func Test_Option_ExpectedAudience(t *testing.T) {
+	// given
+	option := ExpectedAudience("api-a", "api-b")
+	options := &config{expectedAudiences: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.expectedAudiences) != 2 || options.expectedAudiences[0] != "api-a" || options.expectedAudiences[1] != "api-b" {
+		t.Errorf("expected audiences not correctly applied, got %s", options.expectedAudiences)
+	}
+}
+
+// Tests that the RequireAllAudiences option correctly applies.
+func Test_Option_RequireAllAudiences(t *testing.T) {
+	// given
+	option := RequireAllAudiences(true)
+	options := &config{requireAllAudiences: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.requireAllAudiences {
+		t.Error("require all audiences flag not correctly applied")
+	}
+}
+
+// Tests that the EagerRefresh option correctly applies.
+func Test_Option_EagerRefresh(t *testing.T) {
+	// given
+	option := EagerRefresh(5 * time.Minute)
+	options := &config{eagerRefreshMargin: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.eagerRefreshMargin != 5*time.Minute {
+		t.Errorf("eager refresh margin not correctly applied, got %s", options.eagerRefreshMargin)
+	}
+}
+
+// Tests that the AcceptFunc option correctly applies.
+func Test_Option_AcceptFunc(t *testing.T) {
+	// given
+	option := AcceptFunc(func(token jwt.Token) (bool, error) { return false, nil })
+	options := &config{acceptFunc: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.acceptFunc == nil {
+		t.Fatal("accept func not correctly applied")
+	}
+
+	if accepted, _ := options.acceptFunc(nil); accepted {
+		t.Error("accept func not correctly applied")
+	}
+}
+
+// Tests that the ClockJumpThreshold option correctly applies.
+func Test_Option_ClockJumpThreshold(t *testing.T) {
+	// given
+	option := ClockJumpThreshold(time.Minute)
+	options := &config{clockJumpThreshold: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.clockJumpThreshold != time.Minute {
+		t.Errorf("clock jump threshold not correctly applied, got %s", options.clockJumpThreshold)
+	}
+}
+
+// Tests that the SharedKeySet option correctly applies.
+func Test_Option_SharedKeySet(t *testing.T) {
+	// given
+	keys := NewSharedKeys(func() (jwk.Set, error) { return jwk.NewSet(), nil })
+	option := SharedKeySet(keys)
+	options := &config{sharedKeys: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.sharedKeys != keys {
+		t.Error("shared key set not correctly applied")
+	}
+}
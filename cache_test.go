@@ -4,14 +4,20 @@ import (
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -113,6 +119,21 @@ func Test_Cache_Defaults(t *testing.T) {
 	if cache.rejectUnparsable {
 		t.Error("default reject unparsable flag not correctly applied")
 	}
+
+	if cache.observer != (NoopObserver{}) {
+		t.Error("default observer not correctly applied")
+	}
+
+	if cache.scopeClaim != "scope" {
+		t.Error("default scope claim not correctly applied")
+	}
+
+	if !cache.retainClaims {
+		t.Error("default retain claims flag not correctly applied")
+	}
+	if _, ok := cache.recorder.(NoopRecorder); !ok {
+		t.Error("default recorder not correctly applied")
+	}
 }
 
 // Tests that EnsureToken returns the exact error, if any occurred
@@ -367,3 +388,2775 @@ func Test_Cache_EnsureToken_Signed_JWT(t *testing.T) {
 		t.Error("expected token, but got none")
 	}
 }
+
+// Tests that AuthorizationHeader correctly prefixes the token
+// with "Bearer ", without prefixing an already prefixed token twice.
+func Test_Cache_AuthorizationHeader(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]string{
+		"some-token":        "Bearer some-token",
+		"Bearer some-token": "Bearer some-token",
+		"bearer some-token": "Bearer some-token",
+	}
+
+	for token, expected := range tests {
+		token, expected := token, expected
+
+		t.Run(token, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (s string, e error) {
+					return token, nil
+				}),
+			)
+
+			// when
+			header, err := cache.AuthorizationHeader(context.Background())
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if header != expected {
+				t.Errorf("expected header %q, but got %q", expected, header)
+			}
+		})
+	}
+}
+
+// Tests that AuthorizationHeader returns the exact error, if any occurred
+// while retrieving a new token.
+func Test_Cache_AuthorizationHeader_TokenError(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	expectedErr := errors.New("expected error")
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (s string, e error) {
+			return "", expectedErr
+		}),
+	)
+
+	// when
+	header, err := cache.AuthorizationHeader(context.Background())
+
+	// then
+	if err != expectedErr {
+		t.Errorf("unexpected error while token function invocation: %s", err)
+	}
+
+	if header != "" {
+		t.Errorf("expected empty header, but received: %s", header)
+	}
+}
+
+// Tests that ForceRefresh fetches a new token, even if the
+// cached token is still valid.
+func Test_Cache_ForceRefresh(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	firstToken, firstErr := cache.EnsureToken(context.Background())
+	secondToken, secondErr := cache.ForceRefresh(context.Background())
+	thirdToken, thirdErr := cache.EnsureToken(context.Background())
+
+	// then
+	if firstErr != nil {
+		t.Errorf("error while first token function invocation: %s", firstErr)
+	}
+
+	if secondErr != nil {
+		t.Errorf("error while second token function invocation: %s", secondErr)
+	}
+
+	if thirdErr != nil {
+		t.Errorf("error while third token function invocation: %s", thirdErr)
+	}
+
+	if firstToken == secondToken {
+		t.Errorf("token was not refreshed")
+	}
+
+	if secondToken != thirdToken {
+		t.Errorf("refreshed token was not cached")
+	}
+}
+
+// Tests that concurrent EnsureToken calls share a single
+// invocation of the token function.
+func Test_Cache_EnsureToken_Concurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	tokenFunc := getTokenFunction()
+	counter := int32(0)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&counter, 1)
+			time.Sleep(10 * time.Millisecond)
+			return tokenFunc(ctx)
+		}),
+	)
+
+	// when
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// then
+	if count := atomic.LoadInt32(&counter); count != 1 {
+		t.Errorf("expected token function to be called once, but was called %d times", count)
+	}
+}
+
+// fakeClock is a manually controllable clock, for use with the Clock option.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+func (clock *fakeClock) Add(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+}
+
+// Tests that EnsureToken refreshes a token after a jump of the wall clock
+// relative to the monotonic clock, if the token is expired by either - a
+// forward jump by the wall clock, and a backward jump by the monotonic
+// time elapsed.
+func Test_Cache_EnsureToken_ClockJump(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		wall      time.Duration
+		monotonic time.Duration
+		fetches   int
+	}{
+		"forward":                     {wall: 2 * time.Hour, monotonic: time.Second, fetches: 2},
+		"backward, monotonic expired": {wall: -2 * time.Hour, monotonic: 90 * time.Minute, fetches: 2},
+		"backward, monotonic valid":   {wall: -2 * time.Hour, monotonic: 10 * time.Minute, fetches: 1},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			wall := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+			mono := &fakeMonotonic{}
+			calls := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getClockTokenFunction(wall, time.Hour, &calls)),
+				Clock(wall.Now),
+				ClockJumpThreshold(time.Minute),
+				mono.option(),
+			)
+
+			firstToken, firstErr := cache.EnsureToken(context.Background())
+
+			// when
+			wall.Add(test.wall)
+			mono.Add(test.monotonic)
+			secondToken, secondErr := cache.EnsureToken(context.Background())
+
+			// then
+			if firstErr != nil || secondErr != nil {
+				t.Fatalf("unexpected errors: %v, %v", firstErr, secondErr)
+			}
+
+			if refreshed := firstToken != secondToken; refreshed != (test.fetches > 1) || calls != test.fetches {
+				t.Errorf("expected %d fetches, but got %d", test.fetches, calls)
+			}
+		})
+	}
+}
+
+// fakeMonotonic is a manually controllable monotonic clock, for
+// simulating jumps of the wall clock along with a fakeClock.
+type fakeMonotonic struct {
+	lock    sync.Mutex
+	elapsed time.Duration
+}
+
+func (clock *fakeMonotonic) option() Option {
+	return func(c *config) {
+		c.monotonic = func() time.Duration {
+			clock.lock.Lock()
+			defer clock.lock.Unlock()
+
+			return clock.elapsed
+		}
+	}
+}
+
+func (clock *fakeMonotonic) Add(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.elapsed += d
+}
+
+// Tests that ClockJumpThreshold re-evaluates the validity of the cached
+// token after the wall clock jumped back, against the monotonic time
+// elapsed - which the wall clock alone cannot tell.
+func Test_Cache_EnsureToken_ClockJumpThreshold(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		threshold  time.Duration
+		monotonic  time.Duration
+		afterwards time.Duration
+		fetches    []int
+	}{
+		"expired by monotonic time":   {threshold: time.Minute, monotonic: 90 * time.Minute, fetches: []int{1, 2}},
+		"shortened by monotonic time": {threshold: time.Minute, monotonic: 10 * time.Minute, afterwards: 51 * time.Minute, fetches: []int{1, 1, 2}},
+		"disabled":                    {threshold: 0, monotonic: 90 * time.Minute, afterwards: 51 * time.Minute, fetches: []int{1, 1, 1}},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			wall := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+			mono := &fakeMonotonic{}
+			calls := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getClockTokenFunction(wall, time.Hour, &calls)),
+				Clock(wall.Now),
+				ClockJumpThreshold(test.threshold),
+				mono.option(),
+			)
+
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fetches := []int{calls}
+
+			// when
+			wall.Add(-2 * time.Hour)
+			mono.Add(test.monotonic)
+
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fetches = append(fetches, calls)
+
+			if test.afterwards > 0 {
+				wall.Add(test.afterwards)
+				mono.Add(test.afterwards)
+
+				if _, err := cache.EnsureToken(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				fetches = append(fetches, calls)
+			}
+
+			// then
+			if len(fetches) != len(test.fetches) {
+				t.Fatalf("expected fetches %v, but got %v", test.fetches, fetches)
+			}
+
+			for i := range fetches {
+				if fetches[i] != test.fetches[i] {
+					t.Errorf("expected fetches %v, but got %v", test.fetches, fetches)
+					break
+				}
+			}
+		})
+	}
+}
+
+// Tests that EnsureToken logs the decision to not cache a token
+// without exp claim only once on info level, till a token with
+// exp claim is received again.
+func Test_Cache_EnsureToken_NoExp_LogDeduplication(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	// given
+	withExp := false
+	withExpFunc := getTokenFunction()
+	withoutExpFunc := getTokenFunctionWithoutExp()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			if withExp {
+				return withExpFunc(ctx)
+			}
+			return withoutExpFunc(ctx)
+		}),
+	)
+
+	ensure := func() {
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	// when
+	ensure()
+	ensure()
+	ensure()
+
+	// then
+	if count := len(hook.AllEntries()); count != 1 {
+		t.Errorf("expected 1 log entry for repeated tokens without exp, but got %d", count)
+	}
+
+	// when
+	withExp = true
+	ensure()
+	withExp = false
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// then
+	if count := len(hook.AllEntries()); count != 2 {
+		t.Errorf("expected 2 log entries after a changed decision, but got %d", count)
+	}
+}
+
+// Tests that RefreshCount counts successful refreshes only,
+// not cache hits or failed refreshes.
+func Test_Cache_RefreshCount(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	fail := false
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			if fail {
+				return "", errors.New("expected error")
+			}
+			return tokenFunc(ctx)
+		}),
+	)
+
+	// when
+	initialCount := cache.RefreshCount()
+	_, _ = cache.EnsureToken(context.Background())
+	_, _ = cache.EnsureToken(context.Background())
+	firstCount := cache.RefreshCount()
+	_, _ = cache.ForceRefresh(context.Background())
+	secondCount := cache.RefreshCount()
+	fail = true
+	_, _ = cache.ForceRefresh(context.Background())
+	thirdCount := cache.RefreshCount()
+
+	// then
+	if initialCount != 0 {
+		t.Errorf("expected initial count of 0, but got %d", initialCount)
+	}
+
+	if firstCount != 1 {
+		t.Errorf("expected count of 1 after first refresh and cache hit, but got %d", firstCount)
+	}
+
+	if secondCount != 2 {
+		t.Errorf("expected count of 2 after forced refresh, but got %d", secondCount)
+	}
+
+	if thirdCount != 2 {
+		t.Errorf("expected count of 2 after failed refresh, but got %d", thirdCount)
+	}
+}
+
+// Tests that EnsureToken falls back to the secondary cache, if the
+// primary token function fails, and that both caches track their
+// validity independently.
+func Test_Cache_EnsureToken_Secondary(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	primaryDown := true
+	primaryFunc := getTokenFunction()
+	primaryCounter := 0
+	primary := func(ctx context.Context) (string, error) {
+		primaryCounter++
+		if primaryDown {
+			return "", errors.New("primary outage")
+		}
+		return primaryFunc(ctx)
+	}
+
+	secondaryFunc := getTokenFunction()
+	secondaryCounter := 0
+	secondary := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			secondaryCounter++
+			return secondaryFunc(ctx)
+		}),
+	)
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(primary),
+		Secondary(secondary),
+	)
+
+	// when
+	firstToken, firstErr := cache.EnsureToken(context.Background())
+	secondToken, secondErr := cache.EnsureToken(context.Background())
+	primaryDown = false
+	thirdToken, thirdErr := cache.EnsureToken(context.Background())
+
+	// then
+	for _, err := range []error{firstErr, secondErr, thirdErr} {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	if firstToken != secondToken {
+		t.Error("secondary token was not cached")
+	}
+
+	if secondaryCounter != 1 {
+		t.Errorf("expected secondary token function to be called once, but was called %d times", secondaryCounter)
+	}
+
+	if primaryCounter != 3 {
+		t.Errorf("expected primary token function to be called 3 times, but was called %d times", primaryCounter)
+	}
+
+	if thirdToken == secondToken {
+		t.Error("primary token was not used after the outage")
+	}
+}
+
+// Tests that EnsureToken returns the primary error, if both the
+// primary and the secondary cache fail.
+func Test_Cache_EnsureToken_Secondary_Error(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	expectedErr := errors.New("primary outage")
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return "", expectedErr
+		}),
+		Secondary(NewCache(Logger(logger))),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != expectedErr {
+		t.Errorf("expected primary error, but got: %v", err)
+	}
+
+	if token != "" {
+		t.Errorf("expected empty token, but received: %s", token)
+	}
+}
+
+// Tests that WaitUntilExpiry returns immediately, if no token is cached.
+func Test_Cache_WaitUntilExpiry_NoToken(t *testing.T) {
+	// given
+	cache := NewCache()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// when
+	err := cache.WaitUntilExpiry(ctx)
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Tests that WaitUntilExpiry blocks till the validity of the cached
+// token passes, as seen by the injected clock and timer.
+func Test_Cache_WaitUntilExpiry(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	timer := &fakeTimer{}
+	calls := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getClockTokenFunction(clock, time.Hour, &calls)),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		timer.option(),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	clock.Add(30 * time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// when
+	result := make(chan error, 1)
+	go func() {
+		result <- cache.WaitUntilExpiry(ctx)
+	}()
+
+	delays := timer.waitForTimers(t, 1)
+
+	select {
+	case err := <-result:
+		t.Fatalf("expected to wait for the timer, but returned with: %v", err)
+	default:
+	}
+
+	timer.fire(0)
+
+	// then
+	if expected := 29 * time.Minute; delays[0] != expected {
+		t.Errorf("expected timer for %s, but got %s", expected, delays[0])
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if !timer.stopped[0] {
+		t.Error("expected timer to be stopped")
+	}
+}
+
+// Tests that WaitUntilExpiry returns the context error, if the
+// context is done before the validity passes.
+func Test_Cache_WaitUntilExpiry_ContextDone(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// when
+	err := cache.WaitUntilExpiry(ctx)
+
+	// then
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, but got: %v", err)
+	}
+}
+
+// Tests that LastRefreshTime reports the time of the last
+// successful token function invocation.
+func Test_Cache_LastRefreshTime(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Clock(clock.Now),
+	)
+
+	// when
+	_, initiallyRefreshed := cache.LastRefreshTime()
+
+	_, _ = cache.EnsureToken(context.Background())
+	firstRefresh, _ := cache.LastRefreshTime()
+	firstTime := clock.Now()
+
+	clock.Add(time.Minute)
+	_, _ = cache.EnsureToken(context.Background())
+	cachedRefresh, _ := cache.LastRefreshTime()
+
+	_, _ = cache.ForceRefresh(context.Background())
+	secondRefresh, refreshed := cache.LastRefreshTime()
+
+	// then
+	if initiallyRefreshed {
+		t.Error("expected no refresh time before first refresh")
+	}
+
+	if !refreshed {
+		t.Error("expected refresh time after refresh")
+	}
+
+	if !firstRefresh.Equal(firstTime) {
+		t.Errorf("expected refresh time %s, but got %s", firstTime, firstRefresh)
+	}
+
+	if !cachedRefresh.Equal(firstRefresh) {
+		t.Errorf("refresh time changed on cache hit, got %s", cachedRefresh)
+	}
+
+	if !secondRefresh.Equal(firstTime.Add(time.Minute)) {
+		t.Errorf("expected refresh time %s, but got %s", firstTime.Add(time.Minute), secondRefresh)
+	}
+}
+
+// Tests that a token rejected by validation leaves LastRefreshTime
+// unchanged, in line with RefreshCount.
+func Test_Cache_LastRefreshTime_Rejected(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	accept := true
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Clock(clock.Now),
+		AcceptFunc(func(token jwt.Token) (bool, error) {
+			return accept, nil
+		}),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	firstRefresh, _ := cache.LastRefreshTime()
+
+	// when
+	clock.Add(time.Minute)
+	accept = false
+	_, err := cache.ForceRefresh(context.Background())
+	rejectedRefresh, _ := cache.LastRefreshTime()
+
+	// then
+	if !errors.Is(err, ErrTokenNotAccepted) {
+		t.Fatalf("expected rejected token, but got error: %v", err)
+	}
+
+	if !rejectedRefresh.Equal(firstRefresh) {
+		t.Errorf("expected refresh time %s to be kept, but got %s", firstRefresh, rejectedRefresh)
+	}
+
+	if count := cache.RefreshCount(); count != 1 {
+		t.Errorf("expected refresh count 1, but got %d", count)
+	}
+}
+
+// Tests that a cached token with a nbf claim in the future is
+// not served from the cache, till its nbf passes.
+func Test_Cache_EnsureToken_NotBefore(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	nbf := clock.Now().Add(time.Minute).Truncate(time.Second)
+
+	counter := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			counter++
+			return getJwt(map[string]interface{}{
+				jwt.NotBeforeKey:  nbf.UTC(),
+				jwt.ExpirationKey: nbf.Add(time.Hour).UTC(),
+			})
+		}),
+		Clock(clock.Now),
+	)
+
+	// when
+	firstToken, _ := cache.EnsureToken(context.Background())
+	validFrom, hasValidFrom := cache.ValidFrom()
+	secondToken, _ := cache.EnsureToken(context.Background())
+	clock.Add(2 * time.Minute)
+	thirdToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if !hasValidFrom || !validFrom.Equal(nbf) {
+		t.Errorf("expected valid from %s, but got %s (%t)", nbf, validFrom, hasValidFrom)
+	}
+
+	if firstToken == secondToken {
+		t.Error("token was served from cache before its nbf passed")
+	}
+
+	if secondToken != thirdToken || counter != 2 {
+		t.Error("token was not served from cache after its nbf passed")
+	}
+}
+
+// Tests that ValidFrom reports false, if no token is cached, or the
+// cached token has no nbf claim.
+func Test_Cache_ValidFrom_Missing(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	_, beforeFetch := cache.ValidFrom()
+	_, _ = cache.EnsureToken(context.Background())
+	_, afterFetch := cache.ValidFrom()
+
+	// then
+	if beforeFetch {
+		t.Error("expected no valid from without a cached token")
+	}
+
+	if afterFetch {
+		t.Error("expected no valid from for a token without nbf claim")
+	}
+}
+
+// Tests that SameToken correctly compares the cached tokens of two caches.
+func Test_SameToken(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	token, err := getTokenFunction()(context.Background())
+	if err != nil {
+		t.Fatalf("failed to generate token: %s", err)
+	}
+	staticTokenFunc := func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+
+	first := NewCache(Logger(logger), TokenFunction(staticTokenFunc))
+	second := NewCache(Logger(logger), TokenFunction(staticTokenFunc))
+	other := NewCache(Logger(logger), TokenFunction(getTokenFunction()))
+
+	// when
+	emptyEqual := SameToken(first, second)
+
+	for _, cache := range []*Cache{first, second, other} {
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if emptyEqual {
+		t.Error("expected empty caches to not be equal")
+	}
+
+	if !SameToken(first, second) {
+		t.Error("expected caches with identical tokens to be equal")
+	}
+
+	if SameToken(first, other) {
+		t.Error("expected caches with different tokens to not be equal")
+	}
+}
+
+// Tests that a pinned token is served within the headroom window,
+// but never past its actual expiry, and not after unpinning.
+func Test_Cache_EnsureToken_Pin(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	exp := clock.Now().Add(time.Hour).Truncate(time.Second)
+
+	counter := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			counter++
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: exp.UTC(),
+			})
+		}),
+		Headroom(10*time.Minute),
+		Clock(clock.Now),
+	)
+
+	firstToken, _ := cache.EnsureToken(context.Background())
+
+	// when - within the headroom window
+	clock.Add(55 * time.Minute)
+	cache.Pin(time.Hour)
+	pinnedToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if pinnedToken != firstToken || counter != 1 {
+		t.Error("pinned token was refreshed within the headroom window")
+	}
+
+	// when - past the actual expiry
+	clock.Add(10 * time.Minute)
+	expiredToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if expiredToken == firstToken || counter != 2 {
+		t.Error("pinned token was served past its actual expiry")
+	}
+
+	// when - unpinned within the headroom window of the new token
+	clock.Add(-10 * time.Minute)
+	cache.Unpin()
+	unpinnedToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if unpinnedToken == expiredToken || counter != 3 {
+		t.Error("unpinned token was served within the headroom window")
+	}
+}
+
+// Tests that a pin expires after the given duration.
+func Test_Cache_EnsureToken_Pin_Duration(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	exp := clock.Now().Add(time.Hour).Truncate(time.Second)
+
+	counter := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			counter++
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: exp.UTC(),
+			})
+		}),
+		Headroom(30*time.Minute),
+		Clock(clock.Now),
+	)
+
+	_, _ = cache.EnsureToken(context.Background())
+	cache.Pin(time.Minute)
+
+	// when
+	clock.Add(40 * time.Minute)
+	_, _ = cache.EnsureToken(context.Background())
+
+	// then
+	if counter != 2 {
+		t.Error("token was served after the pin expired")
+	}
+}
+
+// Tests that LastFetchStats reflects the most recent invocation of
+// the token function, including failed ones.
+func Test_Cache_LastFetchStats(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	fail := true
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			clock.Add(time.Second)
+			if fail {
+				return "", errors.New("expected error")
+			}
+			return tokenFunc(ctx)
+		}),
+		Clock(clock.Now),
+	)
+
+	// when
+	_, initiallyFetched := cache.LastFetchStats()
+
+	firstStart := clock.Now()
+	_, _ = cache.EnsureToken(context.Background())
+	failedStats, _ := cache.LastFetchStats()
+
+	fail = false
+	secondStart := clock.Now()
+	_, _ = cache.EnsureToken(context.Background())
+	succeededStats, fetched := cache.LastFetchStats()
+
+	// then
+	if initiallyFetched {
+		t.Error("expected no stats before first fetch")
+	}
+
+	if !fetched {
+		t.Error("expected stats after fetch")
+	}
+
+	expected := FetchStats{Start: firstStart, Duration: time.Second, Success: false}
+	if failedStats != expected {
+		t.Errorf("expected stats %+v, but got %+v", expected, failedStats)
+	}
+
+	expected = FetchStats{Start: secondStart, Duration: time.Second, Success: true}
+	if succeededStats != expected {
+		t.Errorf("expected stats %+v, but got %+v", expected, succeededStats)
+	}
+}
+
+// Tests that EnsureToken does not cache tokens rejected by the
+// ShouldCache predicate, but still returns them.
+func Test_Cache_EnsureToken_ShouldCache(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		audience string
+		cached   bool
+	}{
+		"accepted": {audience: "cache-me", cached: true},
+		"rejected": {audience: "skip-me", cached: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			calls := 0
+			tokenFunc := getTokenFunctionWithClaims(map[string]interface{}{jwt.AudienceKey: test.audience})
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					calls++
+					return tokenFunc(ctx)
+				}),
+				ShouldCache(func(token jwt.Token) bool {
+					for _, audience := range token.Audience() {
+						if audience == "skip-me" {
+							return false
+						}
+					}
+					return true
+				}),
+			)
+
+			// when
+			firstToken, firstErr := cache.EnsureToken(context.Background())
+			secondToken, secondErr := cache.EnsureToken(context.Background())
+
+			// then
+			if firstErr != nil || secondErr != nil {
+				t.Errorf("unexpected errors: %v, %v", firstErr, secondErr)
+			}
+
+			if firstToken == "" || secondToken == "" {
+				t.Error("expected tokens, but got none")
+			}
+
+			expectedCalls := 2
+			if test.cached {
+				expectedCalls = 1
+			}
+
+			if calls != expectedCalls {
+				t.Errorf("expected %d token function calls, but got %d", expectedCalls, calls)
+			}
+		})
+	}
+}
+
+// Tests that LastRefreshReason reports why the token function was
+// invoked, for each of the triggers.
+func Test_Cache_LastRefreshReason(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		tokenFunc func(ctx context.Context) (string, error)
+		trigger   func(cache *Cache, clock *fakeClock)
+		expected  RefreshReason
+	}{
+		"initial": {
+			tokenFunc: getTokenFunction(),
+			trigger:   func(cache *Cache, clock *fakeClock) {},
+			expected:  RefreshInitial,
+		},
+		"expired": {
+			tokenFunc: getTokenFunction(),
+			trigger: func(cache *Cache, clock *fakeClock) {
+				clock.Add(2 * time.Hour)
+				_, _ = cache.EnsureToken(context.Background())
+			},
+			expected: RefreshExpired,
+		},
+		"not yet valid": {
+			tokenFunc: getTokenFunctionWithClaims(map[string]interface{}{
+				jwt.NotBeforeKey: time.Now().Add(time.Minute).UTC(),
+			}),
+			trigger: func(cache *Cache, clock *fakeClock) {
+				_, _ = cache.EnsureToken(context.Background())
+			},
+			expected: RefreshNotYetValid,
+		},
+		"not cached": {
+			tokenFunc: getTokenFunctionWithoutExp(),
+			trigger: func(cache *Cache, clock *fakeClock) {
+				_, _ = cache.EnsureToken(context.Background())
+			},
+			expected: RefreshNotCached,
+		},
+		"forced": {
+			tokenFunc: getTokenFunction(),
+			trigger: func(cache *Cache, clock *fakeClock) {
+				_, _ = cache.ForceRefresh(context.Background())
+			},
+			expected: RefreshForced,
+		},
+		"invalidated": {
+			tokenFunc: getTokenFunction(),
+			trigger: func(cache *Cache, clock *fakeClock) {
+				cache.Invalidate()
+				_, _ = cache.EnsureToken(context.Background())
+			},
+			expected: RefreshInvalidated,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			clock := newFakeClock()
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(test.tokenFunc),
+				Clock(clock.Now),
+			)
+
+			_, initiallyRefreshed := cache.LastRefreshReason()
+			_, _ = cache.EnsureToken(context.Background())
+
+			// when
+			test.trigger(cache, clock)
+			reason, refreshed := cache.LastRefreshReason()
+
+			// then
+			if initiallyRefreshed {
+				t.Error("expected no reason before first refresh")
+			}
+
+			if !refreshed {
+				t.Error("expected reason after refresh")
+			}
+
+			if reason != test.expected {
+				t.Errorf("expected reason %q, but got %q", test.expected, reason)
+			}
+		})
+	}
+}
+
+// Tests that a refresh following a rejected token reports RefreshRejected,
+// both for tokens rejected when fetched, and cached tokens failing
+// revalidation.
+func Test_Cache_LastRefreshReason_Rejected(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		revalidate bool
+	}{
+		"fetched token rejected":   {revalidate: false},
+		"cached token revalidated": {revalidate: true},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			rejectNext := !test.revalidate
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunction()),
+				RevalidateOnEveryAccess(test.revalidate),
+				AcceptFunc(func(token jwt.Token) (bool, error) {
+					rejected := rejectNext
+					rejectNext = false
+					return !rejected, nil
+				}),
+			)
+
+			_, _ = cache.EnsureToken(context.Background())
+			rejectNext = test.revalidate
+
+			// when
+			_, err := cache.EnsureToken(context.Background())
+			reason, _ := cache.LastRefreshReason()
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if reason != RefreshRejected {
+				t.Errorf("expected reason %q, but got %q", RefreshRejected, reason)
+			}
+		})
+	}
+}
+
+// Tests that a refresh following a token rejected by any check of the
+// refresh reports RefreshRejected.
+func Test_Cache_LastRefreshReason_RejectedChecks(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	withNonce := func(nonce string) string {
+		token, err := getJwt(map[string]interface{}{
+			jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+			"nonce":           nonce,
+		})
+		if err != nil {
+			t.Fatalf("failed to create token: %s", err)
+		}
+		return token
+	}
+
+	signedWithKeyID := func(keyID string) string {
+		token, err := getTokenFunctionWithKeyID(keyID)(context.Background())
+		if err != nil {
+			t.Fatalf("failed to create token: %s", err)
+		}
+		return token
+	}
+
+	tests := map[string]struct {
+		opts []Option
+		// primed tokens are cached and invalidated, before the rejected token
+		primed   []string
+		rejected string
+	}{
+		"segment size": {
+			opts:     []Option{MaxHeaderBytes(100)},
+			rejected: signedWithKeyID(strings.Repeat("k", 200)),
+		},
+		"header": {
+			opts:     []Option{AllowedKeyIDs("key-1")},
+			rejected: signedWithKeyID("key-2"),
+		},
+		"unparsable": {
+			opts:     []Option{RejectUnparsable(true)},
+			rejected: "not-a-token",
+		},
+		"nonce": {
+			opts:     []Option{NonceTracking(NonceReject)},
+			primed:   []string{withNonce("n-1")},
+			rejected: withNonce("n-1"),
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			tokens := append(append(test.primed, test.rejected), signedWithKeyID("key-1"))
+			cache := NewCache(
+				append([]Option{
+					Logger(logger),
+					TokenFunction(func(ctx context.Context) (string, error) {
+						token := tokens[0]
+						tokens = tokens[1:]
+						return token, nil
+					}),
+				}, test.opts...)...,
+			)
+
+			for range test.primed {
+				if _, err := cache.EnsureToken(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				cache.Invalidate()
+			}
+
+			if _, err := cache.EnsureToken(context.Background()); err == nil {
+				t.Fatal("expected token to be rejected")
+			}
+
+			// when
+			_, err := cache.EnsureToken(context.Background())
+			reason, _ := cache.LastRefreshReason()
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if reason != RefreshRejected {
+				t.Errorf("expected reason %q, but got %q", RefreshRejected, reason)
+			}
+		})
+	}
+}
+
+// Tests that a refresh of an expired token set via SetTokenIfNewer
+// reports RefreshExpired, instead of RefreshInitial.
+func Test_Cache_LastRefreshReason_SetTokenIfNewer(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Clock(clock.Now),
+	)
+
+	token, err := getJwt(map[string]interface{}{jwt.ExpirationKey: clock.Now().Add(time.Hour).UTC()})
+	if err != nil {
+		t.Fatalf("failed to create token: %s", err)
+	}
+
+	if adopted, err := cache.SetTokenIfNewer(token); !adopted || err != nil {
+		t.Fatalf("expected token to be adopted, but got %t, %v", adopted, err)
+	}
+
+	// when
+	clock.Add(2 * time.Hour)
+	_, err = cache.EnsureToken(context.Background())
+	reason, _ := cache.LastRefreshReason()
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if reason != RefreshExpired {
+		t.Errorf("expected reason %q, but got %q", RefreshExpired, reason)
+	}
+}
+
+// Tests that a refresh after the lapse of a pin, which served the token
+// past its validity, reports RefreshPinExpired.
+func Test_Cache_LastRefreshReason_PinExpired(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	calls := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getClockTokenFunction(clock, time.Hour, &calls)),
+		Clock(clock.Now),
+		Headroom(10*time.Minute),
+	)
+
+	_, _ = cache.EnsureToken(context.Background())
+
+	clock.Add(45 * time.Minute)
+	cache.Pin(10 * time.Minute)
+
+	// when
+	clock.Add(7 * time.Minute)
+	_, _ = cache.EnsureToken(context.Background())
+	pinnedCalls := calls
+
+	clock.Add(4 * time.Minute)
+	_, _ = cache.EnsureToken(context.Background())
+	reason, _ := cache.LastRefreshReason()
+
+	// then
+	if pinnedCalls != 1 || calls != 2 {
+		t.Errorf("expected pinned token to be served till the pin lapsed, but got %d and %d calls", pinnedCalls, calls)
+	}
+
+	if reason != RefreshPinExpired {
+		t.Errorf("expected reason %q, but got %q", RefreshPinExpired, reason)
+	}
+}
+
+// Tests that the refresh reasons render human readable.
+func Test_RefreshReason_String(t *testing.T) {
+	tests := map[RefreshReason]string{
+		RefreshInitial:     "initial",
+		RefreshExpired:     "expired",
+		RefreshNotYetValid: "not yet valid",
+		RefreshNotCached:   "not cached",
+		RefreshForced:      "forced",
+		RefreshInvalidated: "invalidated",
+		RefreshWarmup:      "warmup",
+		RefreshEager:       "eager",
+		RefreshRejected:    "rejected",
+		RefreshPinExpired:  "pin expired",
+		RefreshReason(42):  "unknown",
+	}
+
+	for reason, expected := range tests {
+		if actual := reason.String(); actual != expected {
+			t.Errorf("expected %q, but got %q", expected, actual)
+		}
+	}
+}
+
+// Tests that Invalidate drops the cached token, so that the next
+// call to EnsureToken fetches a new token.
+func Test_Cache_Invalidate(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	firstToken, _ := cache.EnsureToken(context.Background())
+
+	// when
+	cache.Invalidate()
+	_, cached := cache.Claim(jwt.ExpirationKey)
+	secondToken, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if cached {
+		t.Error("expected no cached token after invalidation")
+	}
+
+	if firstToken == secondToken {
+		t.Error("expected new token after invalidation")
+	}
+}
+
+// Tests that concurrent calls to Invalidate and EnsureToken never
+// yield an empty token. Run with -race to detect unsynchronized access.
+func Test_Cache_Invalidate_Concurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				cache.Invalidate()
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				// then
+				token, err := cache.EnsureToken(context.Background())
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+
+				if token == "" {
+					t.Error("expected token, but got none")
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Tests that the Warmup function provides the token for the first miss
+// only, and that later misses use the token function.
+func Test_Cache_EnsureToken_Warmup(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	var warmups, fetches int32
+	warmupFunc := getTokenFunction()
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Logger(logger),
+		Warmup(func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&warmups, 1)
+			return warmupFunc(ctx)
+		}),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&fetches, 1)
+			return tokenFunc(ctx)
+		}),
+	)
+
+	// when
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	warmedUpReason, _ := cache.LastRefreshReason()
+	cache.Invalidate()
+	_, _ = cache.EnsureToken(context.Background())
+
+	// then
+	if warmups != 1 {
+		t.Errorf("expected warmup to run once, but ran %d times", warmups)
+	}
+
+	if fetches != 1 {
+		t.Errorf("expected token function to run once after invalidation, but ran %d times", fetches)
+	}
+
+	if warmedUpReason != RefreshWarmup {
+		t.Errorf("expected reason %q, but got %q", RefreshWarmup, warmedUpReason)
+	}
+}
+
+// Tests that a failing Warmup function falls back to the token
+// function, and is not retried.
+func Test_Cache_EnsureToken_Warmup_Error(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	warmups := 0
+	cache := NewCache(
+		Logger(logger),
+		Warmup(func(ctx context.Context) (string, error) {
+			warmups++
+			return "", errors.New("expected error")
+		}),
+		TokenFunction(getTokenFunctionWithoutExp()),
+	)
+
+	// when
+	firstToken, firstErr := cache.EnsureToken(context.Background())
+	secondToken, secondErr := cache.EnsureToken(context.Background())
+
+	// then
+	if firstErr != nil || secondErr != nil {
+		t.Errorf("unexpected errors: %v, %v", firstErr, secondErr)
+	}
+
+	if firstToken == "" || secondToken == "" {
+		t.Error("expected tokens, but got none")
+	}
+
+	if warmups != 1 {
+		t.Errorf("expected warmup to run once, but ran %d times", warmups)
+	}
+}
+
+// Tests that a Warmup function providing an expired token falls back
+// to the token function, instead of returning the expired token.
+func Test_Cache_EnsureToken_Warmup_Expired(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	warmupFunc := getExpiredTokenFunction()
+	warmupToken, _ := warmupFunc(context.Background())
+
+	fetches := 0
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Logger(logger),
+		Warmup(func(ctx context.Context) (string, error) {
+			return warmupToken, nil
+		}),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			fetches++
+			return tokenFunc(ctx)
+		}),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if token == warmupToken || fetches != 1 {
+		t.Errorf("expected token function to replace expired warmup token, but got %d fetches", fetches)
+	}
+
+	if !cache.HasValidToken() {
+		t.Error("expected fetched token to be cached")
+	}
+}
+
+// Tests that the Warmup function is not invoked, if a token was cached
+// before the first miss - so that it never seeds an older token.
+func Test_Cache_EnsureToken_Warmup_AfterForceRefresh(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	warmups := 0
+	cache := NewCache(
+		Logger(logger),
+		Warmup(func(ctx context.Context) (string, error) {
+			warmups++
+			return getJwt(map[string]interface{}{jwt.ExpirationKey: time.Now().Add(time.Hour).UTC()})
+		}),
+		TokenFunction(getTokenFunction()),
+	)
+
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cache.Invalidate()
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if warmups != 0 {
+		t.Errorf("expected no warmup after a token was cached, but ran %d times", warmups)
+	}
+
+	if reason, _ := cache.LastRefreshReason(); reason != RefreshInvalidated {
+		t.Errorf("expected reason %q, but got %q", RefreshInvalidated, reason)
+	}
+}
+
+// Tests that LogFingerprint logs a fingerprint of the token,
+// but never the raw token.
+func Test_Cache_EnsureToken_LogFingerprint(t *testing.T) {
+	tests := map[string]func(ctx context.Context) (string, error){
+		"cached":     getTokenFunction(),
+		"not cached": getTokenFunctionWithoutExp(),
+	}
+
+	for name, tokenFunc := range tests {
+		tokenFunc := tokenFunc
+
+		t.Run(name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			logger.SetLevel(logrus.DebugLevel)
+
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(tokenFunc),
+				LogFingerprint(true),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			sum := sha256.Sum256([]byte(token))
+			expected := "fingerprint " + hex.EncodeToString(sum[:])[:8]
+
+			entries := hook.AllEntries()
+			if len(entries) == 0 {
+				t.Fatal("expected log entries, but got none")
+			}
+
+			for _, entry := range entries {
+				if !strings.Contains(entry.Message, expected) {
+					t.Errorf("expected %q in log message %q", expected, entry.Message)
+				}
+
+				if strings.Contains(entry.Message, token) {
+					t.Errorf("raw token logged in %q", entry.Message)
+				}
+			}
+		})
+	}
+}
+
+// Tests that HasToken and HasValidToken distinguish a cache which was
+// never initialized, from caches with a valid or an expired token.
+func Test_Cache_HasToken(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Clock(clock.Now),
+	)
+
+	// when
+	initialHas, initialValid := cache.HasToken(), cache.HasValidToken()
+
+	_, _ = cache.EnsureToken(context.Background())
+	validHas, validValid := cache.HasToken(), cache.HasValidToken()
+
+	clock.Add(2 * time.Hour)
+	expiredHas, expiredValid := cache.HasToken(), cache.HasValidToken()
+
+	// then
+	if initialHas || initialValid {
+		t.Errorf("expected no token initially, got %t/%t", initialHas, initialValid)
+	}
+
+	if !validHas || !validValid {
+		t.Errorf("expected valid token, got %t/%t", validHas, validValid)
+	}
+
+	if !expiredHas || expiredValid {
+		t.Errorf("expected expired token, got %t/%t", expiredHas, expiredValid)
+	}
+}
+
+// Tests that RefreshAtLifetimeFraction refreshes the token once the
+// configured fraction of its lifetime elapsed.
+func Test_Cache_EnsureToken_RefreshAtLifetimeFraction(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		elapsed time.Duration
+		cached  bool
+	}{
+		"before fraction": {elapsed: 75*time.Minute - time.Second, cached: true},
+		"at fraction":     {elapsed: 75 * time.Minute, cached: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			iat := time.Now().Truncate(time.Second)
+			clock := &fakeClock{now: iat}
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+					jwt.IssuedAtKey:   iat.UTC(),
+					jwt.ExpirationKey: iat.Add(100 * time.Minute).UTC(),
+				})),
+				Clock(clock.Now),
+				Headroom(time.Minute),
+				RefreshAtLifetimeFraction(0.75),
+			)
+
+			firstToken, _ := cache.EnsureToken(context.Background())
+
+			// when
+			clock.Add(test.elapsed)
+			secondToken, _ := cache.EnsureToken(context.Background())
+
+			// then
+			if cached := firstToken == secondToken; cached != test.cached {
+				t.Errorf("expected token cached to be %t, but was %t", test.cached, cached)
+			}
+		})
+	}
+}
+
+// Tests that RefreshAtLifetimeFraction falls back to the headroom
+// for tokens without an iat claim.
+func Test_Cache_EnsureToken_RefreshAtLifetimeFraction_NoIat(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	now := time.Now().Truncate(time.Second)
+	clock := &fakeClock{now: now}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.ExpirationKey: now.Add(100 * time.Minute).UTC(),
+		})),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		RefreshAtLifetimeFraction(0.75),
+	)
+
+	firstToken, _ := cache.EnsureToken(context.Background())
+
+	// when
+	clock.Add(98 * time.Minute)
+	secondToken, _ := cache.EnsureToken(context.Background())
+	clock.Add(time.Minute)
+	thirdToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if firstToken != secondToken {
+		t.Error("expected token to be cached till headroom")
+	}
+
+	if secondToken == thirdToken {
+		t.Error("expected token to be refreshed at headroom")
+	}
+}
+
+// Tests that TreatNoExpAsValid caches tokens without an exp claim
+// indefinitely.
+func Test_Cache_EnsureToken_TreatNoExpAsValid(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := newFakeClock()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithoutExp()),
+		Clock(clock.Now),
+		TreatNoExpAsValid(true),
+	)
+
+	// when
+	firstToken, firstErr := cache.EnsureToken(context.Background())
+	clock.Add(100 * 365 * 24 * time.Hour)
+	secondToken, secondErr := cache.EnsureToken(context.Background())
+
+	// then
+	if firstErr != nil || secondErr != nil {
+		t.Errorf("unexpected errors: %v, %v", firstErr, secondErr)
+	}
+
+	if firstToken != secondToken {
+		t.Error("expected token without exp to be cached")
+	}
+
+	if _, set := cache.Claim(jwt.ExpirationKey); set {
+		t.Error("expected exp claim of the token to stay unset")
+	}
+}
+
+// Tests that TreatNoExpAsValid in combination with RefreshAtLifetimeFraction
+// still caches tokens without exp claim, instead of overflowing the
+// fraction of their (unbounded) lifetime.
+func Test_Cache_EnsureToken_TreatNoExpAsValid_RefreshAtLifetimeFraction(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, fraction := range []float64{0.5, 0.99, 1} {
+		fraction := fraction
+
+		t.Run(fmt.Sprintf("%v", fraction), func(t *testing.T) {
+			// given
+			calls := 0
+			tokenFunc := getTokenFunctionWithoutExp()
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					calls++
+					return tokenFunc(ctx)
+				}),
+				TreatNoExpAsValid(true),
+				RefreshAtLifetimeFraction(fraction),
+			)
+
+			// when
+			firstToken, _ := cache.EnsureToken(context.Background())
+			secondToken, _ := cache.EnsureToken(context.Background())
+
+			// then
+			if firstToken != secondToken || calls != 1 {
+				t.Errorf("expected token without exp to be cached, but the token function was called %d times", calls)
+			}
+
+			if validity := cache.validity; !validity.After(time.Now()) {
+				t.Errorf("expected validity in the future, but was %s", validity)
+			}
+		})
+	}
+}
+
+// Tests that SetTokenIfNewer only adopts tokens which expire later
+// than the currently cached token.
+func Test_Cache_SetTokenIfNewer(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	now := time.Now()
+	tokenExpiringIn := func(d time.Duration) string {
+		token, err := getJwt(map[string]interface{}{jwt.ExpirationKey: now.Add(d).UTC()})
+		if err != nil {
+			t.Fatalf("failed to create token: %s", err)
+		}
+		return token
+	}
+
+	tests := map[string]struct {
+		candidate string
+		adopted   bool
+	}{
+		"newer":         {candidate: tokenExpiringIn(2 * time.Hour), adopted: true},
+		"older":         {candidate: tokenExpiringIn(30 * time.Minute), adopted: false},
+		"same validity": {candidate: tokenExpiringIn(time.Hour), adopted: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cached := tokenExpiringIn(time.Hour)
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					return cached, nil
+				}),
+			)
+
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// when
+			adopted, err := cache.SetTokenIfNewer(test.candidate)
+			token, _ := cache.EnsureToken(context.Background())
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if adopted != test.adopted {
+				t.Errorf("expected adopted to be %t, but was %t", test.adopted, adopted)
+			}
+
+			expected := cached
+			if test.adopted {
+				expected = test.candidate
+			}
+
+			if token != expected {
+				t.Error("unexpected token cached")
+			}
+		})
+	}
+}
+
+// Tests that SetTokenIfNewer adopts tokens for an empty cache, but
+// never adopts tokens without an exp claim or broken tokens.
+func Test_Cache_SetTokenIfNewer_EmptyCache(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	withExp, _ := getTokenFunction()(context.Background())
+	withoutExp, _ := getTokenFunctionWithoutExp()(context.Background())
+
+	tests := map[string]struct {
+		candidate string
+		adopted   bool
+		err       bool
+	}{
+		"with exp":    {candidate: withExp, adopted: true},
+		"without exp": {candidate: withoutExp, adopted: false},
+		"broken":      {candidate: "not-a-valid-token", adopted: false, err: true},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunction()),
+			)
+
+			// when
+			adopted, err := cache.SetTokenIfNewer(test.candidate)
+
+			// then
+			if (err != nil) != test.err {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if adopted != test.adopted {
+				t.Errorf("expected adopted to be %t, but was %t", test.adopted, adopted)
+			}
+
+			if cache.HasValidToken() != test.adopted {
+				t.Error("unexpected cache state")
+			}
+		})
+	}
+}
+
+// Tests that a headroom larger than the token lifetime is logged once,
+// as the token is refreshed on every call.
+func Test_Cache_EnsureToken_HeadroomExceedsLifetime(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.ExpirationKey: time.Now().Add(10 * time.Second).UTC(),
+		})),
+		Headroom(time.Minute),
+	)
+
+	// when
+	firstToken, _ := cache.EnsureToken(context.Background())
+	secondToken, _ := cache.EnsureToken(context.Background())
+	thirdToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if firstToken == secondToken || secondToken == thirdToken {
+		t.Error("expected token to be refreshed on every call")
+	}
+
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.InfoLevel && strings.Contains(entry.Message, "headroom") {
+			warnings++
+		}
+	}
+
+	if warnings != 1 {
+		t.Errorf("expected 1 headroom warning, but got %d", warnings)
+	}
+}
+
+// Tests that a lifetime fraction already passed on receipt is logged
+// without referring to the headroom, which does not apply in this mode.
+func Test_Cache_EnsureToken_HeadroomExceedsLifetime_LifetimeFraction(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.IssuedAtKey:   time.Now().Add(-time.Hour).UTC(),
+			jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+		})),
+		Headroom(time.Minute),
+		RefreshAtLifetimeFraction(0.25),
+	)
+
+	// when
+	_, _ = cache.EnsureToken(context.Background())
+
+	// then
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.InfoLevel && strings.Contains(entry.Message, "refreshed on every call") {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, but got %v", warnings)
+	}
+
+	if strings.Contains(warnings[0], "headroom") || !strings.Contains(warnings[0], "lifetime fraction of 0.25") {
+		t.Errorf("expected warning about the lifetime fraction, but got %q", warnings[0])
+	}
+}
+
+// Tests that MinRemainingToServe only serves cached tokens, which have
+// more than the configured validity left.
+func Test_Cache_EnsureToken_MinRemainingToServe(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		elapsed time.Duration
+		cached  bool
+	}{
+		"above floor": {elapsed: 49*time.Minute - time.Second, cached: true},
+		"at floor":    {elapsed: 49 * time.Minute, cached: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			now := time.Now().Truncate(time.Second)
+			clock := &fakeClock{now: now}
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+					jwt.ExpirationKey: now.Add(time.Hour).UTC(),
+				})),
+				Clock(clock.Now),
+				Headroom(time.Minute),
+				MinRemainingToServe(10*time.Minute),
+			)
+
+			firstToken, _ := cache.EnsureToken(context.Background())
+
+			// when
+			clock.Add(test.elapsed)
+			secondToken, _ := cache.EnsureToken(context.Background())
+
+			// then
+			if cached := firstToken == secondToken; cached != test.cached {
+				t.Errorf("expected token cached to be %t, but was %t", test.cached, cached)
+			}
+		})
+	}
+}
+
+// Tests that a panicking token function is recovered, and reported as
+// TokenFunctionPanicError to the caller and the observers.
+func Test_Cache_EnsureToken_TokenFunctionPanic(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	errPanic := errors.New("expected error")
+
+	tests := map[string]struct {
+		value   interface{}
+		wrapped error
+	}{
+		"value": {value: "unexpected nil", wrapped: nil},
+		"error": {value: errPanic, wrapped: errPanic},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			observer := &recordingObserver{}
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					panic(test.value)
+				}),
+				Observer(observer),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if token != "" {
+				t.Errorf("received token %q, not expected none", token)
+			}
+
+			if !errors.Is(err, ErrTokenFunctionPanic) {
+				t.Errorf("expected panic error, but got: %v", err)
+			}
+
+			var panicErr *TokenFunctionPanicError
+			if !errors.As(err, &panicErr) || panicErr.Value != test.value {
+				t.Errorf("expected panic error with value %v, but got: %v", test.value, err)
+			}
+
+			if test.wrapped != nil && !errors.Is(err, test.wrapped) {
+				t.Errorf("expected panic error to wrap %v", test.wrapped)
+			}
+
+			if !errors.Is(observer.err, ErrTokenFunctionPanic) {
+				t.Errorf("expected observer to receive panic error, but got: %v", observer.err)
+			}
+		})
+	}
+}
+
+// hasScope returns a predicate, which matches tokens with the given scope.
+func hasScope(scope string) func(token jwt.Token) bool {
+	return func(token jwt.Token) bool {
+		value, ok := token.Get("scope")
+		if !ok {
+			return false
+		}
+
+		scopes, _ := value.(string)
+		for _, s := range strings.Fields(scopes) {
+			if s == scope {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Tests that EnsureTokenMatching refreshes the token, if the
+// cached token does not satisfy the predicate.
+func Test_Cache_EnsureTokenMatching(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	scopes := "read"
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.IssuedAtKey:   time.Now().Add(-time.Hour).UTC(),
+				jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+				"scope":           scopes,
+			})
+		}),
+	)
+
+	// when
+	readToken, readErr := cache.EnsureTokenMatching(context.Background(), hasScope("read"))
+
+	scopes = "read write"
+	writeToken, writeErr := cache.EnsureTokenMatching(context.Background(), hasScope("write"))
+	cachedToken, cachedErr := cache.EnsureTokenMatching(context.Background(), hasScope("write"))
+
+	// then
+	if readErr != nil || writeErr != nil || cachedErr != nil {
+		t.Errorf("unexpected errors: %v, %v, %v", readErr, writeErr, cachedErr)
+	}
+
+	if readToken == writeToken {
+		t.Error("expected token to be refreshed, if the predicate is not satisfied")
+	}
+
+	if cachedToken != writeToken {
+		t.Error("expected matching token to be cached")
+	}
+
+	if count := cache.RefreshCount(); count != 2 {
+		t.Errorf("expected 2 refreshes, but got %d", count)
+	}
+}
+
+// Tests that EnsureTokenMatching returns ErrNoMatchingToken, if the
+// refreshed token does not satisfy the predicate either.
+func Test_Cache_EnsureTokenMatching_NoMatch(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	_, err := cache.EnsureTokenMatching(context.Background(), hasScope("write"))
+
+	// then
+	if err != ErrNoMatchingToken {
+		t.Errorf("expected ErrNoMatchingToken, but got: %v", err)
+	}
+
+	if count := cache.RefreshCount(); count != 2 {
+		t.Errorf("expected 2 refreshes, but got %d", count)
+	}
+}
+
+// Tests that LogDurationRounding rounds the logged caching duration.
+func Test_Cache_EnsureToken_LogDurationRounding(t *testing.T) {
+	tests := map[string]struct {
+		rounding time.Duration
+		expected string
+	}{
+		"not rounded": {rounding: 0, expected: "New jwt received. Caching for 20m1.333333333s"},
+		"seconds":     {rounding: time.Second, expected: "New jwt received. Caching for 20m1s"},
+		"minutes":     {rounding: time.Minute, expected: "New jwt received. Caching for 20m0s"},
+	}
+
+	for name, testCase := range tests {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			logger.SetLevel(logrus.DebugLevel)
+
+			// given
+			iat := time.Now().Truncate(time.Second)
+			cache := NewCache(
+				Name("jwt"),
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					return getJwt(map[string]interface{}{
+						jwt.IssuedAtKey:   iat.UTC(),
+						jwt.ExpirationKey: iat.Add(time.Hour + 4*time.Second).UTC(),
+					})
+				}),
+				RefreshAtLifetimeFraction(1.0/3),
+				LogDurationRounding(testCase.rounding),
+			)
+
+			// when
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// then
+			if message := hook.LastEntry().Message; message != testCase.expected {
+				t.Errorf("expected log %q, but got %q", testCase.expected, message)
+			}
+		})
+	}
+}
+
+// recordingLogger records all messages, for loggers without
+// structured fields.
+type recordingLogger struct {
+	messages []string
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+	logger.messages = append(logger.messages, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Debugf(format string, args ...interface{}) {
+	logger.messages = append(logger.messages, fmt.Sprintf(format, args...))
+}
+
+// Tests that LogClaims logs the configured claims as structured
+// fields, but no other claims.
+func Test_Cache_EnsureToken_LogClaims(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.SubjectKey: "some-subject",
+			"scope":        "read",
+			"secret":       "do-not-log",
+		})),
+		LogClaims(jwt.SubjectKey, "scope", "missing"),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	fields := hook.LastEntry().Data
+	if fields[jwt.SubjectKey] != "some-subject" || fields["scope"] != "read" {
+		t.Errorf("expected configured claims to be logged, but got %v", fields)
+	}
+
+	for _, name := range []string{"secret", "missing", jwt.ExpirationKey} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("expected claim %q to not be logged", name)
+		}
+	}
+}
+
+// Tests that LogClaims appends the configured claims to the message,
+// for loggers without structured fields.
+func Test_Cache_EnsureToken_LogClaims_PlainLogger(t *testing.T) {
+	// given
+	logger := &recordingLogger{}
+	cache := NewCache(
+		Name("jwt"),
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.SubjectKey: "some-subject",
+			"secret":       "do-not-log",
+		})),
+		LogClaims(jwt.SubjectKey),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if len(logger.messages) != 1 {
+		t.Fatalf("expected 1 log message, but got %v", logger.messages)
+	}
+
+	if message := logger.messages[0]; !strings.HasSuffix(message, " (sub=some-subject)") || strings.Contains(message, "do-not-log") {
+		t.Errorf("unexpected log message %q", message)
+	}
+}
+
+// Tests that SetHeadroom applies to the cached token, as well as
+// to the validity computed on the next refresh.
+func Test_Cache_SetHeadroom(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	exp := time.Now().Truncate(time.Second).Add(time.Hour)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: exp.UTC(),
+			})
+		}),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	cache.SetHeadroom(10 * time.Minute)
+	cachedValidity := cache.validity
+
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	refreshedValidity := cache.validity
+
+	// then
+	if expected := exp.Add(-10 * time.Minute); !cachedValidity.Equal(expected) {
+		t.Errorf("expected cached validity %s, but got %s", expected, cachedValidity)
+	}
+
+	if expected := exp.Add(-10 * time.Minute); !refreshedValidity.Equal(expected) {
+		t.Errorf("expected refreshed validity %s, but got %s", expected, refreshedValidity)
+	}
+}
+
+// Tests that SetHeadroom is safe for concurrent use with EnsureToken.
+func Test_Cache_SetHeadroom_Concurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		headroom := time.Duration(i) * time.Minute
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cache.SetHeadroom(headroom)
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+
+	// then (must not race)
+	wg.Wait()
+}
+
+// Tests that the ValidityRewriter can shorten, but never extend
+// the computed validity.
+func Test_Cache_EnsureToken_ValidityRewriter(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	exp := time.Now().Truncate(time.Second).Add(time.Hour)
+	computed := exp.Add(-time.Second)
+
+	tests := map[string]struct {
+		rewrite  func(computed time.Time) time.Time
+		expected time.Time
+	}{
+		"shortened": {
+			rewrite:  func(computed time.Time) time.Time { return computed.Add(-10 * time.Minute) },
+			expected: computed.Add(-10 * time.Minute),
+		},
+		"unchanged": {
+			rewrite:  func(computed time.Time) time.Time { return computed },
+			expected: computed,
+		},
+		"extended": {
+			rewrite:  func(computed time.Time) time.Time { return computed.Add(time.Hour) },
+			expected: computed,
+		},
+	}
+
+	for name, testCase := range tests {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			var received jwt.Token
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					return getJwt(map[string]interface{}{
+						jwt.ExpirationKey: exp.UTC(),
+						jwt.SubjectKey:    "some-subject",
+					})
+				}),
+				ValidityRewriter(func(computed time.Time, token jwt.Token) time.Time {
+					received = token
+					return testCase.rewrite(computed)
+				}),
+			)
+
+			// when
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// then
+			if !cache.validity.Equal(testCase.expected) {
+				t.Errorf("expected validity %s, but got %s", testCase.expected, cache.validity)
+			}
+
+			if received == nil || received.Subject() != "some-subject" {
+				t.Error("expected rewriter to receive the parsed token")
+			}
+		})
+	}
+}
+
+// Tests that LastTokenChanged reports whether the most recent refresh
+// provided a different token than the refresh before.
+func Test_Cache_LastTokenChanged(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	tokenFunc := getTokenFunction()
+	token, err := tokenFunc(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return token, nil
+		}),
+	)
+
+	refresh := func() bool {
+		if _, err := cache.ForceRefresh(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return cache.LastTokenChanged()
+	}
+
+	// when
+	beforeRefresh := cache.LastTokenChanged()
+	firstRefresh := refresh()
+	identicalRefresh := refresh()
+
+	token, _ = tokenFunc(context.Background())
+	differentRefresh := refresh()
+
+	// then
+	if beforeRefresh || firstRefresh {
+		t.Error("expected no change to be reported without a previous token")
+	}
+
+	if identicalRefresh {
+		t.Error("expected no change to be reported for an identical token")
+	}
+
+	if !differentRefresh {
+		t.Error("expected change to be reported for a different token")
+	}
+}
+
+// Tests that EnsureTokenForContext returns a token valid till the
+// deadline of the context, refreshing the cached token if required.
+func Test_Cache_EnsureTokenForContext(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		lifetimes         []time.Duration
+		timeout           time.Duration
+		expectedErr       error
+		expectedRefreshes uint64
+	}{
+		"no deadline": {
+			lifetimes:         []time.Duration{time.Minute},
+			expectedRefreshes: 1,
+		},
+		"deadline before expiry": {
+			lifetimes:         []time.Duration{time.Hour},
+			timeout:           time.Minute,
+			expectedRefreshes: 1,
+		},
+		"refreshed token covers deadline": {
+			lifetimes:         []time.Duration{time.Minute, 2 * time.Hour},
+			timeout:           time.Hour,
+			expectedRefreshes: 2,
+		},
+		"token too short lived": {
+			lifetimes:         []time.Duration{time.Minute, time.Minute},
+			timeout:           time.Hour,
+			expectedErr:       ErrTokenTooShortLived,
+			expectedRefreshes: 2,
+		},
+	}
+
+	for name, testCase := range tests {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			calls := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					lifetime := testCase.lifetimes[calls]
+					calls++
+
+					return getJwt(map[string]interface{}{
+						jwt.ExpirationKey: time.Now().Add(lifetime).UTC(),
+					})
+				}),
+			)
+
+			ctx := context.Background()
+			if testCase.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, testCase.timeout)
+				defer cancel()
+			}
+
+			// when
+			token, err := cache.EnsureTokenForContext(ctx)
+
+			// then
+			if !errors.Is(err, testCase.expectedErr) {
+				t.Errorf("expected error %v, but got: %v", testCase.expectedErr, err)
+			}
+
+			if (token != "") != (testCase.expectedErr == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+
+			if count := cache.RefreshCount(); count != testCase.expectedRefreshes {
+				t.Errorf("expected %d refreshes, but got %d", testCase.expectedRefreshes, count)
+			}
+		})
+	}
+}
+
+// Tests that ServeWithinRealExpiryOnError serves the cached token on
+// refresh errors within the headroom window, but never past its expiry.
+func Test_Cache_EnsureToken_ServeWithinRealExpiryOnError(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		enabled     bool
+		elapsed     time.Duration
+		expectedErr bool
+	}{
+		"headroom window":          {enabled: true, elapsed: 55 * time.Minute, expectedErr: false},
+		"past expiry":              {enabled: true, elapsed: 61 * time.Minute, expectedErr: true},
+		"headroom window disabled": {enabled: false, elapsed: 55 * time.Minute, expectedErr: true},
+	}
+
+	for name, testCase := range tests {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			clock := newFakeClock()
+			exp := clock.Now().Truncate(time.Second).Add(time.Hour)
+			expectedErr := errors.New("expected error")
+
+			fail := false
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					if fail {
+						return "", expectedErr
+					}
+					return getJwt(map[string]interface{}{
+						jwt.ExpirationKey: exp.UTC(),
+					})
+				}),
+				Clock(clock.Now),
+				Headroom(10*time.Minute),
+				ServeWithinRealExpiryOnError(testCase.enabled),
+			)
+
+			cachedToken, err := cache.EnsureToken(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// when
+			fail = true
+			clock.Add(testCase.elapsed)
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if testCase.expectedErr {
+				if err != expectedErr || token != "" {
+					t.Errorf("expected error, but got token %q and error %v", token, err)
+				}
+			} else if err != nil || token != cachedToken {
+				t.Errorf("expected cached token, but got error: %v", err)
+			}
+		})
+	}
+}
+
+// Tests that Now reflects the clock of the cache.
+func Test_Cache_Now(t *testing.T) {
+	// given
+	clock := newFakeClock()
+	cache := NewCache(Clock(clock.Now))
+	cacheMap := NewCacheMap(MapClock(clock.Now))
+
+	// when
+	clock.Add(time.Hour)
+
+	// then
+	if now := cache.Now(); !now.Equal(clock.Now()) {
+		t.Errorf("expected %s, but got %s", clock.Now(), now)
+	}
+
+	if now := cacheMap.Now(); !now.Equal(clock.Now()) {
+		t.Errorf("expected %s, but got %s", clock.Now(), now)
+	}
+}
+
+// Tests that concurrent ForceRefresh calls are coalesced into a single
+// invocation of the token function, providing a fresh token to all.
+func Test_Cache_ForceRefresh_Concurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	tokenFunc := getTokenFunction()
+	counter := int32(0)
+	blocking := int32(0)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&counter, 1)
+			if atomic.LoadInt32(&blocking) == 1 {
+				started <- struct{}{}
+				<-release
+			}
+			return tokenFunc(ctx)
+		}),
+	)
+
+	cachedToken, err := cache.EnsureToken(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	atomic.StoreInt32(&counter, 0)
+	atomic.StoreInt32(&blocking, 1)
+
+	// when
+	tokens := make([]string, 10)
+	wg := &sync.WaitGroup{}
+	for i := range tokens {
+		i := i
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			token, err := cache.ForceRefresh(context.Background())
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			tokens[i] = token
+		}()
+
+		// Ensure the first caller is in flight, before the others join
+		if i == 0 {
+			<-started
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// then
+	if count := atomic.LoadInt32(&counter); count != 1 {
+		t.Errorf("expected token function to be called once, but was called %d times", count)
+	}
+
+	for _, token := range tokens {
+		if token == "" || token == cachedToken || token != tokens[0] {
+			t.Errorf("expected all callers to receive the same fresh token, but got %q", token)
+		}
+	}
+}
@@ -1,27 +1,157 @@
 package jwt
 
 import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// refreshAllConcurrency is the maximum number of refreshes
+// run concurrently by RefreshAll.
+const refreshAllConcurrency = 8
+
+// refreshLimiter bounds the number of concurrent token function
+// invocations. A nil limiter does not bound at all.
+type refreshLimiter struct {
+	// Accessed atomically, and thus first for 64-bit alignment
+	pending int64
+
+	slots chan struct{}
+}
+
+func newRefreshLimiter(maxRefreshes int) *refreshLimiter {
+	if maxRefreshes <= 0 {
+		return nil
+	}
+
+	return &refreshLimiter{slots: make(chan struct{}, maxRefreshes)}
+}
+
+// acquire waits for a free slot, or till the context is done.
+func (limiter *refreshLimiter) acquire(ctx context.Context) error {
+	if limiter == nil {
+		return nil
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	atomic.AddInt64(&limiter.pending, 1)
+	defer atomic.AddInt64(&limiter.pending, -1)
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (limiter *refreshLimiter) release() {
+	if limiter != nil {
+		<-limiter.slots
+	}
+}
+
+// waiting returns the number of callers waiting for a free slot.
+func (limiter *refreshLimiter) waiting() int {
+	if limiter == nil {
+		return 0
+	}
+
+	return int(atomic.LoadInt64(&limiter.pending))
+}
+
+// RefreshErrors is returned by RefreshAll, and maps every key
+// which failed to refresh to its respective error.
+type RefreshErrors map[string]error
+
+// Error returns a summary of all contained errors, ordered by key.
+func (errs RefreshErrors) Error() string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	messages := make([]string, len(keys))
+	for i, key := range keys {
+		messages[i] = fmt.Sprintf("%s: %s", key, errs[key])
+	}
+
+	return fmt.Sprintf("failed to refresh %d keys: %s", len(errs), strings.Join(messages, "; "))
+}
+
 // CacheMap is a mapped implementation of Cache, which allows storing
 // JWTs by a key (for example a tenant UUID). As a bonus, the map is
 // concurrency safe.
 type CacheMap struct {
-	jwtMap map[string]*Cache
-	lock   *sync.RWMutex
+	jwtMap  map[string]*Cache
+	lock    *sync.RWMutex
+	limiter *refreshLimiter
+	keys    *keySetHolder
 
-	name             string
-	logger           LoggerContract
-	headroom         time.Duration
-	tokenFunc        func(ctx context.Context, key string) (string, error)
-	parseOptions     []jwt.ParseOption
-	rejectUnparsable bool
+	name                  string
+	logger                LoggerContract
+	headroom              time.Duration
+	tokenFunc             func(ctx context.Context, key string) (string, error)
+	parseOptions          []jwt.ParseOption
+	rejectUnparsable      bool
+	events                eventSink
+	requiredScopes        []string
+	now                   func() time.Time
+	observers             []ObserverContract
+	correlationIDFunc     func(ctx context.Context) string
+	secondary             *CacheMap
+	allowedKeyIDs         []string
+	scopeClaim            string
+	noncePolicy           NoncePolicy
+	shouldCache           func(token jwt.Token) bool
+	maxTokenAge           time.Duration
+	claimValidators       []ClaimValidator
+	aggregateValidation   bool
+	normalizeClaimKeys    bool
+	allowedAlgorithms     []jwa.SignatureAlgorithm
+	warmupFunc            func(ctx context.Context, key string) (string, error)
+	logFingerprint        bool
+	lifetimeFraction      float64
+	treatNoExpAsValid     bool
+	revalidateOnAccess    bool
+	expectedSubject       string
+	minRemaining          time.Duration
+	maxTTL                time.Duration
+	strictExpiry          bool
+	issuedAfter           time.Time
+	logRounding           time.Duration
+	logClaims             []string
+	retainClaims          bool
+	recordLockStats       bool
+	verifier              VerifierContract
+	validityRewriter      func(computed time.Time, token jwt.Token) time.Time
+	allowedIssuers        []string
+	serveUnexpiredOnError bool
+	maxHeaderBytes        int
+	maxPayloadBytes       int
+	refreshKeysOnFailure  bool
+	recorder              RecorderContract
+	expectedAudiences     []string
+	requireAllAudiences   bool
+	acceptFunc            func(token jwt.Token) (bool, error)
+	clockJumpThreshold    time.Duration
+	keyAsAudience         bool
+	keyLookup             KeyLookupFunc
 }
 
 // NewCacheMap returns a new mapped JWT cache.
@@ -36,6 +166,10 @@ func NewCacheMap(opts ...MapOption) *CacheMap {
 		},
 		parseOptions:     nil,
 		rejectUnparsable: false,
+		now:              time.Now,
+		scopeClaim:       "scope",
+		retainClaims:     true,
+		recorder:         NoopRecorder{},
 	}
 
 	//apply opts
@@ -44,25 +178,116 @@ func NewCacheMap(opts ...MapOption) *CacheMap {
 	}
 
 	return &CacheMap{
-		jwtMap: map[string]*Cache{},
-		lock:   &sync.RWMutex{},
+		jwtMap:  map[string]*Cache{},
+		lock:    &sync.RWMutex{},
+		limiter: newRefreshLimiter(mapConfig.maxRefreshes),
+		keys:    newKeySetHolder(mapConfig.keySetLoader, mapConfig.sharedKeys),
 
-		name:             mapConfig.name,
-		logger:           mapConfig.logger,
-		headroom:         mapConfig.headroom,
-		tokenFunc:        mapConfig.tokenFunc,
-		parseOptions:     mapConfig.parseOptions,
-		rejectUnparsable: mapConfig.rejectUnparsable,
+		name:                  mapConfig.name,
+		logger:                mapConfig.logger,
+		headroom:              mapConfig.headroom,
+		tokenFunc:             mapConfig.tokenFunc,
+		parseOptions:          mapConfig.parseOptions,
+		rejectUnparsable:      mapConfig.rejectUnparsable,
+		events:                mapConfig.events,
+		requiredScopes:        mapConfig.requiredScopes,
+		now:                   mapConfig.now,
+		observers:             mapConfig.observers,
+		correlationIDFunc:     mapConfig.correlationIDFunc,
+		secondary:             mapConfig.secondary,
+		allowedKeyIDs:         mapConfig.allowedKeyIDs,
+		scopeClaim:            mapConfig.scopeClaim,
+		noncePolicy:           mapConfig.noncePolicy,
+		shouldCache:           mapConfig.shouldCache,
+		maxTokenAge:           mapConfig.maxTokenAge,
+		claimValidators:       mapConfig.claimValidators,
+		aggregateValidation:   mapConfig.aggregateValidation,
+		normalizeClaimKeys:    mapConfig.normalizeClaimKeys,
+		allowedAlgorithms:     mapConfig.allowedAlgorithms,
+		warmupFunc:            mapConfig.warmupFunc,
+		logFingerprint:        mapConfig.logFingerprint,
+		lifetimeFraction:      mapConfig.lifetimeFraction,
+		treatNoExpAsValid:     mapConfig.treatNoExpAsValid,
+		revalidateOnAccess:    mapConfig.revalidateOnAccess,
+		expectedSubject:       mapConfig.expectedSubject,
+		minRemaining:          mapConfig.minRemaining,
+		maxTTL:                mapConfig.maxTTL,
+		strictExpiry:          mapConfig.strictExpiry,
+		issuedAfter:           mapConfig.issuedAfter,
+		logRounding:           mapConfig.logRounding,
+		logClaims:             mapConfig.logClaims,
+		retainClaims:          mapConfig.retainClaims,
+		recordLockStats:       mapConfig.recordLockStats,
+		verifier:              mapConfig.verifier,
+		validityRewriter:      mapConfig.validityRewriter,
+		allowedIssuers:        mapConfig.allowedIssuers,
+		serveUnexpiredOnError: mapConfig.serveUnexpiredOnError,
+		maxHeaderBytes:        mapConfig.maxHeaderBytes,
+		maxPayloadBytes:       mapConfig.maxPayloadBytes,
+		refreshKeysOnFailure:  mapConfig.refreshKeysOnFailure,
+		recorder:              mapConfig.recorder,
+		expectedAudiences:     mapConfig.expectedAudiences,
+		requireAllAudiences:   mapConfig.requireAllAudiences,
+		acceptFunc:            mapConfig.acceptFunc,
+		clockJumpThreshold:    mapConfig.clockJumpThreshold,
+		keyAsAudience:         mapConfig.keyAsAudience,
+		keyLookup:             mapConfig.keyLookup,
 	}
 }
 
 type mapConfig struct {
-	name             string
-	logger           LoggerContract
-	headroom         time.Duration
-	tokenFunc        func(ctx context.Context, key string) (string, error)
-	parseOptions     []jwt.ParseOption
-	rejectUnparsable bool
+	name                  string
+	logger                LoggerContract
+	headroom              time.Duration
+	tokenFunc             func(ctx context.Context, key string) (string, error)
+	parseOptions          []jwt.ParseOption
+	rejectUnparsable      bool
+	events                eventSink
+	requiredScopes        []string
+	now                   func() time.Time
+	observers             []ObserverContract
+	correlationIDFunc     func(ctx context.Context) string
+	secondary             *CacheMap
+	maxRefreshes          int
+	allowedKeyIDs         []string
+	scopeClaim            string
+	noncePolicy           NoncePolicy
+	shouldCache           func(token jwt.Token) bool
+	maxTokenAge           time.Duration
+	claimValidators       []ClaimValidator
+	aggregateValidation   bool
+	normalizeClaimKeys    bool
+	allowedAlgorithms     []jwa.SignatureAlgorithm
+	warmupFunc            func(ctx context.Context, key string) (string, error)
+	logFingerprint        bool
+	lifetimeFraction      float64
+	treatNoExpAsValid     bool
+	revalidateOnAccess    bool
+	expectedSubject       string
+	minRemaining          time.Duration
+	maxTTL                time.Duration
+	strictExpiry          bool
+	keySetLoader          func() (jwk.Set, error)
+	sharedKeys            *SharedKeys
+	issuedAfter           time.Time
+	logRounding           time.Duration
+	logClaims             []string
+	retainClaims          bool
+	recordLockStats       bool
+	verifier              VerifierContract
+	validityRewriter      func(computed time.Time, token jwt.Token) time.Time
+	allowedIssuers        []string
+	serveUnexpiredOnError bool
+	maxHeaderBytes        int
+	maxPayloadBytes       int
+	refreshKeysOnFailure  bool
+	recorder              RecorderContract
+	expectedAudiences     []string
+	requireAllAudiences   bool
+	acceptFunc            func(token jwt.Token) (bool, error)
+	clockJumpThreshold    time.Duration
+	keyAsAudience         bool
+	keyLookup             KeyLookupFunc
 }
 
 // MapOption represents an option for the mapped cache.
@@ -93,6 +318,120 @@ func MapHeadroom(headroom time.Duration) MapOption {
 	}
 }
 
+// MapMinRemainingToServe sets the validity a cached token must have left to be
+// served by EnsureToken - otherwise, a new token is fetched. In contrast to
+// the headroom, this does not change the stored validity of the token, but
+// is evaluated on every access.
+//
+// The default is 0, which serves tokens till their validity passes.
+func MapMinRemainingToServe(minRemaining time.Duration) MapOption {
+	return func(c *mapConfig) {
+		c.minRemaining = minRemaining
+	}
+}
+
+// MapRefreshAtLifetimeFraction sets the fraction (between 0 and 1) of the
+// token lifetime, after which the token is refreshed. The validity of a
+// token is then computed as iat + fraction * (exp - iat), instead of
+// exp - headroom. Tokens without an iat claim, and tokens without an exp
+// claim accepted via TreatNoExpAsValid, fall back to the headroom.
+//
+// The default is 0, which uses the headroom only.
+func MapRefreshAtLifetimeFraction(fraction float64) MapOption {
+	return func(c *mapConfig) {
+		c.lifetimeFraction = fraction
+	}
+}
+
+// MapLogDurationRounding sets the precision, to which the caching duration
+// is rounded in the refresh log, e.g. time.Second. This avoids noisy
+// sub-second durations, as caused by MapRefreshAtLifetimeFraction.
+// The default is 0, which does not round.
+func MapLogDurationRounding(rounding time.Duration) MapOption {
+	return func(c *mapConfig) {
+		c.logRounding = rounding
+	}
+}
+
+// MapLogClaims sets the names of claims, which are logged along with the
+// refresh log of a new token, e.g. for auditing the sub or scope of
+// refreshed tokens. Loggers supporting structured fields (such as logrus)
+// receive the claims as fields. Take care to not configure sensitive claims.
+// The default is no claims.
+func MapLogClaims(names ...string) MapOption {
+	return func(c *mapConfig) {
+		c.logClaims = names
+	}
+}
+
+// MapRetainClaims sets whether the parsed claims of the cached tokens are
+// retained. Disabling this lowers the memory footprint for very large
+// tokens, as only the exp, iat and nbf claims are kept. CacheMap.Claim then
+// reports no claims, and EnsureTokenMatching parses the cached token again
+// on every call.
+// The default is true.
+func MapRetainClaims(retain bool) MapOption {
+	return func(c *mapConfig) {
+		c.retainClaims = retain
+	}
+}
+
+// MapRecordLockStats sets whether the time spent holding the internal lock
+// of every key is recorded, for diagnosing contention (e.g. caused by slow
+// callbacks). Only exclusive holds (e.g. storing a new token) are recorded,
+// while the shared holds of serving cached tokens are not, to keep the hit
+// path cheap. The statistics are available via LockStats.
+// The default is false.
+func MapRecordLockStats(record bool) MapOption {
+	return func(c *mapConfig) {
+		c.recordLockStats = record
+	}
+}
+
+// MapValidityRewriter sets a function, which adjusts the validity computed
+// for a new token (from its exp claim and the headroom), e.g. for quirks
+// of specific providers. The validity can only be shortened - returning
+// a later validity than the computed one has no effect.
+// The default is no rewriter.
+func MapValidityRewriter(rewriter func(computed time.Time, token jwt.Token) time.Time) MapOption {
+	return func(c *mapConfig) {
+		c.validityRewriter = rewriter
+	}
+}
+
+// MapServeWithinRealExpiryOnError sets whether the cached token of a key
+// is served if refreshing it fails, as long as it is not yet expired as
+// per its exp claim. This turns the headroom into a safety buffer during
+// outages of the issuer, without ever serving actually expired tokens.
+// The default is false.
+func MapServeWithinRealExpiryOnError(serve bool) MapOption {
+	return func(c *mapConfig) {
+		c.serveUnexpiredOnError = serve
+	}
+}
+
+// MapMaxHeaderBytes sets the maximum size of the (still encoded) header
+// segment of a token. Tokens with a larger header are rejected with
+// ErrSegmentTooLarge before being decoded, which defends against
+// pathological tokens.
+// The default is 0, which does not limit the size.
+func MapMaxHeaderBytes(maxBytes int) MapOption {
+	return func(c *mapConfig) {
+		c.maxHeaderBytes = maxBytes
+	}
+}
+
+// MapMaxPayloadBytes sets the maximum size of the (still encoded) payload
+// segment of a token. Tokens with a larger payload are rejected with
+// ErrSegmentTooLarge before being decoded, which defends against
+// pathological tokens.
+// The default is 0, which does not limit the size.
+func MapMaxPayloadBytes(maxBytes int) MapOption {
+	return func(c *mapConfig) {
+		c.maxPayloadBytes = maxBytes
+	}
+}
+
 // MapTokenFunction set the function which is called to retrieve a new
 // JWT when required.
 // The default always returns an error with "not implemented".
@@ -112,9 +451,24 @@ func MapParseOptions(parseOptions ...jwt.ParseOption) MapOption {
 	}
 }
 
+// MapNormalizeClaimKeys sets whether registered claims with non-conforming
+// key casing (e.g. "Exp" instead of "exp") are accepted, for legacy
+// issuers. Such claims are moved to their registered key after parsing,
+// if the registered key itself is not set. Note that validation done by
+// the parser itself (see MapParseOptions) still only sees the original keys.
+//
+// The default is false, as this is not standard conforming.
+func MapNormalizeClaimKeys(normalize bool) MapOption {
+	return func(c *mapConfig) {
+		c.normalizeClaimKeys = normalize
+	}
+}
+
 // MapRejectUnparsable sets if the cache should reject (and return
 // the accompanying error) token which are not parsable.
 // Note, unparsable can mean a failed signature check.
+// Structurally broken tokens are reported with ErrMalformedToken,
+// ErrMalformedEncoding or ErrMalformedJSON.
 //
 // The default is false.
 func MapRejectUnparsable(rejectUnparsable bool) MapOption {
@@ -123,41 +477,661 @@ func MapRejectUnparsable(rejectUnparsable bool) MapOption {
 	}
 }
 
+// MapEvents sets a channel on which cache lifecycle events (hit, miss,
+// refresh and error) of all keyed caches are emitted. The channel should
+// be buffered, and the policy defines what happens if it is full:
+// DropEvents discards the event, while BlockEvents waits till the event
+// is delivered or the context passed to EnsureToken is done.
+//
+// The default is no channel, so no events are emitted.
+func MapEvents(events chan<- Event, policy EventPolicy) MapOption {
+	return func(c *mapConfig) {
+		c.events = eventSink{events: events, policy: policy}
+	}
+}
+
+// MapRequiredScopes sets the scopes a token must carry in its scope
+// claim (either as a space-delimited string, or an array of strings).
+// The name of the claim can be changed via MapScopeClaim.
+// Tokens missing any of these scopes are rejected with ErrMissingScopes,
+// and are not cached.
+// Note, this check only applies to parsable tokens - use MapRejectUnparsable
+// to reject all others.
+//
+// The default is empty.
+func MapRequiredScopes(scopes ...string) MapOption {
+	return func(c *mapConfig) {
+		c.requiredScopes = scopes
+	}
+}
+
+// MapAllowedIssuers sets the issuers a token may be issued by. The iss
+// claim of every token is checked against this list, and tokens of an
+// unknown (or missing) issuer are rejected with ErrIssuerNotAllowed,
+// before being cached. This allows accepting tokens of several issuers.
+//
+// The default is empty, which allows all issuers.
+func MapAllowedIssuers(issuers ...string) MapOption {
+	return func(c *mapConfig) {
+		c.allowedIssuers = issuers
+	}
+}
+
+// MapExpectedSubject sets the subject, which the sub claim of every token must
+// match. Tokens for another subject are rejected with ErrUnexpectedSubject,
+// before being cached. This catches tokens issued for the wrong identity.
+//
+// The default is empty, which accepts any subject.
+func MapExpectedSubject(subject string) MapOption {
+	return func(c *mapConfig) {
+		c.expectedSubject = subject
+	}
+}
+
+// MapExpectedAudience sets the audiences, which the aud claim of every
+// token is checked against. As the aud claim may hold several audiences,
+// a token is accepted if any of them is expected, unless
+// MapRequireAllAudiences is enabled. Other tokens are rejected with
+// ErrUnexpectedAudience, before being cached.
+//
+// The default is empty, which accepts any audience.
+func MapExpectedAudience(audiences ...string) MapOption {
+	return func(c *mapConfig) {
+		c.expectedAudiences = audiences
+	}
+}
+
+// MapRequireAllAudiences sets whether the aud claim of every token must
+// contain all audiences set via MapExpectedAudience, instead of any of them.
+//
+// The default is false.
+func MapRequireAllAudiences(requireAllAudiences bool) MapOption {
+	return func(c *mapConfig) {
+		c.requireAllAudiences = requireAllAudiences
+	}
+}
+
+// MapKeyAsAudience sets whether the aud claim of every token must contain
+// the key of its cache, e.g. for caches keyed by audience. Other tokens are
+// rejected with ErrUnexpectedAudience, before being cached. The check
+// applies in addition to MapExpectedAudience.
+//
+// The default is false.
+func MapKeyAsAudience(keyAsAudience bool) MapOption {
+	return func(c *mapConfig) {
+		c.keyAsAudience = keyAsAudience
+	}
+}
+
+// MapStrictExpiry sets whether the expiry of every token is strictly
+// validated: The exp claim must be present (ErrMissingExpiry), positive
+// (ErrInvalidExpiry), after the iat claim (ErrExpiryBeforeIssuedAt), and -
+// if maxTTL is larger than 0 - at most maxTTL in the future
+// (ErrExpiryTooFar). Tokens violating any of these are rejected.
+//
+// The default is false, which does not validate the expiry strictly.
+func MapStrictExpiry(strict bool, maxTTL time.Duration) MapOption {
+	return func(c *mapConfig) {
+		c.strictExpiry = strict
+		c.maxTTL = maxTTL
+	}
+}
+
+// MapScopeClaim sets the name of the claim the MapRequiredScopes are
+// read from, as providers differ in their convention (e.g. "scope", "scp"
+// or "scopes").
+//
+// The default is "scope".
+func MapScopeClaim(name string) MapOption {
+	return func(c *mapConfig) {
+		c.scopeClaim = name
+	}
+}
+
+// MapClock sets the function used to retrieve the current time, when
+// checking the validity of the cached tokens. This is mostly useful
+// for testing.
+//
+// The default is time.Now.
+func MapClock(now func() time.Time) MapOption {
+	return func(c *mapConfig) {
+		c.now = now
+	}
+}
+
+// MapClockJumpThreshold enables detecting jumps of the wall clock (e.g. on
+// VM resume or NTP steps), by comparing the wall and monotonic time elapsed
+// since a token was cached. If they differ by more than the threshold, the
+// validity of the cached token is re-evaluated against the monotonic time
+// elapsed - and the token is dropped, if it is now expired.
+//
+// Note that the wall time is read via MapClock, while the monotonic time is
+// always read from the system. Combined with a fake clock (e.g. in tests),
+// every deviation of the fake clock from the system time is detected as
+// a jump - so the detection should only be enabled with the real clock.
+//
+// The default is 0, which disables the detection.
+func MapClockJumpThreshold(threshold time.Duration) MapOption {
+	return func(c *mapConfig) {
+		c.clockJumpThreshold = threshold
+	}
+}
+
+// MapObserver registers observers, which are notified about the refresh
+// lifecycle of all keyed caches. The option can be used multiple times,
+// and observers are invoked in registration order. See ObserverContract
+// for the invocation guarantees.
+//
+// The default is no observer.
+func MapObserver(observers ...ObserverContract) MapOption {
+	return func(c *mapConfig) {
+		c.observers = append(c.observers, observers...)
+	}
+}
+
+// MapRecorder sets the recorder, which is notified about hits, misses,
+// refreshes and errors of all keys. This allows adapting any metrics
+// backend, without this package depending on it.
+// The default is the NoopRecorder.
+func MapRecorder(recorder RecorderContract) MapOption {
+	return func(c *mapConfig) {
+		c.recorder = recorder
+	}
+}
+
+// MapCorrelationID sets a function which extracts a correlation ID (e.g. a
+// request or trace ID) from the context passed to EnsureToken. The ID is
+// included in refresh log messages and emitted events, which allows tying
+// token fetches to the request which triggered them.
+//
+// The default is no function, so no correlation ID is used.
+func MapCorrelationID(correlationIDFunc func(ctx context.Context) string) MapOption {
+	return func(c *mapConfig) {
+		c.correlationIDFunc = correlationIDFunc
+	}
+}
+
+// MapSecondary sets a secondary mapped cache (e.g. using a token endpoint
+// in a different region), which is used by EnsureToken if refreshing the
+// token of a key fails. The secondary cache tracks the validity of its
+// tokens on its own. If the secondary cache fails as well, the original
+// error is returned.
+//
+// The default is no secondary cache.
+func MapSecondary(secondary *CacheMap) MapOption {
+	return func(c *mapConfig) {
+		c.secondary = secondary
+	}
+}
+
+// MapMaxConcurrentRefreshes bounds how many token function invocations
+// may run at once across all keys, so that a burst of new keys does not
+// overwhelm the auth server. Further refreshes wait for a free slot, or
+// till their context is done.
+//
+// The default is 0, which means unbounded.
+func MapMaxConcurrentRefreshes(maxRefreshes int) MapOption {
+	return func(c *mapConfig) {
+		c.maxRefreshes = maxRefreshes
+	}
+}
+
+// MapAllowedKeyIDs sets the key IDs a token may be signed with. The kid
+// header of every token is checked against this list before parsing, and
+// tokens with an unknown (or missing) kid are rejected with
+// ErrKeyIDNotAllowed. This limits the exposure to unexpected keys.
+//
+// The default is empty, which allows all key IDs.
+func MapAllowedKeyIDs(keyIDs ...string) MapOption {
+	return func(c *mapConfig) {
+		c.allowedKeyIDs = keyIDs
+	}
+}
+
+// MapClaimValidators registers validators, which check the claims of every
+// freshly parsed token. A token is only accepted if all validators pass.
+// The option can be used multiple times, and validators are invoked in
+// registration order - after the built-in validation rules. By default,
+// the first failure is returned (see MapAggregateValidationErrors).
+//
+// The default is no validator.
+func MapClaimValidators(validators ...ClaimValidator) MapOption {
+	return func(c *mapConfig) {
+		c.claimValidators = append(c.claimValidators, validators...)
+	}
+}
+
+// MapAggregateValidationErrors sets whether all claim validators are invoked
+// even if one fails, returning all failures as ValidationErrors. Otherwise,
+// the first failure is returned as is.
+//
+// The default is false.
+func MapAggregateValidationErrors(aggregate bool) MapOption {
+	return func(c *mapConfig) {
+		c.aggregateValidation = aggregate
+	}
+}
+
+// MapMaxTokenAge sets the maximum age of a token, as derived from its iat
+// claim. Tokens issued longer ago are rejected with ErrTokenTooOld, even
+// if their exp claim is still valid. Tokens without an iat claim are
+// not checked.
+//
+// The default is 0, which does not limit the token age.
+func MapMaxTokenAge(maxTokenAge time.Duration) MapOption {
+	return func(c *mapConfig) {
+		c.maxTokenAge = maxTokenAge
+	}
+}
+
+// MapNotBeforeIssuedAt rejects tokens issued before the given cutoff with
+// ErrIssuedBeforeCutoff, as derived from their iat claim. This allows a
+// mass revocation of tokens by issuance time. Tokens without an iat claim
+// are rejected, too. Unlike the nbf claim, the cutoff is set by the client.
+//
+// The default is the zero time, which does not check the iat claim.
+func MapNotBeforeIssuedAt(cutoff time.Time) MapOption {
+	return func(c *mapConfig) {
+		c.issuedAfter = cutoff
+	}
+}
+
+// MapTreatNoExpAsValid sets whether tokens without an exp claim are cached
+// indefinitely, instead of not being cached at all. This is only meant for
+// trusted internal issuers, which deliberately omit exp: such a token is
+// never refreshed by EnsureToken, even if it was revoked in the meantime -
+// only ForceRefresh or Invalidate replace it.
+//
+// The default is false.
+func MapTreatNoExpAsValid(treatNoExpAsValid bool) MapOption {
+	return func(c *mapConfig) {
+		c.treatNoExpAsValid = treatNoExpAsValid
+	}
+}
+
+// MapVerifier sets a verifier, to which the verification of the signature
+// of every fetched token is delegated before parsing - e.g. to a KMS or
+// HSM, which does not expose its keys. Tokens failing verification are
+// treated as unparsable, so combine with MapRejectUnparsable.
+// The default is no verifier.
+func MapVerifier(verifier VerifierContract) MapOption {
+	return func(c *mapConfig) {
+		c.verifier = verifier
+	}
+}
+
+// MapKeySet sets a function, which loads the key set tokens are verified
+// against - e.g. a static JWKS via jwk.Parse. The key of a token is chosen
+// by its kid header, as with jwt.WithKeySet. The key set is shared by all
+// keys, loaded on first use, and only reloaded via RefreshKeys, which
+// decouples key refreshes from token refreshes. Combine with
+// MapRejectUnparsable, so that tokens failing verification are not returned.
+//
+// The default is nil, which does not verify tokens against a key set.
+func MapKeySet(load func() (jwk.Set, error)) MapOption {
+	return func(c *mapConfig) {
+		c.keySetLoader = load
+	}
+}
+
+// MapSharedKeySet sets a key set shared with other caches (see
+// NewSharedKeys), which tokens are verified against like with MapKeySet. The
+// shared key set is loaded once for all caches, and RefreshKeys on any of
+// them reloads it for all. It takes precedence over MapKeySet.
+//
+// The default is nil, which does not share a key set.
+func MapSharedKeySet(keys *SharedKeys) MapOption {
+	return func(c *mapConfig) {
+		c.sharedKeys = keys
+	}
+}
+
+// MapRefreshKeysOnVerificationFailure sets whether the key set configured
+// via the MapKeySet option is reloaded once, if a token fails verification,
+// and the token is parsed again with the reloaded key set. This handles
+// tokens signed with rotated keys, without waiting for RefreshKeys.
+// The default is false.
+func MapRefreshKeysOnVerificationFailure(refresh bool) MapOption {
+	return func(c *mapConfig) {
+		c.refreshKeysOnFailure = refresh
+	}
+}
+
+// MapAcceptFunc sets a final gate, which is consulted for every token after
+// it passed all other validation, e.g. for applying business rules such as
+// required entitlements. If it returns false, the token is discarded and
+// ErrTokenNotAccepted is returned. If it returns an error, the token is
+// discarded and the error is returned as is. Unlike MapShouldCache, the
+// token is never returned to the caller. The gate is not consulted for
+// tokens which could not be parsed.
+//
+// The default is nil, which accepts all tokens.
+func MapAcceptFunc(accept func(token jwt.Token) (bool, error)) MapOption {
+	return func(c *mapConfig) {
+		c.acceptFunc = accept
+	}
+}
+
+// MapShouldCache sets a predicate, which decides whether a freshly parsed
+// token is cached. If the predicate returns false, the token is returned
+// to the caller, but not cached - similar to tokens without an exp claim.
+// The predicate is not consulted for tokens which could not be parsed.
+//
+// The default is nil, which caches all tokens with an exp claim.
+func MapShouldCache(shouldCache func(token jwt.Token) bool) MapOption {
+	return func(c *mapConfig) {
+		c.shouldCache = shouldCache
+	}
+}
+
+// MapNonceTracking enables tracking of the nonce claim of fetched tokens.
+// The cache records the nonce of the last token, and reports (NonceReport)
+// or rejects (NonceReject) a token repeating it. Tokens without a nonce
+// claim are not tracked. Note that nonces are tracked per key.
+//
+// The default is NonceIgnore, which does not track nonces.
+func MapNonceTracking(policy NoncePolicy) MapOption {
+	return func(c *mapConfig) {
+		c.noncePolicy = policy
+	}
+}
+
+// MapRevalidateOnEveryAccess sets whether cached tokens are parsed (with the
+// configured parse options, e.g. for signature verification) and validated
+// again on every access, instead of only once after being fetched. A token
+// failing revalidation is dropped, and a new token is fetched. This comes at
+// a CPU cost, and is meant as a temporary strict mode (e.g. during an
+// incident).
+//
+// The default is false.
+func MapRevalidateOnEveryAccess(revalidate bool) MapOption {
+	return func(c *mapConfig) {
+		c.revalidateOnAccess = revalidate
+	}
+}
+
+// MapLogFingerprint sets whether refresh logs include a short fingerprint of
+// the token (the first 8 hex digits of its SHA-256 hash), which allows
+// correlating tokens in audits. The raw token is never logged.
+//
+// The default is false.
+func MapLogFingerprint(logFingerprint bool) MapOption {
+	return func(c *mapConfig) {
+		c.logFingerprint = logFingerprint
+	}
+}
+
+// MapWarmup sets a function, which provides the token for the very first
+// miss of EnsureToken for a key, instead of the token function - e.g. to
+// seed the cache from a persisted token. The token is handled like a token
+// provided by the token function. Warmup runs at most once per key, and not
+// at all if a token was cached for the key before. If it fails, or provides
+// a token which cannot be served (e.g. an expired one), the token function
+// is invoked as usual.
+//
+// The default is nil, which does not warm up the cache.
+func MapWarmup(warmupFunc func(ctx context.Context, key string) (string, error)) MapOption {
+	return func(c *mapConfig) {
+		c.warmupFunc = warmupFunc
+	}
+}
+
+// MapAllowedAlgorithms sets the algorithms a token may be signed with. The alg
+// header of every token is checked against this list before parsing, and
+// tokens with another algorithm are rejected with ErrAlgorithmNotAllowed.
+// Unsigned tokens (alg "none") are always rejected, even if listed. Note
+// that this does not verify the signature itself (see MapParseOptions and
+// MapVerifyWithKeyLookup).
+//
+// The default is empty, which allows all algorithms.
+func MapAllowedAlgorithms(algorithms ...jwa.SignatureAlgorithm) MapOption {
+	return func(c *mapConfig) {
+		c.allowedAlgorithms = algorithms
+	}
+}
+
+// MapVerifyWithKeyLookup verifies the signature of every token with the key
+// returned by the given lookup, for the algorithm and key ID of the token
+// header. The algorithm is thus detected from the token, but must be
+// allowed via MapAllowedAlgorithms - with an empty allowlist, every token is
+// rejected with ErrAlgorithmNotAllowed. Unsigned tokens (alg "none") are
+// always rejected. If set, the lookup takes precedence over a key set. As
+// for other parse failures, tokens failing verification are only returned
+// as error in combination with MapRejectUnparsable.
+//
+// The default is nil, which verifies via MapParseOptions only.
+func MapVerifyWithKeyLookup(lookup KeyLookupFunc) MapOption {
+	return func(c *mapConfig) {
+		c.keyLookup = lookup
+	}
+}
+
+// Now returns the current time, as seen by the cache via the MapClock
+// option. Validity comparisons done by the cache are based on this time,
+// so tests and callers can reason about them consistently.
+func (cacheMap *CacheMap) Now() time.Time {
+	return cacheMap.now()
+}
+
 // EnsureToken returns either the cached token if existing and still valid,
 // or calls the internal token function to fetch a new token. If an error
 // occurs in the latter case, it is passed trough.
 func (cacheMap *CacheMap) EnsureToken(ctx context.Context, key string) (string, error) {
-	readLock := cacheMap.lock.RLocker()
-	writeLock := cacheMap.lock
+	return cacheMap.cacheFor(key).EnsureToken(ctx)
+}
 
-	readLock.Lock()
+// ForceRefresh calls the internal token function to fetch a new token
+// for the given key, regardless of the validity of the currently cached
+// token. If an error occurs, it is passed trough, and the currently
+// cached token is kept.
+func (cacheMap *CacheMap) ForceRefresh(ctx context.Context, key string) (string, error) {
+	return cacheMap.cacheFor(key).ForceRefresh(ctx)
+}
+
+// EnsureTokenMatching behaves like EnsureToken, but only returns the
+// token for the given key if its claims satisfy the given predicate.
+// See Cache.EnsureTokenMatching for details.
+func (cacheMap *CacheMap) EnsureTokenMatching(ctx context.Context, key string, pred func(token jwt.Token) bool) (string, error) {
+	return cacheMap.cacheFor(key).EnsureTokenMatching(ctx, pred)
+}
 
+// SetHeadroom replaces the headroom set via the MapHeadroom option at
+// runtime, for all current and future keys. See Cache.SetHeadroom.
+func (cacheMap *CacheMap) SetHeadroom(headroom time.Duration) {
+	cacheMap.lock.Lock()
+	defer cacheMap.lock.Unlock()
+
+	cacheMap.headroom = headroom
+	for _, cache := range cacheMap.jwtMap {
+		cache.SetHeadroom(headroom)
+	}
+}
+
+// Invalidate drops the cached token for the given key, so that the next
+// call to EnsureToken for the key fetches a new token. Unknown keys are
+// ignored.
+func (cacheMap *CacheMap) Invalidate(key string) {
+	cacheMap.lock.RLock()
 	cache, exists := cacheMap.jwtMap[key]
-	if !exists {
-		// Trade read lock for write lock
-		readLock.Unlock()
-		writeLock.Lock()
+	cacheMap.lock.RUnlock()
 
-		cacheMap.jwtMap[key] = NewCache(
-			Name(cacheMap.name+" for "+key),
-			Headroom(cacheMap.headroom),
-			Logger(cacheMap.logger),
-			TokenFunction(func(ctx context.Context) (string, error) {
-				return cacheMap.tokenFunc(ctx, key)
-			}),
-			ParseOptions(cacheMap.parseOptions...),
-			RejectUnparsable(cacheMap.rejectUnparsable),
-		)
+	if exists {
+		cache.Invalidate()
+	}
+}
 
-		cache = cacheMap.jwtMap[key]
+// PendingRefreshes returns the number of callers currently waiting for
+// a free refresh slot, as bounded via MapMaxConcurrentRefreshes. A
+// steadily high number hints at the auth server being a bottleneck.
+func (cacheMap *CacheMap) PendingRefreshes() int {
+	return cacheMap.limiter.waiting()
+}
+
+// RefreshAll forces a refresh of all currently known keys, e.g. after a
+// rotation of the signing key. The refreshes are run concurrently, with
+// at most refreshAllConcurrency refreshes at once. If any refresh fails,
+// a RefreshErrors is returned, containing the error of every failed key.
+func (cacheMap *CacheMap) RefreshAll(ctx context.Context) error {
+	cacheMap.lock.RLock()
+	caches := make(map[string]*Cache, len(cacheMap.jwtMap))
+	for key, cache := range cacheMap.jwtMap {
+		caches[key] = cache
+	}
+	cacheMap.lock.RUnlock()
+
+	errs := RefreshErrors{}
+	errsLock := &sync.Mutex{}
+
+	semaphore := make(chan struct{}, refreshAllConcurrency)
+	wg := &sync.WaitGroup{}
+
+	for key, cache := range caches {
+		key, cache := key, cache
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			if _, err := cache.ForceRefresh(ctx); err != nil {
+				errsLock.Lock()
+				errs[key] = err
+				errsLock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
 
-		// Trade write lock for read lock
-		writeLock.Unlock()
-		readLock.Lock()
+	if len(errs) > 0 {
+		return errs
 	}
 
-	// Ensure that we unlock, even if the key function misbehaves
-	defer readLock.Unlock()
+	return nil
+}
+
+// cacheFor returns the cache for the given key, lazily creating it
+// if it does not exist yet.
+// claimValidatorsFor returns the claim validators of the cache for the
+// given key, including the audience check of MapKeyAsAudience.
+func (cacheMap *CacheMap) claimValidatorsFor(key string) []ClaimValidator {
+	if !cacheMap.keyAsAudience {
+		return cacheMap.claimValidators
+	}
+
+	validators := make([]ClaimValidator, 0, len(cacheMap.claimValidators)+1)
+	validators = append(validators, func(token jwt.Token) error {
+		return validateAudience(token, []string{key}, true)
+	})
+
+	return append(validators, cacheMap.claimValidators...)
+}
+
+func (cacheMap *CacheMap) cacheFor(key string) *Cache {
+	cacheMap.lock.RLock()
+	cache, exists := cacheMap.jwtMap[key]
+	cacheMap.lock.RUnlock()
+
+	if exists {
+		return cache
+	}
+
+	cacheMap.lock.Lock()
+	defer cacheMap.lock.Unlock()
+
+	// Another caller might have created the cache in the meantime
+	if cache, exists := cacheMap.jwtMap[key]; exists {
+		return cache
+	}
+
+	var secondary *Cache
+	if cacheMap.secondary != nil {
+		secondary = cacheMap.secondary.cacheFor(key)
+	}
+
+	cache = NewCache(
+		Name(cacheMap.name+" for "+key),
+		Headroom(cacheMap.headroom),
+		Logger(cacheMap.logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return cacheMap.tokenFunc(ctx, key)
+		}),
+		ParseOptions(cacheMap.parseOptions...),
+		RejectUnparsable(cacheMap.rejectUnparsable),
+		Events(cacheMap.events.events, cacheMap.events.policy),
+		RequiredScopes(cacheMap.requiredScopes...),
+		Clock(cacheMap.now),
+		Observer(cacheMap.observers...),
+		CorrelationID(cacheMap.correlationIDFunc),
+		Secondary(secondary),
+		AllowedKeyIDs(cacheMap.allowedKeyIDs...),
+		ScopeClaim(cacheMap.scopeClaim),
+		NonceTracking(cacheMap.noncePolicy),
+		ShouldCache(cacheMap.shouldCache),
+		MaxTokenAge(cacheMap.maxTokenAge),
+		ClaimValidators(cacheMap.claimValidatorsFor(key)...),
+		AggregateValidationErrors(cacheMap.aggregateValidation),
+		NormalizeClaimKeys(cacheMap.normalizeClaimKeys),
+		AllowedAlgorithms(cacheMap.allowedAlgorithms...),
+		Warmup(cacheMap.warmupFor(key)),
+		LogFingerprint(cacheMap.logFingerprint),
+		RefreshAtLifetimeFraction(cacheMap.lifetimeFraction),
+		TreatNoExpAsValid(cacheMap.treatNoExpAsValid),
+		RevalidateOnEveryAccess(cacheMap.revalidateOnAccess),
+		ExpectedSubject(cacheMap.expectedSubject),
+		MinRemainingToServe(cacheMap.minRemaining),
+		StrictExpiry(cacheMap.strictExpiry, cacheMap.maxTTL),
+		NotBeforeIssuedAt(cacheMap.issuedAfter),
+		LogDurationRounding(cacheMap.logRounding),
+		LogClaims(cacheMap.logClaims...),
+		RetainClaims(cacheMap.retainClaims),
+		RecordLockStats(cacheMap.recordLockStats),
+		Verifier(cacheMap.verifier),
+		ValidityRewriter(cacheMap.validityRewriter),
+		AllowedIssuers(cacheMap.allowedIssuers...),
+		ServeWithinRealExpiryOnError(cacheMap.serveUnexpiredOnError),
+		MaxHeaderBytes(cacheMap.maxHeaderBytes),
+		MaxPayloadBytes(cacheMap.maxPayloadBytes),
+		RefreshKeysOnVerificationFailure(cacheMap.refreshKeysOnFailure),
+		Recorder(cacheMap.recorder),
+		ExpectedAudience(cacheMap.expectedAudiences...),
+		RequireAllAudiences(cacheMap.requireAllAudiences),
+		AcceptFunc(cacheMap.acceptFunc),
+		ClockJumpThreshold(cacheMap.clockJumpThreshold),
+		VerifyWithKeyLookup(cacheMap.keyLookup),
+	)
+
+	cache.limiter = cacheMap.limiter
+	cache.keys = cacheMap.keys
+
+	cacheMap.jwtMap[key] = cache
+
+	return cache
+}
+
+// warmupFor binds the warmup function (if any) to the given key.
+func (cacheMap *CacheMap) warmupFor(key string) func(ctx context.Context) (string, error) {
+	if cacheMap.warmupFunc == nil {
+		return nil
+	}
+
+	return func(ctx context.Context) (string, error) {
+		return cacheMap.warmupFunc(ctx, key)
+	}
+}
+
+// AuthorizationHeader returns the token as provided by EnsureToken, formatted
+// as a value for the HTTP Authorization header (e.g. "Bearer xyz"). If the
+// token function already returned a token with a "Bearer" prefix, the
+// prefix is not applied twice.
+func (cacheMap *CacheMap) AuthorizationHeader(ctx context.Context, key string) (string, error) {
+	token, err := cacheMap.EnsureToken(ctx, key)
+	if err != nil {
+		return "", err
+	}
 
-	return cache.EnsureToken(ctx)
+	return bearer(token), nil
 }
@@ -1,11 +1,14 @@
 package jwt
 
 import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -122,3 +125,728 @@ func Test_MapOption_RejectUnparsable(t *testing.T) {
 		t.Errorf("reject unparsable not correctly applied, got %t", options.rejectUnparsable)
 	}
 }
+
+// Tests that the MapEvents option correctly applies.
+func Test_MapOption_Events(t *testing.T) {
+	// given
+	events := make(chan Event)
+	option := MapEvents(events, BlockEvents)
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if options.events.events != events || options.events.policy != BlockEvents {
+		t.Errorf("events not correctly applied, got %v", options.events)
+	}
+}
+
+// Tests that the MapRequiredScopes option correctly applies.
+func Test_MapOption_RequiredScopes(t *testing.T) {
+	// given
+	option := MapRequiredScopes("read", "write")
+	options := &mapConfig{requiredScopes: []string{"admin"}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.requiredScopes) != 2 || options.requiredScopes[0] != "read" || options.requiredScopes[1] != "write" {
+		t.Errorf("required scopes not correctly applied, got %s", options.requiredScopes)
+	}
+}
+
+// Tests that the MapClock option correctly applies.
+func Test_MapOption_Clock(t *testing.T) {
+	// given
+	fixed := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	option := MapClock(func() time.Time { return fixed })
+	options := &mapConfig{now: time.Now}
+
+	// when
+	option(options)
+
+	// then
+	if now := options.now(); !now.Equal(fixed) {
+		t.Errorf("clock not correctly applied, got %s", now)
+	}
+}
+
+// Tests that the MapObserver option correctly applies.
+func Test_MapOption_Observer(t *testing.T) {
+	// given
+	first := &recordingObserver{}
+	second := &recordingObserver{}
+	options := &mapConfig{}
+
+	// when
+	MapObserver(first)(options)
+	MapObserver(second)(options)
+
+	// then
+	if len(options.observers) != 2 || options.observers[0] != first || options.observers[1] != second {
+		t.Errorf("observers not correctly applied, got %v", options.observers)
+	}
+}
+
+// Tests that the MapCorrelationID option correctly applies.
+func Test_MapOption_CorrelationID(t *testing.T) {
+	// given
+	option := MapCorrelationID(func(ctx context.Context) string {
+		return "some-id"
+	})
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if id := options.correlationIDFunc(context.Background()); id != "some-id" {
+		t.Errorf("correlation ID not correctly applied, got %s", id)
+	}
+}
+
+// Tests that the MapSecondary option correctly applies.
+func Test_MapOption_Secondary(t *testing.T) {
+	// given
+	secondary := NewCacheMap()
+	option := MapSecondary(secondary)
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if options.secondary != secondary {
+		t.Errorf("secondary not correctly applied, got %v", options.secondary)
+	}
+}
+
+// Tests that the MapMaxConcurrentRefreshes option correctly applies.
+func Test_MapOption_MaxConcurrentRefreshes(t *testing.T) {
+	// given
+	option := MapMaxConcurrentRefreshes(5)
+	options := &mapConfig{maxRefreshes: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxRefreshes != 5 {
+		t.Errorf("max concurrent refreshes not correctly applied, got %d", options.maxRefreshes)
+	}
+}
+
+// Tests that the MapAllowedKeyIDs option correctly applies.
+func Test_MapOption_AllowedKeyIDs(t *testing.T) {
+	// given
+	option := MapAllowedKeyIDs("key-1", "key-2")
+	options := &mapConfig{allowedKeyIDs: []string{"key-3"}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedKeyIDs) != 2 || options.allowedKeyIDs[0] != "key-1" || options.allowedKeyIDs[1] != "key-2" {
+		t.Errorf("allowed key IDs not correctly applied, got %s", options.allowedKeyIDs)
+	}
+}
+
+// Tests that the MapScopeClaim option correctly applies.
+func Test_MapOption_ScopeClaim(t *testing.T) {
+	// given
+	option := MapScopeClaim("scp")
+	options := &mapConfig{scopeClaim: "scope"}
+
+	// when
+	option(options)
+
+	// then
+	if options.scopeClaim != "scp" {
+		t.Errorf("scope claim not correctly applied, got %s", options.scopeClaim)
+	}
+}
+
+// Tests that the MapNonceTracking option correctly applies.
+func Test_MapOption_NonceTracking(t *testing.T) {
+	// given
+	option := MapNonceTracking(NonceReject)
+	options := &mapConfig{noncePolicy: NonceIgnore}
+
+	// when
+	option(options)
+
+	// then
+	if options.noncePolicy != NonceReject {
+		t.Errorf("nonce policy not correctly applied, got %d", options.noncePolicy)
+	}
+}
+
+// Tests that the MapShouldCache option correctly applies.
+func Test_MapOption_ShouldCache(t *testing.T) {
+	// given
+	called := false
+	option := MapShouldCache(func(token jwt.Token) bool {
+		called = true
+		return false
+	})
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if options.shouldCache == nil {
+		t.Fatal("should cache predicate not correctly applied")
+	}
+
+	if options.shouldCache(jwt.New()) || !called {
+		t.Error("should cache predicate not correctly applied")
+	}
+}
+
+// Tests that the MapMaxTokenAge option correctly applies.
+func Test_MapOption_MaxTokenAge(t *testing.T) {
+	// given
+	option := MapMaxTokenAge(time.Hour)
+	options := &mapConfig{maxTokenAge: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxTokenAge != time.Hour {
+		t.Errorf("max token age not correctly applied, got %s", options.maxTokenAge)
+	}
+}
+
+// Tests that the MapClaimValidators option correctly applies,
+// and appends to previously registered validators.
+func Test_MapOption_ClaimValidators(t *testing.T) {
+	// given
+	first := func(token jwt.Token) error { return errors.New("first") }
+	second := func(token jwt.Token) error { return errors.New("second") }
+	option := MapClaimValidators(second)
+	options := &mapConfig{claimValidators: []ClaimValidator{first}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.claimValidators) != 2 ||
+		options.claimValidators[0](nil).Error() != "first" ||
+		options.claimValidators[1](nil).Error() != "second" {
+		t.Error("claim validators not correctly applied")
+	}
+}
+
+// Tests that the MapAggregateValidationErrors option correctly applies.
+func Test_MapOption_AggregateValidationErrors(t *testing.T) {
+	// given
+	option := MapAggregateValidationErrors(true)
+	options := &mapConfig{aggregateValidation: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.aggregateValidation {
+		t.Error("aggregate validation flag not correctly applied")
+	}
+}
+
+// Tests that the MapNormalizeClaimKeys option correctly applies.
+func Test_MapOption_NormalizeClaimKeys(t *testing.T) {
+	// given
+	option := MapNormalizeClaimKeys(true)
+	options := &mapConfig{normalizeClaimKeys: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.normalizeClaimKeys {
+		t.Error("normalize claim keys flag not correctly applied")
+	}
+}
+
+// Tests that the MapAllowedAlgorithms option correctly applies.
+func Test_MapOption_AllowedAlgorithms(t *testing.T) {
+	// given
+	option := MapAllowedAlgorithms(jwa.RS256, jwa.ES256)
+	options := &mapConfig{allowedAlgorithms: []jwa.SignatureAlgorithm{jwa.HS256}}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedAlgorithms) != 2 || options.allowedAlgorithms[0] != jwa.RS256 || options.allowedAlgorithms[1] != jwa.ES256 {
+		t.Errorf("allowed algorithms not correctly applied, got %s", options.allowedAlgorithms)
+	}
+}
+
+// Tests that the MapVerifyWithKeyLookup option correctly applies.
+func Test_MapOption_VerifyWithKeyLookup(t *testing.T) {
+	// given
+	called := false
+	option := MapVerifyWithKeyLookup(func(alg jwa.SignatureAlgorithm, kid string) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	options := &mapConfig{keyLookup: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.keyLookup == nil {
+		t.Fatal("key lookup not correctly applied")
+	}
+
+	if _, _ = options.keyLookup(jwa.HS256, ""); !called {
+		t.Error("key lookup not correctly applied")
+	}
+}
+
+// Tests that the MapWarmup option correctly applies.
+func Test_MapOption_Warmup(t *testing.T) {
+	// given
+	option := MapWarmup(func(ctx context.Context, key string) (string, error) {
+		return "warmup", nil
+	})
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if options.warmupFunc == nil {
+		t.Fatal("warmup function not correctly applied")
+	}
+
+	if token, _ := options.warmupFunc(context.Background(), "key"); token != "warmup" {
+		t.Error("warmup function not correctly applied")
+	}
+}
+
+// Tests that the MapLogFingerprint option correctly applies.
+func Test_MapOption_LogFingerprint(t *testing.T) {
+	// given
+	option := MapLogFingerprint(true)
+	options := &mapConfig{logFingerprint: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.logFingerprint {
+		t.Error("log fingerprint flag not correctly applied")
+	}
+}
+
+// Tests that the MapRefreshAtLifetimeFraction option correctly applies.
+func Test_MapOption_RefreshAtLifetimeFraction(t *testing.T) {
+	// given
+	option := MapRefreshAtLifetimeFraction(0.75)
+	options := &mapConfig{lifetimeFraction: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.lifetimeFraction != 0.75 {
+		t.Errorf("lifetime fraction not correctly applied, got %f", options.lifetimeFraction)
+	}
+}
+
+// Tests that the MapTreatNoExpAsValid option correctly applies.
+func Test_MapOption_TreatNoExpAsValid(t *testing.T) {
+	// given
+	option := MapTreatNoExpAsValid(true)
+	options := &mapConfig{treatNoExpAsValid: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.treatNoExpAsValid {
+		t.Error("treat no exp as valid flag not correctly applied")
+	}
+}
+
+// Tests that the MapRevalidateOnEveryAccess option correctly applies.
+func Test_MapOption_RevalidateOnEveryAccess(t *testing.T) {
+	// given
+	option := MapRevalidateOnEveryAccess(true)
+	options := &mapConfig{revalidateOnAccess: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.revalidateOnAccess {
+		t.Error("revalidate on every access flag not correctly applied")
+	}
+}
+
+// Tests that the MapExpectedSubject option correctly applies.
+func Test_MapOption_ExpectedSubject(t *testing.T) {
+	// given
+	option := MapExpectedSubject("billing-service")
+	options := &mapConfig{expectedSubject: ""}
+
+	// when
+	option(options)
+
+	// then
+	if options.expectedSubject != "billing-service" {
+		t.Errorf("expected subject not correctly applied, got %s", options.expectedSubject)
+	}
+}
+
+// Tests that the MapMinRemainingToServe option correctly applies.
+func Test_MapOption_MinRemainingToServe(t *testing.T) {
+	// given
+	option := MapMinRemainingToServe(time.Minute)
+	options := &mapConfig{minRemaining: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.minRemaining != time.Minute {
+		t.Errorf("min remaining not correctly applied, got %s", options.minRemaining)
+	}
+}
+
+// Tests that the MapStrictExpiry option correctly applies.
+func Test_MapOption_StrictExpiry(t *testing.T) {
+	// given
+	option := MapStrictExpiry(true, time.Hour)
+	options := &mapConfig{strictExpiry: false, maxTTL: 0}
+
+	// when
+	option(options)
+
+	// then
+	if !options.strictExpiry || options.maxTTL != time.Hour {
+		t.Errorf("strict expiry not correctly applied, got %t and %s", options.strictExpiry, options.maxTTL)
+	}
+}
+
+// Tests that the MapKeySet option correctly applies.
+func Test_MapOption_KeySet(t *testing.T) {
+	// given
+	set := jwk.NewSet()
+	option := MapKeySet(func() (jwk.Set, error) {
+		return set, nil
+	})
+	options := &mapConfig{}
+
+	// when
+	option(options)
+
+	// then
+	if options.keySetLoader == nil {
+		t.Fatal("key set loader not correctly applied")
+	}
+
+	if loaded, _ := options.keySetLoader(); loaded != set {
+		t.Error("key set loader not correctly applied")
+	}
+}
+
+// Tests that the MapNotBeforeIssuedAt option correctly applies.
+func Test_MapOption_NotBeforeIssuedAt(t *testing.T) {
+	// given
+	cutoff := time.Now()
+	option := MapNotBeforeIssuedAt(cutoff)
+	options := &mapConfig{issuedAfter: time.Time{}}
+
+	// when
+	option(options)
+
+	// then
+	if !options.issuedAfter.Equal(cutoff) {
+		t.Error("issuance cutoff not correctly applied")
+	}
+}
+
+// Tests that the MapLogDurationRounding option correctly applies.
+func Test_MapOption_LogDurationRounding(t *testing.T) {
+	// given
+	option := MapLogDurationRounding(time.Second)
+	options := &mapConfig{logRounding: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.logRounding != time.Second {
+		t.Error("log duration rounding not correctly applied")
+	}
+}
+
+// Tests that the MapLogClaims option correctly applies.
+func Test_MapOption_LogClaims(t *testing.T) {
+	// given
+	option := MapLogClaims("sub", "scope")
+	options := &mapConfig{logClaims: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.logClaims) != 2 || options.logClaims[0] != "sub" || options.logClaims[1] != "scope" {
+		t.Errorf("log claims not correctly applied, got %s", options.logClaims)
+	}
+}
+
+// Tests that the MapRetainClaims option correctly applies.
+func Test_MapOption_RetainClaims(t *testing.T) {
+	// given
+	option := MapRetainClaims(false)
+	options := &mapConfig{retainClaims: true}
+
+	// when
+	option(options)
+
+	// then
+	if options.retainClaims {
+		t.Error("retain claims flag not correctly applied")
+	}
+}
+
+// Tests that the MapRecordLockStats option correctly applies.
+func Test_MapOption_RecordLockStats(t *testing.T) {
+	// given
+	option := MapRecordLockStats(true)
+	options := &mapConfig{recordLockStats: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.recordLockStats {
+		t.Error("record lock stats flag not correctly applied")
+	}
+}
+
+// Tests that the MapVerifier option correctly applies.
+func Test_MapOption_Verifier(t *testing.T) {
+	// given
+	verifier := &fakeVerifier{}
+	option := MapVerifier(verifier)
+	options := &mapConfig{verifier: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.verifier != verifier {
+		t.Error("verifier not correctly applied")
+	}
+}
+
+// Tests that the MapValidityRewriter option correctly applies.
+func Test_MapOption_ValidityRewriter(t *testing.T) {
+	// given
+	fixed := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	option := MapValidityRewriter(func(computed time.Time, token jwt.Token) time.Time { return fixed })
+	options := &mapConfig{validityRewriter: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.validityRewriter == nil || !options.validityRewriter(time.Now(), nil).Equal(fixed) {
+		t.Error("validity rewriter not correctly applied")
+	}
+}
+
+// Tests that the MapAllowedIssuers option correctly applies.
+func Test_MapOption_AllowedIssuers(t *testing.T) {
+	// given
+	option := MapAllowedIssuers("issuer-a", "issuer-b")
+	options := &mapConfig{allowedIssuers: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.allowedIssuers) != 2 || options.allowedIssuers[0] != "issuer-a" || options.allowedIssuers[1] != "issuer-b" {
+		t.Errorf("allowed issuers not correctly applied, got %s", options.allowedIssuers)
+	}
+}
+
+// Tests that the MapServeWithinRealExpiryOnError option correctly applies.
+func Test_MapOption_ServeWithinRealExpiryOnError(t *testing.T) {
+	// given
+	option := MapServeWithinRealExpiryOnError(true)
+	options := &mapConfig{serveUnexpiredOnError: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.serveUnexpiredOnError {
+		t.Error("serve within real expiry flag not correctly applied")
+	}
+}
+
+// Tests that the MapMaxHeaderBytes option correctly applies.
+func Test_MapOption_MaxHeaderBytes(t *testing.T) {
+	// given
+	option := MapMaxHeaderBytes(1024)
+	options := &mapConfig{maxHeaderBytes: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxHeaderBytes != 1024 {
+		t.Error("max header bytes not correctly applied")
+	}
+}
+
+// Tests that the MapMaxPayloadBytes option correctly applies.
+func Test_MapOption_MaxPayloadBytes(t *testing.T) {
+	// given
+	option := MapMaxPayloadBytes(1024)
+	options := &mapConfig{maxPayloadBytes: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.maxPayloadBytes != 1024 {
+		t.Error("max payload bytes not correctly applied")
+	}
+}
+
+// Tests that the MapRefreshKeysOnVerificationFailure option correctly applies.
+func Test_MapOption_RefreshKeysOnVerificationFailure(t *testing.T) {
+	// given
+	option := MapRefreshKeysOnVerificationFailure(true)
+	options := &mapConfig{refreshKeysOnFailure: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.refreshKeysOnFailure {
+		t.Error("refresh keys on verification failure flag not correctly applied")
+	}
+}
+
+// Tests that the MapRecorder option correctly applies.
+func Test_MapOption_Recorder(t *testing.T) {
+	// given
+	recorder := &fakeRecorder{}
+	option := MapRecorder(recorder)
+	options := &mapConfig{recorder: NoopRecorder{}}
+
+	// when
+	option(options)
+
+	// then
+	if options.recorder != recorder {
+		t.Error("recorder not correctly applied")
+	}
+}
+
+// Tests that the MapExpectedAudience option correctly applies.
+func Test_MapOption_ExpectedAudience(t *testing.T) {
+	// given
+	option := MapExpectedAudience("api-a", "api-b")
+	options := &mapConfig{expectedAudiences: nil}
+
+	// when
+	option(options)
+
+	// then
+	if len(options.expectedAudiences) != 2 || options.expectedAudiences[0] != "api-a" || options.expectedAudiences[1] != "api-b" {
+		t.Errorf("expected audiences not correctly applied, got %s", options.expectedAudiences)
+	}
+}
+
+// Tests that the MapRequireAllAudiences option correctly applies.
+func Test_MapOption_RequireAllAudiences(t *testing.T) {
+	// given
+	option := MapRequireAllAudiences(true)
+	options := &mapConfig{requireAllAudiences: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.requireAllAudiences {
+		t.Error("require all audiences flag not correctly applied")
+	}
+}
+
+// Tests that the MapKeyAsAudience option correctly applies.
+func Test_MapOption_KeyAsAudience(t *testing.T) {
+	// given
+	option := MapKeyAsAudience(true)
+	options := &mapConfig{keyAsAudience: false}
+
+	// when
+	option(options)
+
+	// then
+	if !options.keyAsAudience {
+		t.Error("key as audience flag not correctly applied")
+	}
+}
+
+// Tests that the MapAcceptFunc option correctly applies.
+func Test_MapOption_AcceptFunc(t *testing.T) {
+	// given
+	option := MapAcceptFunc(func(token jwt.Token) (bool, error) { return false, nil })
+	options := &mapConfig{acceptFunc: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.acceptFunc == nil {
+		t.Fatal("accept func not correctly applied")
+	}
+
+	if accepted, _ := options.acceptFunc(nil); accepted {
+		t.Error("accept func not correctly applied")
+	}
+}
+
+// Tests that the MapClockJumpThreshold option correctly applies.
+func Test_MapOption_ClockJumpThreshold(t *testing.T) {
+	// given
+	option := MapClockJumpThreshold(time.Minute)
+	options := &mapConfig{clockJumpThreshold: 0}
+
+	// when
+	option(options)
+
+	// then
+	if options.clockJumpThreshold != time.Minute {
+		t.Errorf("clock jump threshold not correctly applied, got %s", options.clockJumpThreshold)
+	}
+}
+
+// Tests that the MapSharedKeySet option correctly applies.
+func Test_MapOption_SharedKeySet(t *testing.T) {
+	// given
+	keys := NewSharedKeys(func() (jwk.Set, error) { return jwk.NewSet(), nil })
+	option := MapSharedKeySet(keys)
+	options := &mapConfig{sharedKeys: nil}
+
+	// when
+	option(options)
+
+	// then
+	if options.sharedKeys != keys {
+		t.Error("shared key set not correctly applied")
+	}
+}
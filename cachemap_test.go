@@ -12,6 +12,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -85,6 +87,21 @@ func Test_CacheMap_Defaults(t *testing.T) {
 	if cache.rejectUnparsable {
 		t.Error("default reject unparsable flag not correctly applied")
 	}
+
+	if len(cache.observers) != 0 {
+		t.Error("default observer not correctly applied")
+	}
+
+	if cache.scopeClaim != "scope" {
+		t.Error("default scope claim not correctly applied")
+	}
+
+	if !cache.retainClaims {
+		t.Error("default retain claims flag not correctly applied")
+	}
+	if _, ok := cache.recorder.(NoopRecorder); !ok {
+		t.Error("default recorder not correctly applied")
+	}
 }
 
 // Tests that EnsureToken returns the exact error, if any occurred
@@ -358,3 +375,610 @@ func Test_MapCache_EnsureToken_Signed_JWT(t *testing.T) {
 		t.Error("expected token, but got none")
 	}
 }
+
+// Tests that AuthorizationHeader correctly prefixes the token
+// with "Bearer ".
+func Test_CacheMap_AuthorizationHeader(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (s string, e error) {
+			return "token-for-" + key, nil
+		}),
+	)
+
+	// when
+	header, err := cache.AuthorizationHeader(context.Background(), "some-key")
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if expected := "Bearer token-for-some-key"; header != expected {
+		t.Errorf("expected header %q, but got %q", expected, header)
+	}
+}
+
+// Tests that ForceRefresh fetches a new token for the given key
+// only, even if the cached token is still valid.
+func Test_CacheMap_ForceRefresh(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+	)
+
+	// when
+	firstToken, firstErr := cache.EnsureToken(context.Background(), "some-key")
+	otherToken, otherErr := cache.EnsureToken(context.Background(), "another-key")
+	secondToken, secondErr := cache.ForceRefresh(context.Background(), "some-key")
+	otherCachedToken, otherCachedErr := cache.EnsureToken(context.Background(), "another-key")
+
+	// then
+	for _, err := range []error{firstErr, otherErr, secondErr, otherCachedErr} {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	if firstToken == secondToken {
+		t.Errorf(`"some-key" token was not refreshed`)
+	}
+
+	if otherToken != otherCachedToken {
+		t.Errorf(`"another-key" token was refreshed, but was not supposed to`)
+	}
+}
+
+// Tests that RefreshAll refreshes all known keys, and reports
+// the errors of the keys which failed to refresh.
+func Test_CacheMap_RefreshAll(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	expectedErr := errors.New("expected error")
+	tokenFunc := getMapTokenFunction()
+
+	failing := int32(0)
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			if key == "failing-key" && atomic.LoadInt32(&failing) == 1 {
+				return "", expectedErr
+			}
+			return tokenFunc(ctx, key)
+		}),
+	)
+
+	keys := []string{"first-key", "second-key", "third-key", "failing-key"}
+	tokens := map[string]string{}
+	for _, key := range keys {
+		token, err := cache.EnsureToken(context.Background(), key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tokens[key] = token
+	}
+
+	atomic.StoreInt32(&failing, 1)
+
+	// when
+	err := cache.RefreshAll(context.Background())
+
+	// then
+	var refreshErrs RefreshErrors
+	if !errors.As(err, &refreshErrs) {
+		t.Fatalf("expected refresh errors, but got: %v", err)
+	}
+
+	if len(refreshErrs) != 1 || refreshErrs["failing-key"] != expectedErr {
+		t.Errorf("expected error for failing key only, but got: %s", refreshErrs)
+	}
+
+	for _, key := range keys {
+		token, err := cache.EnsureToken(context.Background(), key)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		if key == "failing-key" {
+			if token != tokens[key] {
+				t.Errorf("%q token was replaced, despite the refresh failing", key)
+			}
+		} else if token == tokens[key] {
+			t.Errorf("%q token was not refreshed", key)
+		}
+	}
+}
+
+// Tests that RefreshAll returns no error, if all refreshes succeed.
+func Test_CacheMap_RefreshAll_Success(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+	)
+
+	if _, err := cache.EnsureToken(context.Background(), "some-key"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	err := cache.RefreshAll(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Tests that RefreshErrors are rendered ordered by key.
+func Test_RefreshErrors_Error(t *testing.T) {
+	// given
+	errs := RefreshErrors{
+		"b": errors.New("second"),
+		"a": errors.New("first"),
+	}
+
+	// when
+	message := errs.Error()
+
+	// then
+	if expected := "failed to refresh 2 keys: a: first; b: second"; message != expected {
+		t.Errorf("expected %q, but got %q", expected, message)
+	}
+}
+
+// Tests that EnsureToken falls back to the secondary mapped cache
+// for the same key, if the primary token function fails.
+func Test_CacheMap_EnsureToken_Secondary(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	secondary := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return "secondary-token-for-" + key, nil
+		}),
+	)
+
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return "", errors.New("primary outage")
+		}),
+		MapSecondary(secondary),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background(), "some-key")
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if expected := "secondary-token-for-some-key"; token != expected {
+		t.Errorf("expected token %q, but got %q", expected, token)
+	}
+}
+
+// Tests that concurrent callers for the same key share a single token
+// function invocation, while distinct keys are fetched in parallel.
+func Test_CacheMap_EnsureToken_PerKeyDeduplication(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	tokenFunc := getMapTokenFunction()
+	callsLock := &sync.Mutex{}
+	calls := map[string]int{}
+
+	bothStarted := &sync.WaitGroup{}
+	bothStarted.Add(2)
+	parallel := make(chan struct{})
+	go func() {
+		bothStarted.Wait()
+		close(parallel)
+	}()
+
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			callsLock.Lock()
+			calls[key]++
+			callsLock.Unlock()
+
+			// Only returns, once the other key is fetched concurrently
+			bothStarted.Done()
+			select {
+			case <-parallel:
+				return tokenFunc(ctx, key)
+			case <-time.After(time.Second):
+				return "", errors.New("keys were not fetched in parallel")
+			}
+		}),
+	)
+
+	// when
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i%2)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.EnsureToken(context.Background(), key); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// then
+	for _, key := range []string{"key-0", "key-1"} {
+		if calls[key] != 1 {
+			t.Errorf("expected one token function invocation for %s, but got %d", key, calls[key])
+		}
+	}
+}
+
+// Tests that MapMaxConcurrentRefreshes bounds the number of token
+// function invocations running at once across all keys.
+func Test_CacheMap_EnsureToken_MaxConcurrentRefreshes(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	tokenFunc := getMapTokenFunction()
+	inFlight := int32(0)
+	maxInFlight := int32(0)
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			current := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			return tokenFunc(ctx, key)
+		}),
+		MapMaxConcurrentRefreshes(2),
+	)
+
+	// when
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.EnsureToken(context.Background(), key); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// then
+	if max := atomic.LoadInt32(&maxInFlight); max != 2 {
+		t.Errorf("expected at most 2 concurrent refreshes, but got %d", max)
+	}
+}
+
+// Tests that waiting for a free refresh slot respects the context.
+func Test_CacheMap_EnsureToken_MaxConcurrentRefreshes_ContextDone(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	release := make(chan struct{})
+	started := make(chan struct{})
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			if key == "blocking-key" {
+				close(started)
+				<-release
+			}
+			return "token-for-" + key, nil
+		}),
+		MapMaxConcurrentRefreshes(1),
+	)
+
+	go func() {
+		_, _ = cache.EnsureToken(context.Background(), "blocking-key")
+	}()
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// when
+	token, err := cache.EnsureToken(ctx, "waiting-key")
+
+	// then
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, but got: %v", err)
+	}
+
+	if token != "" {
+		t.Errorf("expected empty token, but received: %s", token)
+	}
+}
+
+// Tests that PendingRefreshes reports the callers waiting for a free
+// refresh slot.
+func Test_CacheMap_PendingRefreshes(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	release := make(chan struct{})
+	started := make(chan struct{})
+	cache := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			if key == "blocking-key" {
+				close(started)
+				<-release
+			}
+			return "token-for-" + key, nil
+		}),
+		MapMaxConcurrentRefreshes(1),
+	)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = cache.EnsureToken(context.Background(), "blocking-key")
+	}()
+	<-started
+
+	// when
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("waiting-key-%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = cache.EnsureToken(context.Background(), key)
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for cache.PendingRefreshes() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	pending := cache.PendingRefreshes()
+
+	close(release)
+	wg.Wait()
+
+	// then
+	if pending != 3 {
+		t.Errorf("expected 3 pending refreshes, but got %d", pending)
+	}
+
+	if pending := cache.PendingRefreshes(); pending != 0 {
+		t.Errorf("expected no pending refreshes, but got %d", pending)
+	}
+}
+
+// Tests that PendingRefreshes is always zero, if refreshes are unbounded.
+func Test_CacheMap_PendingRefreshes_Unbounded(t *testing.T) {
+	// given
+	cache := NewCacheMap()
+
+	// when
+	pending := cache.PendingRefreshes()
+
+	// then
+	if pending != 0 {
+		t.Errorf("expected no pending refreshes, but got %d", pending)
+	}
+}
+
+// Tests that Invalidate drops the cached token of the given key only,
+// and ignores unknown keys.
+func Test_CacheMap_Invalidate(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+	)
+
+	firstToken, _ := cacheMap.EnsureToken(context.Background(), "invalidated")
+	otherToken, _ := cacheMap.EnsureToken(context.Background(), "kept")
+
+	// when
+	cacheMap.Invalidate("invalidated")
+	cacheMap.Invalidate("unknown")
+
+	secondToken, _ := cacheMap.EnsureToken(context.Background(), "invalidated")
+	secondOtherToken, _ := cacheMap.EnsureToken(context.Background(), "kept")
+
+	// then
+	if firstToken == secondToken {
+		t.Error("expected new token after invalidation")
+	}
+
+	if otherToken != secondOtherToken {
+		t.Error("expected token of other key to be kept")
+	}
+
+	cacheMap.lock.RLock()
+	_, created := cacheMap.jwtMap["unknown"]
+	cacheMap.lock.RUnlock()
+
+	if created {
+		t.Error("expected no cache to be created for unknown key")
+	}
+}
+
+// Tests that the MapWarmup function runs once per key, with the key.
+func Test_CacheMap_EnsureToken_Warmup(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	warmups := map[string]int{}
+	warmupFunc := getMapTokenFunction()
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapWarmup(func(ctx context.Context, key string) (string, error) {
+			warmups[key]++
+			return warmupFunc(ctx, key)
+		}),
+		MapTokenFunction(getMapTokenFunction()),
+	)
+
+	// when
+	for _, key := range []string{"a", "b", "a", "b"} {
+		if _, err := cacheMap.EnsureToken(context.Background(), key); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if len(warmups) != 2 || warmups["a"] != 1 || warmups["b"] != 1 {
+		t.Errorf("expected warmup to run once per key, but got %v", warmups)
+	}
+}
+
+// Tests that EnsureTokenMatching is delegated to the cache of the key.
+func Test_CacheMap_EnsureTokenMatching(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+				"scope":           key,
+			})
+		}),
+	)
+
+	// when
+	token, err := cacheMap.EnsureTokenMatching(context.Background(), "read", hasScope("read"))
+	_, mismatchErr := cacheMap.EnsureTokenMatching(context.Background(), "write", hasScope("read"))
+
+	// then
+	if err != nil || token == "" {
+		t.Errorf("expected token, but got error: %v", err)
+	}
+
+	if mismatchErr != ErrNoMatchingToken {
+		t.Errorf("expected ErrNoMatchingToken, but got: %v", mismatchErr)
+	}
+}
+
+// Tests that SetHeadroom applies to existing as well as new keys.
+func Test_CacheMap_SetHeadroom(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	exp := time.Now().Truncate(time.Second).Add(time.Hour)
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: exp.UTC(),
+			})
+		}),
+	)
+
+	if _, err := cacheMap.EnsureToken(context.Background(), "existing"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	cacheMap.SetHeadroom(10 * time.Minute)
+
+	if _, err := cacheMap.EnsureToken(context.Background(), "new"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	expected := exp.Add(-10 * time.Minute)
+	for _, key := range []string{"existing", "new"} {
+		if validity := cacheMap.jwtMap[key].validity; !validity.Equal(expected) {
+			t.Errorf("expected validity %s for %s, but got %s", expected, key, validity)
+		}
+	}
+}
+
+// Tests that MapKeyAsAudience provides distinct tokens when switching
+// audiences, and rejects tokens issued for another audience.
+func Test_CacheMap_EnsureToken_KeyAsAudience(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, audience string) (string, error) {
+			// The issuer confuses the billing audience
+			if audience == "https://billing.example.com" {
+				audience = "https://shipping.example.com"
+			}
+
+			return getJwt(map[string]interface{}{
+				jwt.AudienceKey:   audience,
+				jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+			})
+		}),
+		MapKeyAsAudience(true),
+	)
+
+	// when
+	ordersToken, ordersErr := cacheMap.EnsureToken(context.Background(), "https://orders.example.com")
+	shippingToken, shippingErr := cacheMap.EnsureToken(context.Background(), "https://shipping.example.com")
+	cachedToken, cachedErr := cacheMap.EnsureToken(context.Background(), "https://orders.example.com")
+	billingToken, billingErr := cacheMap.EnsureToken(context.Background(), "https://billing.example.com")
+
+	// then
+	if ordersErr != nil || shippingErr != nil || cachedErr != nil {
+		t.Fatalf("unexpected errors: %v, %v, %v", ordersErr, shippingErr, cachedErr)
+	}
+
+	if ordersToken == shippingToken {
+		t.Error("expected distinct tokens for distinct audiences")
+	}
+
+	if cachedToken != ordersToken {
+		t.Error("expected token to be cached per audience")
+	}
+
+	if !errors.Is(billingErr, ErrUnexpectedAudience) || billingToken != "" {
+		t.Errorf("expected token for another audience to be rejected, but got %q, %v", billingToken, billingErr)
+	}
+}
@@ -0,0 +1,62 @@
+package jwt
+
+// Claim returns the value of the given claim of the cached token, or
+// false if no token is cached or the claim is not set. Registered claims
+// are returned with the types of the jwx library (e.g. time.Time for exp).
+// Reference types (slices and maps) are copied, so the returned value can
+// be modified freely.
+func (jwtCache *Cache) Claim(name string) (interface{}, bool) {
+	jwtCache.lock.RLock()
+	parsed := jwtCache.parsed
+	jwtCache.lock.RUnlock()
+
+	if parsed == nil {
+		return nil, false
+	}
+
+	value, ok := parsed.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	return copyClaim(value), true
+}
+
+// Claim returns the value of the given claim of the token cached for the
+// given key, as Cache.Claim does. Unknown keys report no claim.
+func (cacheMap *CacheMap) Claim(key string, name string) (interface{}, bool) {
+	cacheMap.lock.RLock()
+	cache, exists := cacheMap.jwtMap[key]
+	cacheMap.lock.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+
+	return cache.Claim(name)
+}
+
+// copyClaim returns a deep copy of the given claim value, for the
+// reference types a decoded JSON payload can contain.
+func copyClaim(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			copied[key] = copyClaim(value)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, value := range v {
+			copied[i] = copyClaim(value)
+		}
+		return copied
+	case []string:
+		copied := make([]string, len(v))
+		copy(copied, v)
+		return copied
+	default:
+		return value
+	}
+}
@@ -0,0 +1,192 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Tests that Claim returns registered and custom claims of the
+// cached token by name.
+func Test_Cache_Claim(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: exp.UTC(),
+				jwt.SubjectKey:    "some-subject",
+				"tenant":          "some-tenant",
+				"roles":           []string{"admin", "user"},
+			})
+		}),
+	)
+
+	// when
+	_, beforeFetch := cache.Claim(jwt.SubjectKey)
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if beforeFetch {
+		t.Error("expected no claim without a cached token")
+	}
+
+	if sub, ok := cache.Claim(jwt.SubjectKey); !ok || sub != "some-subject" {
+		t.Errorf("expected subject %q, but got %v", "some-subject", sub)
+	}
+
+	if actualExp, ok := cache.Claim(jwt.ExpirationKey); !ok || !actualExp.(time.Time).Equal(exp) {
+		t.Errorf("expected expiration %s, but got %v", exp, actualExp)
+	}
+
+	if tenant, ok := cache.Claim("tenant"); !ok || tenant != "some-tenant" {
+		t.Errorf("expected tenant %q, but got %v", "some-tenant", tenant)
+	}
+
+	if _, ok := cache.Claim("missing"); ok {
+		t.Error("expected missing claim to be reported as such")
+	}
+}
+
+// Tests that no claims are retained, if RetainClaims is disabled,
+// Tests that the CacheMap Claim returns the claims of the token cached
+// for the given key, and reports no claims for unknown keys.
+func Test_CacheMap_Claim(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+				"tenant":          key,
+			})
+		}),
+	)
+
+	// when
+	if _, err := cacheMap.EnsureToken(context.Background(), "some-tenant"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if tenant, ok := cacheMap.Claim("some-tenant", "tenant"); !ok || tenant != "some-tenant" {
+		t.Errorf("expected tenant %q, but got %v", "some-tenant", tenant)
+	}
+
+	if _, ok := cacheMap.Claim("other-tenant", "tenant"); ok {
+		t.Error("expected no claim for an unknown key")
+	}
+
+	if _, exists := cacheMap.jwtMap["other-tenant"]; exists {
+		t.Error("expected no cache to be created for an unknown key")
+	}
+}
+
+// while the cache still works as usual.
+func Test_Cache_Claim_RetainClaimsDisabled(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.SubjectKey: "some-subject",
+		})),
+		RetainClaims(false),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+	cachedToken, cachedErr := cache.EnsureToken(context.Background())
+	snapshot, snapshotErr := cache.EnsureTokenSnapshot(context.Background())
+
+	// then
+	if err != nil || cachedErr != nil || snapshotErr != nil {
+		t.Fatalf("unexpected errors: %v, %v, %v", err, cachedErr, snapshotErr)
+	}
+
+	if cache.parsed != nil {
+		t.Error("expected parsed claims to be discarded")
+	}
+
+	if _, ok := cache.Claim(jwt.SubjectKey); ok {
+		t.Error("expected no claims, if claims are not retained")
+	}
+
+	if token != cachedToken || !snapshot.FromCache || cache.RefreshCount() != 1 {
+		t.Error("expected token to be cached")
+	}
+
+	if sub := snapshot.Claims[jwt.SubjectKey]; sub != "some-subject" {
+		t.Errorf("expected snapshot to parse cached token again, but got %v", snapshot.Claims)
+	}
+}
+
+// Tests that Claim returns copies of reference type claims.
+func Test_Cache_Claim_Copy(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			"roles":   []string{"admin", "user"},
+			"profile": map[string]interface{}{"name": "foo"},
+		})),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	roles, _ := cache.Claim("roles")
+	roles.([]interface{})[0] = "tampered"
+
+	profile, _ := cache.Claim("profile")
+	profile.(map[string]interface{})["name"] = "tampered"
+
+	// then
+	if roles, _ := cache.Claim("roles"); roles.([]interface{})[0] != "admin" {
+		t.Error("slice claim is not a copy")
+	}
+
+	if profile, _ := cache.Claim("profile"); profile.(map[string]interface{})["name"] != "foo" {
+		t.Error("map claim is not a copy")
+	}
+}
+
+// Tests that copyClaim copies string slices, and passes
+// through scalar values.
+func Test_copyClaim(t *testing.T) {
+	// given
+	original := []string{"a", "b"}
+
+	// when
+	copied := copyClaim(original).([]string)
+	copied[0] = "tampered"
+
+	// then
+	if original[0] != "a" {
+		t.Error("string slice is not a copy")
+	}
+
+	if copyClaim(42) != 42 {
+		t.Error("scalar value not passed through")
+	}
+}
@@ -0,0 +1,75 @@
+package jwt
+
+import (
+	"time"
+)
+
+// processStart is the reference for monotonic readings.
+var processStart = time.Now()
+
+// monotonic returns the monotonic time elapsed since the process started,
+// which is unaffected by jumps of the wall clock. It is replaced in tests,
+// to simulate clock jumps.
+func monotonic() time.Duration {
+	return time.Since(processStart)
+}
+
+// clockJump returns by how much more the wall clock advanced than the
+// monotonic clock, since the token was cached. The caller must hold the lock.
+func (jwtCache *Cache) clockJump(nowWall time.Time, nowMono time.Duration) time.Duration {
+	return nowWall.Sub(jwtCache.storedWall) - (nowMono - jwtCache.storedMono)
+}
+
+// detectClockJump re-evaluates the validity of the cached token, if the
+// wall clock jumped by more than the ClockJumpThreshold since the token was
+// cached. The validity is shortened to the monotonic time remaining, and
+// the token is dropped if it is now expired.
+func (jwtCache *Cache) detectClockJump() {
+	if jwtCache.clockJumpThreshold <= 0 {
+		return
+	}
+
+	jwtCache.lock.RLock()
+	jumped := jwtCache.jwt != "" && exceeds(jwtCache.clockJump(jwtCache.now().Round(0), jwtCache.monotonic()), jwtCache.clockJumpThreshold)
+	jwtCache.lock.RUnlock()
+
+	if !jumped {
+		return
+	}
+
+	jwtCache.lockState()
+
+	// Another caller might have handled the jump while we waited
+	nowWall, nowMono := jwtCache.now().Round(0), jwtCache.monotonic()
+	jump := jwtCache.clockJump(nowWall, nowMono)
+	if jwtCache.jwt == "" || !exceeds(jump, jwtCache.clockJumpThreshold) {
+		jwtCache.unlockState()
+		return
+	}
+
+	remaining := jwtCache.validity.Sub(jwtCache.storedWall) - (nowMono - jwtCache.storedMono)
+	if rebased := nowWall.Add(remaining); rebased.Before(jwtCache.validity) {
+		jwtCache.validity = rebased
+	}
+	jwtCache.storedWall, jwtCache.storedMono = nowWall, nowMono
+
+	expired := !jwtCache.validity.After(nowWall)
+	if expired {
+		jwtCache.logger.Infof("Detected clock jump of %s for %s, dropping cached token which is now expired", jump, jwtCache.name)
+		jwtCache.invalidateLocked()
+	} else {
+		jwtCache.logger.Infof("Detected clock jump of %s for %s, caching till %s", jump, jwtCache.name, jwtCache.validity)
+	}
+
+	jwtCache.unlockState()
+
+	if expired {
+		jwtCache.stopEagerRefresh()
+	}
+}
+
+// exceeds reports whether the absolute of the given duration is larger
+// than the threshold.
+func exceeds(d time.Duration, threshold time.Duration) bool {
+	return d > threshold || d < -threshold
+}
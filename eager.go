@@ -0,0 +1,106 @@
+package jwt
+
+import (
+	"context"
+	"time"
+)
+
+// newTimer calls f in its own goroutine after d, and returns the stop
+// function of the timer. It is replaced in tests, to control EagerRefresh
+// and WaitUntilExpiry.
+func newTimer(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// scheduleEagerRefresh replaces the eager refresh timer with one firing
+// the margin before the given validity. A zero validity (no token cached)
+// only stops the current timer.
+func (jwtCache *Cache) scheduleEagerRefresh(validity time.Time) {
+	if jwtCache.eagerRefreshMargin <= 0 {
+		return
+	}
+
+	jwtCache.eagerLock.Lock()
+	defer jwtCache.eagerLock.Unlock()
+
+	jwtCache.stopEagerRefreshLocked()
+
+	if validity.IsZero() || jwtCache.closeCtx.Err() != nil {
+		return
+	}
+
+	// Tokens with a validity shorter than the margin are not refreshed
+	// eagerly, as the timer would fire right away - over and over again
+	delay := validity.Add(-jwtCache.eagerRefreshMargin).Sub(jwtCache.now().Round(0))
+	if delay <= 0 {
+		jwtCache.logger.Debugf("Validity of %s ends within the eager refresh margin of %s, so not refreshing eagerly", jwtCache.name, jwtCache.eagerRefreshMargin)
+		return
+	}
+
+	generation := jwtCache.eagerGeneration
+	jwtCache.eagerStop = jwtCache.newTimer(delay, func() {
+		jwtCache.eagerRefresh(generation)
+	})
+}
+
+// stopEagerRefresh stops the eager refresh timer, if any.
+func (jwtCache *Cache) stopEagerRefresh() {
+	jwtCache.eagerLock.Lock()
+	defer jwtCache.eagerLock.Unlock()
+
+	jwtCache.stopEagerRefreshLocked()
+}
+
+// stopEagerRefreshLocked stops the eager refresh timer, if any. Timers
+// already fired are invalidated via the generation. The caller must hold
+// the eager lock.
+func (jwtCache *Cache) stopEagerRefreshLocked() {
+	if jwtCache.eagerStop != nil {
+		jwtCache.eagerStop()
+		jwtCache.eagerStop = nil
+	}
+
+	jwtCache.eagerGeneration++
+}
+
+// eagerRefresh refreshes the token, if the timer of the given generation
+// is still current, and the token is not pinned. Otherwise, the token was
+// refreshed in the meantime (which scheduled a new timer), the cache was
+// closed, or the token must not be replaced yet.
+//
+// The refresh is cancelled via Close, and bounded by the margin - by then,
+// the validity of the cached token ends, and callers refresh on access
+// anyway. Thus, a hanging token function never holds the refresh lock
+// indefinitely.
+func (jwtCache *Cache) eagerRefresh(generation uint64) {
+	ctx, cancel := context.WithTimeout(jwtCache.closeCtx, jwtCache.eagerRefreshMargin)
+	defer cancel()
+
+	if err := jwtCache.acquireRefresh(ctx); err != nil {
+		return
+	}
+	defer jwtCache.releaseRefresh()
+
+	jwtCache.eagerLock.Lock()
+	current := jwtCache.eagerGeneration == generation
+	jwtCache.eagerLock.Unlock()
+
+	if !current {
+		return
+	}
+
+	// A pinned token must not be replaced - it is refreshed on access,
+	// once the pin is released or passed
+	jwtCache.lock.RLock()
+	pinned := jwtCache.now().Round(0).Before(jwtCache.pinnedUntil)
+	jwtCache.lock.RUnlock()
+
+	if pinned {
+		jwtCache.logger.Debugf("Token of %s is pinned, so not refreshing eagerly", jwtCache.name)
+		return
+	}
+
+	if _, err := jwtCache.refresh(ctx, RefreshEager); err != nil {
+		jwtCache.logger.Infof("Eager refresh of %s failed, refreshing on next access: %s", jwtCache.name, err)
+	}
+}
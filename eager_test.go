@@ -0,0 +1,417 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTimer records all scheduled timers, for use with EagerRefresh and
+// WaitUntilExpiry. Timers never fire on their own, but are fired via fire.
+type fakeTimer struct {
+	lock      sync.Mutex
+	delays    []time.Duration
+	callbacks []func()
+	stopped   []bool
+}
+
+func (timer *fakeTimer) option() Option {
+	return func(c *config) {
+		c.newTimer = func(d time.Duration, f func()) func() bool {
+			timer.lock.Lock()
+			defer timer.lock.Unlock()
+
+			i := len(timer.delays)
+			timer.delays = append(timer.delays, d)
+			timer.callbacks = append(timer.callbacks, f)
+			timer.stopped = append(timer.stopped, false)
+
+			return func() bool {
+				timer.lock.Lock()
+				defer timer.lock.Unlock()
+
+				timer.stopped[i] = true
+				return true
+			}
+		}
+	}
+}
+
+func (timer *fakeTimer) fire(i int) {
+	timer.lock.Lock()
+	callback := timer.callbacks[i]
+	timer.lock.Unlock()
+
+	callback()
+}
+
+// waitForTimers waits till the given amount of timers was scheduled,
+// and returns their delays.
+func (timer *fakeTimer) waitForTimers(t *testing.T, count int) []time.Duration {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		timer.lock.Lock()
+		delays := append([]time.Duration(nil), timer.delays...)
+		timer.lock.Unlock()
+
+		if len(delays) >= count {
+			return delays
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d timers, but got %d", count, len(delays))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// getClockTokenFunction returns tokens issued now, and valid for the given
+// lifetime, as seen by the given clock.
+func getClockTokenFunction(clock *fakeClock, lifetime time.Duration, calls *int) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		*calls++
+
+		return getJwt(map[string]interface{}{
+			jwt.IssuedAtKey:   clock.Now().UTC(),
+			jwt.ExpirationKey: clock.Now().Add(lifetime).UTC(),
+		})
+	}
+}
+
+// Tests that EagerRefresh schedules a timer firing the margin before the
+// validity ends, which refreshes the token and reschedules itself.
+func Test_Cache_EagerRefresh(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	timer := &fakeTimer{}
+	calls := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getClockTokenFunction(clock, time.Hour, &calls)),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		EagerRefresh(5*time.Minute),
+		timer.option(),
+	)
+
+	first, err := cache.EnsureToken(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	expectedDelay := time.Hour - time.Minute - 5*time.Minute
+	if len(timer.delays) != 1 || timer.delays[0] != expectedDelay {
+		t.Fatalf("expected one timer firing after %s, but got %v", expectedDelay, timer.delays)
+	}
+
+	// when
+	clock.Add(expectedDelay)
+	timer.fire(0)
+
+	// then
+	if calls != 2 {
+		t.Errorf("expected token function to be called twice, but got %d calls", calls)
+	}
+
+	if reason, _ := cache.LastRefreshReason(); reason != RefreshEager {
+		t.Errorf("expected refresh reason %s, but got %s", RefreshEager, reason)
+	}
+
+	if len(timer.delays) != 2 || timer.delays[1] != expectedDelay {
+		t.Fatalf("expected timer to be rescheduled after %s, but got %v", expectedDelay, timer.delays)
+	}
+
+	second, err := cache.EnsureToken(context.Background())
+	if err != nil || second == first || calls != 2 {
+		t.Errorf("expected eagerly refreshed token to be served, but got %d calls and error %v", calls, err)
+	}
+}
+
+// Tests that a timer firing after the token was refreshed otherwise
+// does not refresh the token once more.
+func Test_Cache_EagerRefresh_Superseded(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	timer := &fakeTimer{}
+	calls := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getClockTokenFunction(clock, time.Hour, &calls)),
+		Clock(clock.Now),
+		EagerRefresh(5*time.Minute),
+		timer.option(),
+	)
+
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	timer.fire(0)
+
+	// then
+	if !timer.stopped[0] {
+		t.Error("expected superseded timer to be stopped")
+	}
+
+	if calls != 2 {
+		t.Errorf("expected superseded timer to not refresh, but got %d calls", calls)
+	}
+}
+
+// Tests that no timer is scheduled, if the validity ends within the margin,
+// and that Close stops the timer.
+func Test_Cache_EagerRefresh_Margin(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		lifetime time.Duration
+		timers   int
+	}{
+		"outside margin": {lifetime: time.Hour, timers: 1},
+		"within margin":  {lifetime: 5 * time.Minute, timers: 0},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+			timer := &fakeTimer{}
+			calls := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getClockTokenFunction(clock, test.lifetime, &calls)),
+				Clock(clock.Now),
+				EagerRefresh(5*time.Minute),
+				timer.option(),
+			)
+
+			// when
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			_ = cache.Close()
+
+			// then
+			if len(timer.delays) != test.timers {
+				t.Fatalf("expected %d timers, but got %v", test.timers, timer.delays)
+			}
+
+			for i, stopped := range timer.stopped {
+				if !stopped {
+					t.Errorf("expected timer %d to be stopped after Close", i)
+				}
+			}
+
+			if _, err := cache.ForceRefresh(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(timer.delays) != test.timers {
+				t.Errorf("expected no timer after Close, but got %v", timer.delays)
+			}
+		})
+	}
+}
+
+// Tests that no timer is scheduled by default.
+func Test_Cache_EagerRefresh_Disabled(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	timer := &fakeTimer{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		timer.option(),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if len(timer.delays) != 0 {
+		t.Errorf("expected no timer by default, but got %v", timer.delays)
+	}
+}
+
+// Tests that Close cancels an eager refresh in progress, which is bounded
+// by the margin, so that a hanging token function does not hold the
+// refresh lock indefinitely.
+func Test_Cache_EagerRefresh_Close(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	var calls int32
+	deadlines := make(chan time.Time, 1)
+	tokenFunc := getTokenFunction()
+
+	timer := &fakeTimer{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return tokenFunc(ctx)
+			}
+
+			deadline, _ := ctx.Deadline()
+			deadlines <- deadline
+
+			<-ctx.Done()
+			return "", ctx.Err()
+		}),
+		EagerRefresh(5*time.Minute),
+		timer.option(),
+	)
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timer.fire(0)
+	}()
+
+	// when
+	deadline := <-deadlines
+	_ = cache.Close()
+
+	// then
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected eager refresh to be cancelled via Close")
+	}
+
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > 5*time.Minute {
+		t.Errorf("expected eager refresh to be bounded by the margin, but got deadline in %s", remaining)
+	}
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Errorf("expected cache to stay usable, but got error: %s", err)
+	}
+}
+
+// Tests that SetHeadroom and SetTokenIfNewer reschedule the timer based on
+// the changed validity, and Invalidate stops the timer.
+func Test_Cache_EagerRefresh_ValidityChanges(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	timer := &fakeTimer{}
+	calls := 0
+	tokenFunc := getClockTokenFunction(clock, time.Hour, &calls)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(tokenFunc),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		EagerRefresh(5*time.Minute),
+		timer.option(),
+	)
+
+	// when
+	token, err := getClockTokenFunction(clock, 2*time.Hour, &calls)(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if adopted, err := cache.SetTokenIfNewer(token); err != nil || !adopted {
+		t.Fatalf("expected token to be adopted, but got error: %v", err)
+	}
+
+	// then
+	if len(timer.delays) != 1 || timer.delays[0] != 2*time.Hour-time.Minute-5*time.Minute {
+		t.Fatalf("expected adopted token to schedule the timer, but got %v", timer.delays)
+	}
+
+	// when
+	cache.SetHeadroom(10 * time.Minute)
+
+	// then
+	if len(timer.delays) != 2 || timer.delays[1] != 2*time.Hour-10*time.Minute-5*time.Minute || !timer.stopped[0] {
+		t.Fatalf("expected SetHeadroom to reschedule the timer, but got %v", timer.delays)
+	}
+
+	// when
+	cache.Invalidate()
+	timer.fire(1)
+
+	// then
+	if !timer.stopped[1] {
+		t.Error("expected Invalidate to stop the timer")
+	}
+
+	if calls != 1 {
+		t.Errorf("expected stopped timer to not refresh, but got %d refreshes", calls-1)
+	}
+}
+
+// Tests that EagerRefresh does not replace a pinned token.
+func Test_Cache_EagerRefresh_Pinned(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	timer := &fakeTimer{}
+	calls := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getClockTokenFunction(clock, time.Hour, &calls)),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		EagerRefresh(5*time.Minute),
+		timer.option(),
+	)
+
+	first, err := cache.EnsureToken(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	clock.Add(time.Hour - time.Minute - 5*time.Minute)
+	cache.Pin(10 * time.Minute)
+
+	// when
+	timer.fire(0)
+	second, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if calls != 1 || second != first {
+		t.Errorf("expected pinned token to be kept, but got %d calls", calls)
+	}
+}
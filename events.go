@@ -0,0 +1,98 @@
+package jwt
+
+import (
+	"context"
+)
+
+// EventType describes the kind of a cache lifecycle event.
+type EventType int
+
+const (
+	// EventHit is emitted when a cached token is returned.
+	EventHit EventType = iota
+
+	// EventMiss is emitted when no valid cached token exists, and
+	// the token function has to be called.
+	EventMiss
+
+	// EventRefresh is emitted when the token function successfully
+	// provided a new token.
+	EventRefresh
+
+	// EventError is emitted when a new token could not be provided,
+	// either due to the token function failing or the token being rejected.
+	EventError
+)
+
+// String returns a human readable representation of the event type.
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventRefresh:
+		return "refresh"
+	case EventError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a cache lifecycle event, as emitted to the channel
+// provided via the Events option.
+type Event struct {
+	// Type is the kind of the event.
+	Type EventType
+
+	// Name is the name of the cache emitting the event.
+	Name string
+
+	// CorrelationID is the correlation ID extracted from the context
+	// passed to EnsureToken, if the CorrelationID option is used.
+	CorrelationID string
+
+	// Err is the error which occurred, if Type is EventError.
+	Err error
+}
+
+// EventPolicy defines how events are handled, if the channel provided
+// via the Events option is full.
+type EventPolicy int
+
+const (
+	// DropEvents drops events which cannot be delivered immediately,
+	// so that a slow consumer never stalls EnsureToken.
+	DropEvents EventPolicy = iota
+
+	// BlockEvents blocks EnsureToken till the event is delivered, or
+	// the context passed to EnsureToken is done (in which case the
+	// event is dropped).
+	BlockEvents
+)
+
+// eventSink delivers events to a channel, according to its policy.
+type eventSink struct {
+	events chan<- Event
+	policy EventPolicy
+}
+
+func (sink eventSink) emit(ctx context.Context, event Event) {
+	if sink.events == nil {
+		return
+	}
+
+	if sink.policy == BlockEvents {
+		select {
+		case sink.events <- event:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	select {
+	case sink.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,262 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the event types render human readable.
+func Test_EventType_String(t *testing.T) {
+	tests := map[EventType]string{
+		EventHit:      "hit",
+		EventMiss:     "miss",
+		EventRefresh:  "refresh",
+		EventError:    "error",
+		EventType(42): "unknown",
+	}
+
+	for eventType, expected := range tests {
+		if actual := eventType.String(); actual != expected {
+			t.Errorf("expected %q, but got %q", expected, actual)
+		}
+	}
+}
+
+// Tests that EnsureToken emits miss, refresh and hit events
+// in the correct order.
+func Test_Cache_EnsureToken_Events(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	events := make(chan Event, 10)
+	cache := NewCache(
+		Name("events"),
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Events(events, DropEvents),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Errorf("error while first token function invocation: %s", err)
+	}
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Errorf("error while second token function invocation: %s", err)
+	}
+	close(events)
+
+	// then
+	expected := []EventType{EventMiss, EventRefresh, EventHit}
+
+	var actual []EventType
+	for event := range events {
+		if event.Name != "events" {
+			t.Errorf("expected event name %q, but got %q", "events", event.Name)
+		}
+		actual = append(actual, event.Type)
+	}
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected events %v, but got %v", expected, actual)
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("expected events %v, but got %v", expected, actual)
+			break
+		}
+	}
+}
+
+// Tests that EnsureToken emits an error event, carrying the error
+// returned by the token function.
+func Test_Cache_EnsureToken_Events_Error(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	expectedErr := errors.New("expected error")
+	events := make(chan Event, 10)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (s string, e error) {
+			return "", expectedErr
+		}),
+		Events(events, DropEvents),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != expectedErr {
+		t.Errorf("unexpected error while token function invocation: %s", err)
+	}
+	close(events)
+
+	// then
+	var last Event
+	for event := range events {
+		last = event
+	}
+
+	if last.Type != EventError || last.Err != expectedErr {
+		t.Errorf("expected error event with %q, but got %s event with %v", expectedErr, last.Type, last.Err)
+	}
+}
+
+// Tests that a full channel does not block EnsureToken,
+// if the DropEvents policy is used.
+func Test_Cache_EnsureToken_Events_Drop(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	events := make(chan Event)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Events(events, DropEvents),
+	)
+
+	// when
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+
+	// then
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("EnsureToken blocked on full event channel")
+	}
+}
+
+// Tests that a full channel blocks EnsureToken only till the
+// context is done, if the BlockEvents policy is used.
+func Test_Cache_EnsureToken_Events_Block(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	events := make(chan Event)
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Events(events, BlockEvents),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// when
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := cache.EnsureToken(ctx); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+
+	// then
+	select {
+	case event := <-events:
+		if event.Type != EventMiss {
+			t.Errorf("expected miss event, but got %s", event.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("EnsureToken blocked past context deadline")
+	}
+}
+
+// Tests that the keyed caches of a CacheMap emit their events
+// to the shared channel.
+func Test_CacheMap_EnsureToken_Events(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	events := make(chan Event, 10)
+	cache := NewCacheMap(
+		MapName("events"),
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+		MapEvents(events, DropEvents),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background(), "some-key"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	close(events)
+
+	// then
+	count := 0
+	for event := range events {
+		count++
+		if event.Name != "events for some-key" {
+			t.Errorf("expected event name %q, but got %q", "events for some-key", event.Name)
+		}
+	}
+
+	if count != 2 {
+		t.Errorf("expected 2 events, but got %d", count)
+	}
+}
+
+type correlationKey struct{}
+
+// Tests that the correlation ID extracted from the context is
+// included in emitted events and refresh log messages.
+func Test_Cache_EnsureToken_Events_CorrelationID(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.Level = logrus.DebugLevel
+
+	// given
+	events := make(chan Event, 10)
+	cache := NewCache(
+		Name("correlated"),
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Events(events, DropEvents),
+		CorrelationID(func(ctx context.Context) string {
+			id, _ := ctx.Value(correlationKey{}).(string)
+			return id
+		}),
+	)
+
+	ctx := context.WithValue(context.Background(), correlationKey{}, "request-42")
+
+	// when
+	if _, err := cache.EnsureToken(ctx); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	close(events)
+
+	// then
+	for event := range events {
+		if event.CorrelationID != "request-42" {
+			t.Errorf("expected correlation ID %q in %s event, but got %q", "request-42", event.Type, event.CorrelationID)
+		}
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || !strings.Contains(entry.Message, "correlation ID request-42") {
+		t.Errorf("expected correlation ID in refresh log, but got %v", entry)
+	}
+}
@@ -0,0 +1,46 @@
+package jwt
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// expvarStatus is the status of a cache, as published via expvar.
+type expvarStatus struct {
+	Name         string     `json:"name"`
+	Cached       bool       `json:"cached"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	RefreshCount uint64     `json:"refresh_count"`
+}
+
+// Var returns an expvar.Var reporting the status of the cache (name,
+// whether a token is cached, its expiration and the refresh count).
+// The status is evaluated each time the variable is read. The token
+// itself is never reported.
+func (jwtCache *Cache) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		status := expvarStatus{
+			Name:         jwtCache.name,
+			RefreshCount: atomic.LoadUint64(&jwtCache.refreshCount),
+		}
+
+		if _, cached := jwtCache.cachedState(); cached {
+			jwtCache.lock.RLock()
+			expiration := jwtCache.expiration
+			jwtCache.lock.RUnlock()
+
+			status.Cached = true
+			status.ExpiresAt = &expiration
+		}
+
+		return status
+	})
+}
+
+// PublishExpvar publishes the status of the cache as returned by Var
+// under the given name, so that it shows up on /debug/vars. As with
+// expvar.Publish, publishing the same name twice panics.
+func (jwtCache *Cache) PublishExpvar(name string) {
+	expvar.Publish(name, jwtCache.Var())
+}
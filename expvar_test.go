@@ -0,0 +1,79 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// expvarTestRuns makes the published names unique, as expvar panics on
+// publishing the same name twice (e.g. with go test -count=2).
+var expvarTestRuns uint64
+
+// uniqueExpvarName returns an expvar name not published before.
+func uniqueExpvarName(t *testing.T) string {
+	return fmt.Sprintf("jwtcache-%s-%d", t.Name(), atomic.AddUint64(&expvarTestRuns, 1))
+}
+
+// Tests that PublishExpvar publishes the status of the cache,
+// and that the status reflects the current state of the cache.
+func Test_Cache_PublishExpvar(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Name("expvar-test"),
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+	name := uniqueExpvarName(t)
+	cache.PublishExpvar(name)
+
+	read := func() map[string]interface{} {
+		published := expvar.Get(name)
+		if published == nil {
+			t.Fatal("expected published expvar, but got none")
+		}
+
+		var status map[string]interface{}
+		if err := json.Unmarshal([]byte(published.String()), &status); err != nil {
+			t.Fatalf("failed to decode expvar: %s", err)
+		}
+		return status
+	}
+
+	// when
+	initial := read()
+	_, _ = cache.EnsureToken(context.Background())
+	refreshed := read()
+
+	// then
+	if initial["name"] != "expvar-test" {
+		t.Errorf("expected name %q, but got %v", "expvar-test", initial["name"])
+	}
+
+	if initial["cached"] != false || initial["expires_at"] != nil || initial["refresh_count"] != 0.0 {
+		t.Errorf("unexpected initial status %v", initial)
+	}
+
+	if refreshed["cached"] != true || refreshed["refresh_count"] != 1.0 {
+		t.Errorf("unexpected status after refresh %v", refreshed)
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, refreshed["expires_at"].(string))
+	if err != nil {
+		t.Fatalf("failed to parse expires_at: %s", err)
+	}
+
+	if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("unexpected expires_at %s", expiresAt)
+	}
+}
@@ -0,0 +1,60 @@
+package jwt
+
+import (
+	"time"
+)
+
+// newTicker returns the channel and stop function of a new time.Ticker.
+// It is replaced in tests, to control the heartbeat.
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// Close stops the background heartbeat of the cache, if enabled via
+// HeartbeatInterval, and the timer of EagerRefresh - cancelling an eager
+// refresh in progress. The cache itself stays usable. Close is safe to be
+// called multiple times.
+func (jwtCache *Cache) Close() error {
+	jwtCache.closeOnce.Do(func() {
+		jwtCache.closeCancel()
+		jwtCache.stopEagerRefresh()
+	})
+
+	return nil
+}
+
+// heartbeat logs the status of the cache on every tick, till the
+// cache is closed.
+func (jwtCache *Cache) heartbeat(ticks <-chan time.Time, stop func()) {
+	defer stop()
+
+	for {
+		select {
+		case <-jwtCache.closeCtx.Done():
+			return
+		case <-ticks:
+			jwtCache.logHeartbeat()
+		}
+	}
+}
+
+// logHeartbeat logs the current status of the cache.
+func (jwtCache *Cache) logHeartbeat() {
+	jwtCache.lock.RLock()
+	token, expiration := jwtCache.jwt, jwtCache.expiration
+	jwtCache.lock.RUnlock()
+
+	if token == "" {
+		jwtCache.logger.Infof("Heartbeat: cache for %s healthy, no token cached", jwtCache.name)
+		return
+	}
+
+	remaining := expiration.Sub(jwtCache.now())
+	if remaining <= 0 {
+		jwtCache.logger.Infof("Heartbeat: cache for %s healthy, cached token expired %s ago", jwtCache.name, -remaining)
+		return
+	}
+
+	jwtCache.logger.Infof("Heartbeat: cache for %s healthy, expires in %s", jwtCache.name, remaining.Truncate(time.Second))
+}
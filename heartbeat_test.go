@@ -0,0 +1,115 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTicker is a manually controllable ticker, for use with the heartbeat.
+type fakeTicker struct {
+	ticks   chan time.Time
+	stopped chan struct{}
+}
+
+func newFakeTicker() *fakeTicker {
+	return &fakeTicker{
+		ticks:   make(chan time.Time),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (ticker *fakeTicker) option() Option {
+	return func(c *config) {
+		c.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+			return ticker.ticks, func() { close(ticker.stopped) }
+		}
+	}
+}
+
+// waitForEntries waits till the hook recorded the given amount of entries.
+func waitForEntries(t *testing.T, hook *test.Hook, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for len(hook.AllEntries()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d log entries, but got %d", count, len(hook.AllEntries()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Tests that the heartbeat logs the cache status on every tick,
+// and stops when the cache is closed.
+func Test_Cache_Heartbeat(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	// given
+	ticker := newFakeTicker()
+	cache := NewCache(
+		Name("jwt"),
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		HeartbeatInterval(time.Minute),
+		ticker.option(),
+	)
+
+	// when
+	ticker.ticks <- time.Now()
+	waitForEntries(t, hook, 1)
+	emptyMessage := hook.LastEntry().Message
+
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hook.Reset()
+
+	ticker.ticks <- time.Now()
+	waitForEntries(t, hook, 1)
+	cachedMessage := hook.LastEntry().Message
+
+	_ = cache.Close()
+	_ = cache.Close()
+
+	// then
+	if emptyMessage != "Heartbeat: cache for jwt healthy, no token cached" {
+		t.Errorf("unexpected heartbeat %q", emptyMessage)
+	}
+
+	if !strings.HasPrefix(cachedMessage, "Heartbeat: cache for jwt healthy, expires in ") {
+		t.Errorf("unexpected heartbeat %q", cachedMessage)
+	}
+
+	select {
+	case <-ticker.stopped:
+	case <-time.After(time.Second):
+		t.Error("expected ticker to be stopped after Close")
+	}
+}
+
+// Tests that no heartbeat is started by default.
+func Test_Cache_Heartbeat_Disabled(t *testing.T) {
+	// given
+	started := false
+
+	// when
+	cache := NewCache(func(c *config) {
+		c.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+			started = true
+			return nil, func() {}
+		}
+	})
+
+	// then
+	if started {
+		t.Error("expected no heartbeat by default")
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
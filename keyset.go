@@ -0,0 +1,143 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"errors"
+	"sync"
+)
+
+// ErrNoKeySetLoader is returned if a key set without loader is used, such
+// as the zero value of SharedKeys, or SharedKeys created with a nil loader.
+var ErrNoKeySetLoader = errors.New("key set has no loader")
+
+// keySetHolder holds the key set used for verifying tokens, as loaded
+// via the configured loader. It is shared by all caches of a CacheMap,
+// or all caches configured with the same SharedKeys.
+type keySetHolder struct {
+	lock     sync.RWMutex
+	loadLock sync.Mutex
+	set      jwk.Set
+	load     func() (jwk.Set, error)
+}
+
+// SharedKeys is a key set shared by multiple caches, via the SharedKeySet
+// and MapSharedKeySet options. It is safe for concurrent use. Use
+// NewSharedKeys to create it, as the zero value has no loader, and fails
+// every load with ErrNoKeySetLoader.
+type SharedKeys struct {
+	holder keySetHolder
+}
+
+// NewSharedKeys returns a key set, which loads its keys via the given
+// function - e.g. a static JWKS via jwk.Parse. The key set is loaded on
+// first use by any of the caches, and only reloaded via Refresh (or
+// RefreshKeys of any of the caches).
+func NewSharedKeys(load func() (jwk.Set, error)) *SharedKeys {
+	return &SharedKeys{holder: keySetHolder{load: load}}
+}
+
+// Refresh reloads the key set for all caches sharing it. If loading fails,
+// the error is returned and the previous key set is kept.
+func (keys *SharedKeys) Refresh() error {
+	return keys.holder.refresh()
+}
+
+// newKeySetHolder returns the holder of the given shared key set, if
+// given. Otherwise, a holder for the given loader is returned, or nil
+// if no loader is given either.
+func newKeySetHolder(load func() (jwk.Set, error), shared *SharedKeys) *keySetHolder {
+	if shared != nil {
+		return &shared.holder
+	}
+
+	if load == nil {
+		return nil
+	}
+
+	return &keySetHolder{load: load}
+}
+
+// current returns the current key set, loading it if not done yet.
+// Concurrent callers share a single load.
+func (holder *keySetHolder) current() (jwk.Set, error) {
+	holder.lock.RLock()
+	set := holder.set
+	holder.lock.RUnlock()
+
+	if set != nil {
+		return set, nil
+	}
+
+	holder.loadLock.Lock()
+	defer holder.loadLock.Unlock()
+
+	// Another caller might have loaded the key set while we waited
+	holder.lock.RLock()
+	set = holder.set
+	holder.lock.RUnlock()
+
+	if set != nil {
+		return set, nil
+	}
+
+	if err := holder.reload(); err != nil {
+		return nil, err
+	}
+
+	holder.lock.RLock()
+	defer holder.lock.RUnlock()
+
+	return holder.set, nil
+}
+
+// refresh (re)loads the key set. If loading fails, the previous key
+// set is kept.
+func (holder *keySetHolder) refresh() error {
+	holder.loadLock.Lock()
+	defer holder.loadLock.Unlock()
+
+	return holder.reload()
+}
+
+// reload loads the key set. The caller must hold the load lock.
+func (holder *keySetHolder) reload() error {
+	if holder.load == nil {
+		return ErrNoKeySetLoader
+	}
+
+	set, err := holder.load()
+	if err != nil {
+		return err
+	}
+
+	holder.lock.Lock()
+	holder.set = set
+	holder.lock.Unlock()
+
+	return nil
+}
+
+// RefreshKeys reloads the key set configured via the KeySet option - or the
+// SharedKeySet option, for all caches sharing it. If loading fails, the error
+// is returned and the previous key set is kept. Without a key set, this is a
+// no-op.
+func (jwtCache *Cache) RefreshKeys() error {
+	if jwtCache.keys == nil {
+		return nil
+	}
+
+	return jwtCache.keys.refresh()
+}
+
+// RefreshKeys reloads the key set configured via the MapKeySet option (or
+// the MapSharedKeySet option), which is shared by all keys. If loading fails,
+// the error is returned and the previous key set is kept. Without a key set,
+// this is a no-op.
+func (cacheMap *CacheMap) RefreshKeys() error {
+	if cacheMap.keys == nil {
+		return nil
+	}
+
+	return cacheMap.keys.refresh()
+}
@@ -0,0 +1,90 @@
+package jwt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LockStats holds the statistics about the time spent holding the
+// internal lock of a cache exclusively, as recorded via RecordLockStats.
+// Shared holds for serving cached tokens are not included.
+type LockStats struct {
+	// Holds is the number of times the lock was held exclusively.
+	Holds uint64
+
+	// Total is the accumulated time the lock was held.
+	Total time.Duration
+
+	// Max is the longest time the lock was held at once.
+	Max time.Duration
+}
+
+// Average returns the average time the lock was held, or 0 if the
+// lock was never held.
+func (stats LockStats) Average() time.Duration {
+	if stats.Holds == 0 {
+		return 0
+	}
+
+	return stats.Total / time.Duration(stats.Holds)
+}
+
+// LockStats returns the statistics about the time spent holding the
+// internal lock. Statistics are only recorded, if enabled via
+// RecordLockStats.
+func (jwtCache *Cache) LockStats() LockStats {
+	return LockStats{
+		Holds: atomic.LoadUint64(&jwtCache.lockHolds),
+		Total: time.Duration(atomic.LoadUint64(&jwtCache.lockHoldSum)),
+		Max:   time.Duration(atomic.LoadUint64(&jwtCache.lockHoldMax)),
+	}
+}
+
+// LockStats returns the statistics about the time spent holding the
+// internal locks, accumulated over all keys. Statistics are only
+// recorded, if enabled via MapRecordLockStats.
+func (cacheMap *CacheMap) LockStats() LockStats {
+	cacheMap.lock.RLock()
+	defer cacheMap.lock.RUnlock()
+
+	stats := LockStats{}
+	for _, cache := range cacheMap.jwtMap {
+		cacheStats := cache.LockStats()
+
+		stats.Holds += cacheStats.Holds
+		stats.Total += cacheStats.Total
+		if cacheStats.Max > stats.Max {
+			stats.Max = cacheStats.Max
+		}
+	}
+
+	return stats
+}
+
+// lockState acquires the write lock of the cache state.
+func (jwtCache *Cache) lockState() {
+	jwtCache.lock.Lock()
+
+	if jwtCache.recordLockStats {
+		jwtCache.lockedAt = time.Now()
+	}
+}
+
+// unlockState releases the write lock of the cache state, and records
+// the time the lock was held, if enabled.
+func (jwtCache *Cache) unlockState() {
+	if jwtCache.recordLockStats {
+		held := uint64(time.Since(jwtCache.lockedAt))
+
+		atomic.AddUint64(&jwtCache.lockHolds, 1)
+		atomic.AddUint64(&jwtCache.lockHoldSum, held)
+		for {
+			max := atomic.LoadUint64(&jwtCache.lockHoldMax)
+			if held <= max || atomic.CompareAndSwapUint64(&jwtCache.lockHoldMax, max, held) {
+				break
+			}
+		}
+	}
+
+	jwtCache.lock.Unlock()
+}
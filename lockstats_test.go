@@ -0,0 +1,143 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that RecordLockStats records the time spent holding the lock.
+func Test_Cache_LockStats(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Name("jwt"),
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		RecordLockStats(true),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	before := cache.LockStats()
+
+	cache.Invalidate()
+	stats := cache.LockStats()
+
+	buffer := &bytes.Buffer{}
+	if err := cache.WriteMetrics(buffer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if before.Holds == 0 || stats.Holds != before.Holds+1 {
+		t.Errorf("expected Invalidate to hold the lock once, but got %d holds before and %d after", before.Holds, stats.Holds)
+	}
+
+	if stats.Max <= 0 || stats.Max > stats.Total || stats.Average() > stats.Max {
+		t.Errorf("inconsistent lock stats %+v", stats)
+	}
+
+	for _, expected := range []string{
+		fmt.Sprintf(`jwtcache_lock_hold_seconds_count{name="jwt"} %d`, stats.Holds),
+		`jwtcache_lock_hold_seconds_sum{name="jwt"} `,
+		`jwtcache_lock_hold_max_seconds{name="jwt"} `,
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected metrics to contain %q, but got:\n%s", expected, buffer.String())
+		}
+	}
+}
+
+// Tests that no lock stats are recorded by default.
+func Test_Cache_LockStats_Disabled(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := cache.WriteMetrics(buffer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	if stats := cache.LockStats(); stats != (LockStats{}) {
+		t.Errorf("expected no lock stats, but got %+v", stats)
+	}
+
+	if strings.Contains(buffer.String(), "jwtcache_lock_hold") {
+		t.Errorf("expected no lock metrics, but got:\n%s", buffer.String())
+	}
+}
+
+// Tests that the lock stats of a CacheMap are accumulated over all keys.
+func Test_CacheMap_LockStats(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+		MapRecordLockStats(true),
+	)
+
+	// when
+	for _, key := range []string{"a", "b"} {
+		if _, err := cacheMap.EnsureToken(context.Background(), key); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	stats := cacheMap.LockStats()
+
+	// then
+	if expected := cacheMap.jwtMap["a"].LockStats().Holds + cacheMap.jwtMap["b"].LockStats().Holds; stats.Holds != expected || expected == 0 {
+		t.Errorf("expected %d lock holds, but got %d", expected, stats.Holds)
+	}
+
+	if stats.Max <= 0 || stats.Max > stats.Total {
+		t.Errorf("inconsistent lock stats %+v", stats)
+	}
+}
+
+// Tests that Average computes the average time the lock was held.
+func Test_LockStats_Average(t *testing.T) {
+	tests := map[string]struct {
+		stats    LockStats
+		expected time.Duration
+	}{
+		"empty":   {stats: LockStats{}, expected: 0},
+		"average": {stats: LockStats{Holds: 4, Total: time.Second, Max: time.Second}, expected: 250 * time.Millisecond},
+	}
+
+	for name, testCase := range tests {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			if actual := testCase.stats.Average(); actual != testCase.expected {
+				t.Errorf("expected average %s, but got %s", testCase.expected, actual)
+			}
+		})
+	}
+}
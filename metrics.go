@@ -0,0 +1,108 @@
+package jwt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// metricLabelEscaper escapes label values for the Prometheus text
+// exposition format.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics holds the counters of a cache.
+type Metrics struct {
+	// Hits is the number of tokens served from the cache.
+	Hits uint64
+
+	// Misses is the number of calls, which found no servable token
+	// in the cache.
+	Misses uint64
+
+	// Refreshes is the number of tokens successfully provided by the
+	// token function.
+	Refreshes uint64
+
+	// Errors is the number of failed refreshes.
+	Errors uint64
+}
+
+// Metrics returns the counters of the cache, since it was created.
+func (jwtCache *Cache) Metrics() Metrics {
+	return Metrics{
+		Hits:      atomic.LoadUint64(&jwtCache.hitCount),
+		Misses:    atomic.LoadUint64(&jwtCache.missCount),
+		Refreshes: atomic.LoadUint64(&jwtCache.refreshCount),
+		Errors:    atomic.LoadUint64(&jwtCache.errorCount),
+	}
+}
+
+// MetricsAndReset returns the counters of the cache since the previous
+// call of MetricsAndReset (or since the cache was created), and resets
+// them to zero - as preferred by delta-based monitoring systems. No count
+// is lost or reported twice between calls. The counters reported by
+// Metrics, WriteMetrics and RefreshCount are not affected.
+func (jwtCache *Cache) MetricsAndReset() Metrics {
+	jwtCache.metricsLock.Lock()
+	defer jwtCache.metricsLock.Unlock()
+
+	current := jwtCache.Metrics()
+	baseline := jwtCache.metricsBaseline
+	jwtCache.metricsBaseline = current
+
+	return Metrics{
+		Hits:      current.Hits - baseline.Hits,
+		Misses:    current.Misses - baseline.Misses,
+		Refreshes: current.Refreshes - baseline.Refreshes,
+		Errors:    current.Errors - baseline.Errors,
+	}
+}
+
+// WriteMetrics writes the counters of the cache (hits, misses, refreshes
+// and errors, as well as the lock statistics if RecordLockStats is
+// enabled) to the given writer, in the Prometheus text exposition
+// format. The name of the cache is used as the "name" label. This allows
+// scraping the cache without depending on the Prometheus client library.
+func (jwtCache *Cache) WriteMetrics(w io.Writer) error {
+	current := jwtCache.Metrics()
+
+	metrics := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"jwtcache_hits_total", "Number of tokens served from the cache.", current.Hits},
+		{"jwtcache_misses_total", "Number of calls which found no servable token in the cache.", current.Misses},
+		{"jwtcache_refreshes_total", "Number of tokens successfully provided by the token function.", current.Refreshes},
+		{"jwtcache_errors_total", "Number of failed refreshes.", current.Errors},
+	}
+
+	label := metricLabelEscaper.Replace(jwtCache.name)
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(
+			w,
+			"# HELP %s %s\n# TYPE %s counter\n%s{name=\"%s\"} %d\n",
+			metric.name, metric.help, metric.name, metric.name, label, metric.value,
+		); err != nil {
+			return err
+		}
+	}
+
+	if jwtCache.recordLockStats {
+		stats := jwtCache.LockStats()
+
+		if _, err := fmt.Fprintf(
+			w,
+			"# HELP jwtcache_lock_hold_seconds Time spent holding the internal lock.\n# TYPE jwtcache_lock_hold_seconds summary\n"+
+				"jwtcache_lock_hold_seconds_sum{name=\"%s\"} %g\njwtcache_lock_hold_seconds_count{name=\"%s\"} %d\n"+
+				"# HELP jwtcache_lock_hold_max_seconds Longest time the internal lock was held at once.\n# TYPE jwtcache_lock_hold_max_seconds gauge\n"+
+				"jwtcache_lock_hold_max_seconds{name=\"%s\"} %g\n",
+			label, stats.Total.Seconds(), label, stats.Holds, label, stats.Max.Seconds(),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// Tests that WriteMetrics writes the counters of the cache in the
+// Prometheus text exposition format.
+func Test_Cache_WriteMetrics(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	fail := true
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Name(`metrics "test"`),
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			if fail {
+				return "", errors.New("expected error")
+			}
+			return tokenFunc(ctx)
+		}),
+	)
+
+	_, _ = cache.EnsureToken(context.Background())
+	fail = false
+	_, _ = cache.EnsureToken(context.Background())
+	_, _ = cache.EnsureToken(context.Background())
+
+	// when
+	var buffer bytes.Buffer
+	err := cache.WriteMetrics(&buffer)
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := `# HELP jwtcache_hits_total Number of tokens served from the cache.
+# TYPE jwtcache_hits_total counter
+jwtcache_hits_total{name="metrics \"test\""} 1
+# HELP jwtcache_misses_total Number of calls which found no servable token in the cache.
+# TYPE jwtcache_misses_total counter
+jwtcache_misses_total{name="metrics \"test\""} 2
+# HELP jwtcache_refreshes_total Number of tokens successfully provided by the token function.
+# TYPE jwtcache_refreshes_total counter
+jwtcache_refreshes_total{name="metrics \"test\""} 1
+# HELP jwtcache_errors_total Number of failed refreshes.
+# TYPE jwtcache_errors_total counter
+jwtcache_errors_total{name="metrics \"test\""} 1
+`
+	if actual := buffer.String(); actual != expected {
+		t.Errorf("expected metrics:\n%s\nbut got:\n%s", expected, actual)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("expected error")
+}
+
+// Tests that WriteMetrics passes through errors of the writer.
+func Test_Cache_WriteMetrics_WriterError(t *testing.T) {
+	// given
+	cache := NewCache()
+
+	// when
+	err := cache.WriteMetrics(failingWriter{})
+
+	// then
+	if err == nil || err.Error() != "expected error" {
+		t.Errorf("expected writer error, but got: %v", err)
+	}
+}
+
+// Tests that MetricsAndReset returns the counters since the previous
+// call, without affecting the total counters.
+func Test_Cache_MetricsAndReset(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	_, _ = cache.EnsureToken(context.Background())
+	_, _ = cache.EnsureToken(context.Background())
+	_, _ = cache.EnsureToken(context.Background())
+
+	// when
+	first := cache.MetricsAndReset()
+	reset := cache.MetricsAndReset()
+
+	_, _ = cache.EnsureToken(context.Background())
+	second := cache.MetricsAndReset()
+
+	// then
+	if expected := (Metrics{Hits: 2, Misses: 1, Refreshes: 1}); first != expected {
+		t.Errorf("expected metrics %+v, but got %+v", expected, first)
+	}
+
+	if reset != (Metrics{}) {
+		t.Errorf("expected metrics to start from zero after reset, but got %+v", reset)
+	}
+
+	if expected := (Metrics{Hits: 1}); second != expected {
+		t.Errorf("expected metrics %+v, but got %+v", expected, second)
+	}
+
+	if expected := (Metrics{Hits: 3, Misses: 1, Refreshes: 1}); cache.Metrics() != expected {
+		t.Errorf("expected total metrics %+v, but got %+v", expected, cache.Metrics())
+	}
+}
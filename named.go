@@ -0,0 +1,264 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUnknownTokenName is returned by NamedCache.EnsureToken, if the token
+// function did not provide a token with the requested name.
+var ErrUnknownTokenName = errors.New("no token with the requested name")
+
+// NamedCache caches several named tokens, which are provided together by
+// a single invocation of the token function - e.g. an access and an id
+// token of the same response. All tokens are cached together, till the
+// earliest validity of any of them passes.
+type NamedCache struct {
+	// cache provides the configuration, parsing and validation
+	cache      *Cache
+	tokensFunc func(ctx context.Context) (map[string]string, error)
+
+	refreshLock chan struct{}
+
+	lock     sync.RWMutex
+	tokens   map[string]string
+	validity time.Time
+}
+
+// NewNamedCache returns a new cache for the named tokens provided by the
+// given token function. The options are applied as for NewCache, except
+// for TokenFunction. Every token is checked and validated like a token
+// provided to a Cache, and its validity is derived from its own exp claim.
+// If any token has no exp claim or cannot be parsed, the tokens are not
+// cached. Events, observers and recorders are notified as for a Cache,
+// but the refresh statistics of a Cache (e.g. LastFetchStats) are not
+// tracked.
+func NewNamedCache(tokensFunc func(ctx context.Context) (map[string]string, error), opts ...Option) *NamedCache {
+	return &NamedCache{
+		cache:       NewCache(opts...),
+		tokensFunc:  tokensFunc,
+		refreshLock: make(chan struct{}, 1),
+	}
+}
+
+// EnsureToken returns the cached token of the given name, if the cached
+// tokens are still valid. Otherwise, the token function is called to fetch
+// new tokens. If an error occurs in the latter case, it is passed trough.
+// If the token function provides no token of the given name,
+// ErrUnknownTokenName is returned.
+//
+// EnsureToken is safe for concurrent use. Concurrent callers encountering
+// invalid tokens wait for a single invocation of the token function.
+func (namedCache *NamedCache) EnsureToken(ctx context.Context, name string) (string, error) {
+	tokens, err := namedCache.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenNamed(tokens, name)
+}
+
+// EnsureTokens behaves like EnsureToken, but returns all tokens by name.
+// The returned map is a copy, and may be modified by the caller.
+func (namedCache *NamedCache) EnsureTokens(ctx context.Context) (map[string]string, error) {
+	tokens, err := namedCache.ensure(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyTokens(tokens), nil
+}
+
+// Invalidate drops the cached tokens, so that the next call to EnsureToken
+// fetches new tokens.
+func (namedCache *NamedCache) Invalidate() {
+	namedCache.lock.Lock()
+	defer namedCache.lock.Unlock()
+
+	namedCache.tokens = nil
+	namedCache.validity = time.Time{}
+}
+
+// ensure returns either the cached tokens if existing and still valid,
+// or freshly fetched tokens. The returned map must not be modified.
+func (namedCache *NamedCache) ensure(ctx context.Context) (map[string]string, error) {
+	jwtCache := namedCache.cache
+
+	if tokens, ok := namedCache.cachedTokens(); ok {
+		jwtCache.emit(ctx, EventHit, nil)
+		jwtCache.observer.OnCacheHit()
+		return tokens, nil
+	}
+
+	select {
+	case namedCache.refreshLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-namedCache.refreshLock }()
+
+	// Another caller might have refreshed the tokens while we waited
+	if tokens, ok := namedCache.cachedTokens(); ok {
+		jwtCache.emit(ctx, EventHit, nil)
+		jwtCache.observer.OnCacheHit()
+		return tokens, nil
+	}
+
+	jwtCache.emit(ctx, EventMiss, nil)
+
+	return namedCache.refresh(ctx)
+}
+
+// cachedTokens returns the cached tokens, if existing and still valid.
+func (namedCache *NamedCache) cachedTokens() (map[string]string, bool) {
+	namedCache.lock.RLock()
+	defer namedCache.lock.RUnlock()
+
+	if namedCache.tokens != nil && namedCache.cache.now().Round(0).Before(namedCache.validity) {
+		return namedCache.tokens, true
+	}
+
+	return nil, false
+}
+
+// refresh fetches new tokens via the token function, and caches them
+// if possible. The caller must hold the refresh lock.
+func (namedCache *NamedCache) refresh(ctx context.Context) (map[string]string, error) {
+	jwtCache := namedCache.cache
+
+	if err := jwtCache.limiter.acquire(ctx); err != nil {
+		jwtCache.fail(ctx, err)
+		return nil, err
+	}
+	defer jwtCache.limiter.release()
+
+	jwtCache.observer.OnStart()
+	start := jwtCache.now()
+
+	tokens, err := callTokensFunction(ctx, namedCache.tokensFunc)
+	if err != nil {
+		jwtCache.fail(ctx, err)
+		return nil, err
+	}
+
+	// Copy the tokens, so that the caller of the token function
+	// cannot modify the cached tokens
+	tokens = copyTokens(tokens)
+
+	var validity time.Time
+	cacheable := len(tokens) > 0
+
+	for name, token := range tokens {
+		tokenValidity, err := namedCache.validityOf(token)
+		if err != nil {
+			err = fmt.Errorf("token %q: %w", name, err)
+			jwtCache.fail(ctx, err)
+			return nil, err
+		}
+
+		if tokenValidity.IsZero() {
+			cacheable = false
+		} else if validity.IsZero() || tokenValidity.Before(validity) {
+			validity = tokenValidity
+		}
+	}
+
+	if !cacheable {
+		validity = time.Time{}
+	}
+
+	namedCache.lock.Lock()
+	if cacheable {
+		namedCache.tokens = tokens
+		namedCache.validity = validity
+
+		jwtCache.logger.Debugf("New %d %ss received. Caching till %s", len(tokens), jwtCache.name, validity)
+	} else {
+		namedCache.tokens = nil
+		namedCache.validity = time.Time{}
+
+		jwtCache.logger.Debugf("New %d %ss received. Not all have an 'exp' header set or could be parsed, so not caching", len(tokens), jwtCache.name)
+	}
+	namedCache.lock.Unlock()
+
+	jwtCache.emit(ctx, EventRefresh, nil)
+	jwtCache.observer.OnSuccess(validity)
+	jwtCache.recorder.ObserveRefresh(jwtCache.now().Sub(start))
+
+	return tokens, nil
+}
+
+// validityOf checks and validates the given token, and computes its
+// validity. A zero validity is returned for tokens without exp claim, and
+// for unparsable tokens unless RejectUnparsable is set.
+func (namedCache *NamedCache) validityOf(token string) (time.Time, error) {
+	jwtCache := namedCache.cache
+
+	if err := jwtCache.validateSegmentSizes(token); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := jwtCache.validateHeader(token); err != nil {
+		return time.Time{}, err
+	}
+
+	parsedToken, err := jwtCache.parse(token)
+	if err != nil && jwtCache.rejectUnparsable {
+		return time.Time{}, err
+	}
+
+	if err != nil {
+		jwtCache.logger.Debugf("Error while parsing %s: %s", jwtCache.name, err)
+		return time.Time{}, nil
+	}
+
+	if err := jwtCache.validate(parsedToken); err != nil {
+		return time.Time{}, err
+	}
+
+	exp := parsedToken.Expiration()
+	if exp.IsZero() && jwtCache.treatNoExpAsValid {
+		exp = farFuture
+	}
+
+	if exp.IsZero() {
+		return time.Time{}, nil
+	}
+
+	return jwtCache.rewriteValidity(jwtCache.validityFor(parsedToken.IssuedAt(), exp), parsedToken), nil
+}
+
+// tokenNamed returns the token of the given name.
+func tokenNamed(tokens map[string]string, name string) (string, error) {
+	token, ok := tokens[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownTokenName, name)
+	}
+
+	return token, nil
+}
+
+// copyTokens returns a copy of the given tokens.
+func copyTokens(tokens map[string]string) map[string]string {
+	copied := make(map[string]string, len(tokens))
+	for name, token := range tokens {
+		copied[name] = token
+	}
+
+	return copied
+}
+
+// callTokensFunction invokes the given token function, and converts a
+// panic of it into a TokenFunctionPanicError.
+func callTokensFunction(ctx context.Context, tokensFunc func(ctx context.Context) (map[string]string, error)) (tokens map[string]string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			tokens, err = nil, &TokenFunctionPanicError{Value: recovered}
+		}
+	}()
+
+	return tokensFunc(ctx)
+}
@@ -0,0 +1,323 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// getNamedTokensFunction returns an access and an id token, valid for the
+// given lifetimes, as seen by the given clock.
+func getNamedTokensFunction(clock *fakeClock, accessLifetime, idLifetime time.Duration, calls *int) func(ctx context.Context) (map[string]string, error) {
+	return func(ctx context.Context) (map[string]string, error) {
+		*calls++
+
+		tokens := map[string]string{}
+		for name, lifetime := range map[string]time.Duration{"access": accessLifetime, "id": idLifetime} {
+			token, err := getJwt(map[string]interface{}{
+				jwt.IssuedAtKey:   clock.Now().UTC(),
+				jwt.ExpirationKey: clock.Now().Add(lifetime).UTC(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			tokens[name] = token
+		}
+
+		return tokens, nil
+	}
+}
+
+// Tests that all named tokens are provided by a single invocation of the
+// token function, and cached together till the earliest validity passes.
+func Test_NamedCache_EnsureToken(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	calls := 0
+	namedCache := NewNamedCache(
+		getNamedTokensFunction(clock, time.Hour, 10*time.Minute, &calls),
+		Logger(logger),
+		Clock(clock.Now),
+	)
+
+	// when
+	accessToken, accessErr := namedCache.EnsureToken(context.Background(), "access")
+	idToken, idErr := namedCache.EnsureToken(context.Background(), "id")
+	cachedCalls := calls
+
+	clock.Add(10 * time.Minute)
+	refreshedToken, refreshedErr := namedCache.EnsureToken(context.Background(), "access")
+
+	// then
+	if accessErr != nil || idErr != nil || refreshedErr != nil {
+		t.Fatalf("unexpected errors: %v, %v, %v", accessErr, idErr, refreshedErr)
+	}
+
+	if accessToken == "" || idToken == "" || accessToken == idToken {
+		t.Error("expected distinct access and id tokens")
+	}
+
+	if cachedCalls != 1 {
+		t.Errorf("expected a single fetch for both tokens, but got %d", cachedCalls)
+	}
+
+	if calls != 2 || refreshedToken == accessToken {
+		t.Errorf("expected tokens to be refreshed once the id token expired, but got %d fetches", calls)
+	}
+}
+
+// Tests that names not provided by the token function fail with
+// ErrUnknownTokenName, and that invalid tokens fail validation.
+func Test_NamedCache_EnsureToken_Errors(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+
+	tests := map[string]struct {
+		name     string
+		opts     []Option
+		expected error
+	}{
+		"unknown name": {name: "refresh", expected: ErrUnknownTokenName},
+		"rejected":     {name: "access", opts: []Option{ExpectedSubject("someone")}, expected: ErrUnexpectedSubject},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			calls := 0
+			namedCache := NewNamedCache(
+				getNamedTokensFunction(clock, time.Hour, time.Hour, &calls),
+				append([]Option{Logger(logger), Clock(clock.Now)}, test.opts...)...,
+			)
+
+			// when
+			token, err := namedCache.EnsureToken(context.Background(), test.name)
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if token != "" {
+				t.Errorf("received token %q, not expected none", token)
+			}
+		})
+	}
+}
+
+// Tests that concurrent callers share a single fetch, and Invalidate
+// drops the cached tokens.
+func Test_NamedCache_EnsureToken_Concurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	calls := 0
+	namedCache := NewNamedCache(
+		getNamedTokensFunction(clock, time.Hour, time.Hour, &calls),
+		Logger(logger),
+		Clock(clock.Now),
+	)
+
+	// when
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		name := "access"
+		if i%2 == 0 {
+			name = "id"
+		}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := namedCache.EnsureToken(context.Background(), name); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	concurrentCalls := calls
+
+	namedCache.Invalidate()
+	_, err := namedCache.EnsureToken(context.Background(), "access")
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if concurrentCalls != 1 {
+		t.Errorf("expected concurrent callers to share a single fetch, but got %d", concurrentCalls)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected a fetch after Invalidate, but got %d fetches", calls)
+	}
+}
+
+// Tests that unparsable tokens are passed through without caching, unless
+// RejectUnparsable is set - as for a Cache.
+func Test_NamedCache_EnsureToken_Unparsable(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		rejectUnparsable bool
+		expectedErr      error
+	}{
+		"passed through": {rejectUnparsable: false},
+		"rejected":       {rejectUnparsable: true, expectedErr: ErrMalformedToken},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			calls := 0
+			namedCache := NewNamedCache(
+				func(ctx context.Context) (map[string]string, error) {
+					calls++
+
+					accessToken, err := getJwt(map[string]interface{}{
+						jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+					})
+
+					return map[string]string{"access": accessToken, "refresh": "opaque-refresh"}, err
+				},
+				Logger(logger),
+				RejectUnparsable(test.rejectUnparsable),
+			)
+
+			// when
+			token, err := namedCache.EnsureToken(context.Background(), "refresh")
+			_, _ = namedCache.EnsureToken(context.Background(), "refresh")
+
+			// then
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v, but got: %v", test.expectedErr, err)
+			}
+
+			if test.expectedErr == nil && token != "opaque-refresh" {
+				t.Errorf("expected opaque token to be passed through, but got %q", token)
+			}
+
+			if calls != 2 {
+				t.Errorf("expected tokens not to be cached, but got %d fetches", calls)
+			}
+		})
+	}
+}
+
+// Tests that a panic of the token function is returned as
+// TokenFunctionPanicError.
+func Test_NamedCache_EnsureToken_Panic(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	namedCache := NewNamedCache(
+		func(ctx context.Context) (map[string]string, error) {
+			panic("oh no")
+		},
+		Logger(logger),
+	)
+
+	// when
+	_, err := namedCache.EnsureToken(context.Background(), "access")
+
+	// then
+	var panicErr *TokenFunctionPanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "oh no" {
+		t.Errorf("expected TokenFunctionPanicError, but got: %v", err)
+	}
+}
+
+// Tests that the observer hooks are called as for a Cache.
+func Test_NamedCache_EnsureToken_Observer(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	calls := 0
+	observer := &recordingObserver{}
+	namedCache := NewNamedCache(
+		getNamedTokensFunction(clock, time.Hour, 10*time.Minute, &calls),
+		Logger(logger),
+		Clock(clock.Now),
+		Headroom(time.Minute),
+		Observer(observer),
+	)
+
+	// when
+	for _, name := range []string{"access", "id"} {
+		if _, err := namedCache.EnsureToken(context.Background(), name); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	assertCalls(t, observer.calls, "start", "success", "hit")
+
+	if expected := clock.Now().Add(9 * time.Minute); !observer.validity.Equal(expected) {
+		t.Errorf("expected validity %s, but got %s", expected, observer.validity)
+	}
+}
+
+// Tests that neither the map returned by the token function, nor the
+// map returned by EnsureTokens is shared with the cache.
+func Test_NamedCache_EnsureTokens_Copy(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	accessToken, err := getJwt(map[string]interface{}{
+		jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create token: %s", err)
+	}
+
+	provided := map[string]string{"access": accessToken}
+	namedCache := NewNamedCache(
+		func(ctx context.Context) (map[string]string, error) {
+			return provided, nil
+		},
+		Logger(logger),
+	)
+
+	// when
+	tokens, err := namedCache.EnsureTokens(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	provided["access"] = "modified"
+	tokens["access"] = "modified"
+	token, err := namedCache.EnsureToken(context.Background(), "access")
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token != accessToken {
+		t.Errorf("expected cached token to be unaffected, but got %q", token)
+	}
+}
@@ -0,0 +1,88 @@
+package jwt
+
+import (
+	"time"
+)
+
+// ObserverContract defines the hooks an observer can implement, to
+// follow the refresh lifecycle of a cache.
+//
+// Hooks are invoked synchronously on the goroutine calling the cache - or
+// on the timer goroutine for refreshes via EagerRefresh - and never while
+// the lock guarding the cached token is held. If multiple observers are
+// registered, they are invoked in registration order. Note that OnStart,
+// OnSuccess and OnError are invoked while a refresh is in progress, so
+// they must not trigger another refresh of the same cache (e.g. via
+// ForceRefresh).
+type ObserverContract interface {
+	// OnStart is called before the token function is invoked.
+	OnStart()
+
+	// OnSuccess is called after the token function successfully provided
+	// a new token. The validity is the point in time till the token is
+	// cached, and is zero if the token is not cached.
+	OnSuccess(validity time.Time)
+
+	// OnError is called if a new token could not be provided, either due
+	// to the token function failing or the token being rejected.
+	OnError(err error)
+
+	// OnCacheHit is called when a cached token is returned.
+	OnCacheHit()
+}
+
+// NoopObserver is an ObserverContract which does nothing. It is the
+// default observer, and can be embedded to only implement some hooks.
+type NoopObserver struct{}
+
+// OnStart does nothing.
+func (NoopObserver) OnStart() {}
+
+// OnSuccess does nothing.
+func (NoopObserver) OnSuccess(time.Time) {}
+
+// OnError does nothing.
+func (NoopObserver) OnError(error) {}
+
+// OnCacheHit does nothing.
+func (NoopObserver) OnCacheHit() {}
+
+// observerChain invokes multiple observers in order.
+type observerChain []ObserverContract
+
+// newObserverChain returns an observer invoking all given observers in
+// order, or a NoopObserver if there are none.
+func newObserverChain(observers []ObserverContract) ObserverContract {
+	switch len(observers) {
+	case 0:
+		return NoopObserver{}
+	case 1:
+		return observers[0]
+	default:
+		return observerChain(observers)
+	}
+}
+
+func (chain observerChain) OnStart() {
+	for _, observer := range chain {
+		observer.OnStart()
+	}
+}
+
+func (chain observerChain) OnSuccess(validity time.Time) {
+	for _, observer := range chain {
+		observer.OnSuccess(validity)
+	}
+}
+
+func (chain observerChain) OnError(err error) {
+	for _, observer := range chain {
+		observer.OnError(err)
+	}
+}
+
+func (chain observerChain) OnCacheHit() {
+	for _, observer := range chain {
+		observer.OnCacheHit()
+	}
+}
@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the names of all invoked hooks.
+type recordingObserver struct {
+	lock     sync.Mutex
+	calls    []string
+	validity time.Time
+	err      error
+}
+
+func (observer *recordingObserver) record(call string) {
+	observer.lock.Lock()
+	defer observer.lock.Unlock()
+
+	observer.calls = append(observer.calls, call)
+}
+
+func (observer *recordingObserver) OnStart() {
+	observer.record("start")
+}
+
+func (observer *recordingObserver) OnSuccess(validity time.Time) {
+	observer.validity = validity
+	observer.record("success")
+}
+
+func (observer *recordingObserver) OnError(err error) {
+	observer.err = err
+	observer.record("error")
+}
+
+func (observer *recordingObserver) OnCacheHit() {
+	observer.record("hit")
+}
+
+func assertCalls(t *testing.T, actual []string, expected ...string) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected calls %v, but got %v", expected, actual)
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected calls %v, but got %v", expected, actual)
+		}
+	}
+}
+
+// Tests that the observer hooks are called in the correct order.
+func Test_Cache_EnsureToken_Observer(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	observer := &recordingObserver{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Observer(observer),
+	)
+
+	// when
+	for i := 0; i < 2; i++ {
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	assertCalls(t, observer.calls, "start", "success", "hit")
+
+	if !observer.validity.Equal(cache.validity) {
+		t.Errorf("expected validity %s, but got %s", cache.validity, observer.validity)
+	}
+}
+
+// Tests that the observer error hook is called, if the
+// token function fails.
+func Test_Cache_EnsureToken_Observer_Error(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	expectedErr := errors.New("expected error")
+	observer := &recordingObserver{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (s string, e error) {
+			return "", expectedErr
+		}),
+		Observer(observer),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != expectedErr {
+		t.Errorf("unexpected error while token function invocation: %s", err)
+	}
+
+	// then
+	assertCalls(t, observer.calls, "start", "error")
+
+	if observer.err != expectedErr {
+		t.Errorf("expected error %q, but got %q", expectedErr, observer.err)
+	}
+}
+
+// Tests that the NoopObserver can be used as a partial implementation.
+func Test_NoopObserver(t *testing.T) {
+	// given
+	var observer ObserverContract = struct{ NoopObserver }{}
+
+	// when / then (must not panic)
+	observer.OnStart()
+	observer.OnSuccess(time.Now())
+	observer.OnError(errors.New("some error"))
+	observer.OnCacheHit()
+}
+
+// namedObserver appends its name and the invoked hook to a shared log.
+type namedObserver struct {
+	NoopObserver
+	name string
+	log  *[]string
+}
+
+func (observer namedObserver) OnStart() {
+	*observer.log = append(*observer.log, observer.name+":start")
+}
+
+func (observer namedObserver) OnSuccess(time.Time) {
+	*observer.log = append(*observer.log, observer.name+":success")
+}
+
+// Tests that multiple observers are invoked in registration order,
+// on the calling goroutine.
+func Test_Cache_EnsureToken_Observer_Order(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	var log []string
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Observer(namedObserver{name: "metrics", log: &log}),
+		Observer(namedObserver{name: "logging", log: &log}),
+	)
+
+	// when
+	if _, err := cache.EnsureToken(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// then - no synchronization required, as hooks run on this goroutine
+	assertCalls(t, log, "metrics:start", "logging:start", "metrics:success", "logging:success")
+}
@@ -0,0 +1,316 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrMalformedToken is returned if a token does not consist of
+	// exactly three dot-separated segments.
+	ErrMalformedToken = errors.New("token is not made of three segments")
+
+	// ErrMalformedEncoding is returned if the header or payload segment
+	// of a token is not valid base64url.
+	ErrMalformedEncoding = errors.New("token segment is not valid base64url")
+
+	// ErrMalformedJSON is returned if the header or payload segment
+	// of a token does not decode to valid JSON.
+	ErrMalformedJSON = errors.New("token segment is not valid JSON")
+
+	// ErrSegmentTooLarge is returned if the header or payload segment of
+	// a token exceeds the size set via MaxHeaderBytes or MaxPayloadBytes.
+	ErrSegmentTooLarge = errors.New("token segment is too large")
+)
+
+// KeyLookupFunc returns the key to verify a token with, for the algorithm
+// and key ID (which might be empty) of the token header. See
+// VerifyWithKeyLookup.
+type KeyLookupFunc func(alg jwa.SignatureAlgorithm, kid string) (interface{}, error)
+
+// parse parses the given token with the configured parse options. Tokens
+// which are obviously broken are rejected before invoking the parser, and
+// parse errors are classified via classifyParseError.
+func (jwtCache *Cache) parse(token string) (jwt.Token, error) {
+	if !hasThreeSegments(token) {
+		return nil, fmt.Errorf("failed to parse token: %w", ErrMalformedToken)
+	}
+
+	if jwtCache.verifier != nil {
+		if err := verifySignature(token, jwtCache.verifier); err != nil {
+			return nil, err
+		}
+	}
+
+	if jwtCache.keyLookup != nil {
+		return jwtCache.parseWithKeyLookup(token)
+	}
+
+	parsedToken, err := jwtCache.parseWithKeys(token)
+
+	// A failed verification might be caused by keys rotated in the meantime
+	if err != nil && jwtCache.refreshKeysOnFailure && jwtCache.keys != nil && !isMalformed(err) {
+		if refreshErr := jwtCache.keys.refresh(); refreshErr == nil {
+			jwtCache.logger.Debugf("Failed to verify %s, retrying with refreshed key set: %s", jwtCache.name, err)
+			parsedToken, err = jwtCache.parseWithKeys(token)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jwtCache.normalize(parsedToken)
+}
+
+// normalize applies NormalizeClaimKeys to the given parsed token.
+func (jwtCache *Cache) normalize(parsedToken jwt.Token) (jwt.Token, error) {
+	if jwtCache.normalizeClaimKeys {
+		if err := normalizeClaimKeys(parsedToken); err != nil {
+			return nil, fmt.Errorf("failed to parse token: %w", err)
+		}
+	}
+
+	return parsedToken, nil
+}
+
+// parseWithKeyLookup parses the given token, and verifies it with the
+// key resolved via the KeyLookupFunc for the alg and kid of its header.
+func (jwtCache *Cache) parseWithKeyLookup(token string) (jwt.Token, error) {
+	header, err := decodeHeader(token)
+	if err != nil {
+		return nil, classifyParseError(token, err)
+	}
+
+	if err := validateAlgorithm(header, jwtCache.allowedAlgorithms); err != nil {
+		return nil, err
+	}
+
+	algorithm := jwa.SignatureAlgorithm(header.Algorithm)
+	key, err := jwtCache.keyLookup(algorithm, header.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up key for %q: %w", header.KeyID, err)
+	}
+
+	parseOptions := append(jwtCache.parseOptions[:len(jwtCache.parseOptions):len(jwtCache.parseOptions)], jwt.WithVerify(algorithm, key))
+
+	parsedToken, err := jwt.ParseString(token, parseOptions...)
+	if err != nil {
+		return nil, classifyParseError(token, err)
+	}
+
+	return jwtCache.normalize(parsedToken)
+}
+
+// parseWithKeys parses the given token with the configured parse options,
+// and the current key set if configured.
+func (jwtCache *Cache) parseWithKeys(token string) (jwt.Token, error) {
+	parseOptions := jwtCache.parseOptions
+	if jwtCache.keys != nil {
+		set, err := jwtCache.keys.current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key set: %w", err)
+		}
+
+		parseOptions = append(parseOptions[:len(parseOptions):len(parseOptions)], jwt.WithKeySet(set))
+	}
+
+	// Without any parse option, the token is not verified, and can be
+	// decoded without the full JWS parser
+	if len(parseOptions) == 0 {
+		if parsedToken, ok := parseUnverified(token); ok {
+			return parsedToken, nil
+		}
+	}
+
+	parsedToken, err := jwt.ParseString(token, parseOptions...)
+	if err != nil {
+		return nil, classifyParseError(token, err)
+	}
+
+	return parsedToken, nil
+}
+
+// segmentBuffer holds the buffers used by parseUnverified.
+type segmentBuffer struct {
+	raw     []byte
+	decoded []byte
+}
+
+// segmentBuffers pools the buffers of parseUnverified, so that the raw
+// segments are not decoded into fresh buffers on every cache miss.
+var segmentBuffers = sync.Pool{
+	New: func() interface{} { return &segmentBuffer{} },
+}
+
+// parseUnverified decodes the given compact token without verifying it,
+// reusing pooled buffers for the segments. This avoids the JWS parser,
+// which decodes the header and signature into structures that are
+// discarded for unverified tokens - the header is thus only checked to
+// be valid JSON. If the token is not plain base64url-encoded JSON, false
+// is returned, and the token must be parsed via the JWS parser instead,
+// so that errors are reported as before.
+func parseUnverified(token string) (jwt.Token, bool) {
+	buffer := segmentBuffers.Get().(*segmentBuffer)
+	defer segmentBuffers.Put(buffer)
+
+	buffer.raw = append(buffer.raw[:0], token...)
+
+	i := bytes.IndexByte(buffer.raw, '.')
+	j := bytes.LastIndexByte(buffer.raw, '.')
+	if i < 0 || i == j {
+		return nil, false
+	}
+
+	header, payload, signature := buffer.raw[:i], buffer.raw[i+1:j], buffer.raw[j+1:]
+
+	if n := base64.RawURLEncoding.DecodedLen(len(buffer.raw)); cap(buffer.decoded) < n {
+		buffer.decoded = make([]byte, n)
+	}
+
+	decodedHeader, ok := decodeSegment(buffer.decoded[:cap(buffer.decoded)], header)
+	if !ok || !json.Valid(decodedHeader) {
+		return nil, false
+	}
+
+	if _, ok := decodeSegment(buffer.decoded[:cap(buffer.decoded)], signature); !ok {
+		return nil, false
+	}
+
+	decodedPayload, ok := decodeSegment(buffer.decoded[:cap(buffer.decoded)], payload)
+	if !ok {
+		return nil, false
+	}
+
+	// The parsed token copies all claims, so the buffer can be reused
+	parsedToken := jwt.New()
+	if err := json.Unmarshal(decodedPayload, parsedToken); err != nil {
+		return nil, false
+	}
+
+	return parsedToken, true
+}
+
+// decodeSegment decodes the given base64url segment into dst.
+func decodeSegment(dst []byte, segment []byte) ([]byte, bool) {
+	n, err := base64.RawURLEncoding.Decode(dst, segment)
+	if err != nil {
+		return nil, false
+	}
+
+	return dst[:n], true
+}
+
+// isMalformed reports whether the given parse error stems from a
+// structurally broken token.
+func isMalformed(err error) bool {
+	return errors.Is(err, ErrMalformedToken) || errors.Is(err, ErrMalformedEncoding) || errors.Is(err, ErrMalformedJSON)
+}
+
+// registeredClaimKeys are the registered claim names of RFC 7519.
+var registeredClaimKeys = []string{
+	jwt.AudienceKey,
+	jwt.ExpirationKey,
+	jwt.IssuedAtKey,
+	jwt.IssuerKey,
+	jwt.JwtIDKey,
+	jwt.NotBeforeKey,
+	jwt.SubjectKey,
+}
+
+// normalizeClaimKeys moves private claims, which only differ in casing
+// from a registered claim, to the registered claim - unless it is set.
+func normalizeClaimKeys(token jwt.Token) error {
+	var keys []string
+	for key := range token.PrivateClaims() {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		for _, registeredKey := range registeredClaimKeys {
+			if !strings.EqualFold(key, registeredKey) {
+				continue
+			}
+
+			if _, set := token.Get(registeredKey); !set {
+				value, _ := token.Get(key)
+				if err := token.Set(registeredKey, value); err != nil {
+					return err
+				}
+
+				if err := token.Remove(key); err != nil {
+					return err
+				}
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// hasThreeSegments checks if the token consists of exactly three
+// dot-separated segments, without allocating.
+func hasThreeSegments(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// validateSegmentSizes ensures that the header and payload segments of
+// the given token do not exceed the configured sizes. The segments are
+// only located, but not decoded.
+func (jwtCache *Cache) validateSegmentSizes(token string) error {
+	if jwtCache.maxHeaderBytes <= 0 && jwtCache.maxPayloadBytes <= 0 {
+		return nil
+	}
+
+	header, payload := token, ""
+	if i := strings.IndexByte(token, '.'); i >= 0 {
+		header, payload = token[:i], token[i+1:]
+		if j := strings.IndexByte(payload, '.'); j >= 0 {
+			payload = payload[:j]
+		}
+	}
+
+	if jwtCache.maxHeaderBytes > 0 && len(header) > jwtCache.maxHeaderBytes {
+		return fmt.Errorf("%w: header has %d bytes, allowed are %d", ErrSegmentTooLarge, len(header), jwtCache.maxHeaderBytes)
+	}
+
+	if jwtCache.maxPayloadBytes > 0 && len(payload) > jwtCache.maxPayloadBytes {
+		return fmt.Errorf("%w: payload has %d bytes, allowed are %d", ErrSegmentTooLarge, len(payload), jwtCache.maxPayloadBytes)
+	}
+
+	return nil
+}
+
+// classifyParseError inspects a token which failed to parse, and
+// returns an error wrapping ErrMalformedToken, ErrMalformedEncoding or
+// ErrMalformedJSON, if the token is structurally broken. For all other
+// failures (e.g. a failed signature check), the parse error is returned
+// as is. In any case, the returned error is prefixed for context.
+func classifyParseError(token string, err error) error {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return fmt.Errorf("failed to parse token: %w", ErrMalformedToken)
+	}
+
+	for _, segment := range segments[:2] {
+		decoded, decodeErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+		if decodeErr != nil {
+			return fmt.Errorf("failed to parse token: %w: %s", ErrMalformedEncoding, decodeErr)
+		}
+
+		if !json.Valid(decoded) {
+			return fmt.Errorf("failed to parse token: %w", ErrMalformedJSON)
+		}
+	}
+
+	return fmt.Errorf("failed to parse token: %w", err)
+}
@@ -0,0 +1,889 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that EnsureToken classifies structurally broken tokens
+// with typed errors, if RejectUnparsable is enabled.
+func Test_Cache_EnsureToken_Malformed(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	validHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	validPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"foo"}`))
+	brokenJSON := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":`))
+
+	tests := map[string]struct {
+		token    string
+		expected error
+	}{
+		"html":         {token: "<html><body>Bad Gateway</body></html>", expected: ErrMalformedToken},
+		"empty":        {token: "", expected: ErrMalformedToken},
+		"two segments": {token: validHeader + "." + validPayload, expected: ErrMalformedToken},
+		"bad base64":   {token: validHeader + ".$$$." + "sig", expected: ErrMalformedEncoding},
+		"bad json":     {token: validHeader + "." + brokenJSON + ".sig", expected: ErrMalformedJSON},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (s string, e error) {
+					return test.token, nil
+				}),
+				RejectUnparsable(true),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %q, but got: %v", test.expected, err)
+			}
+
+			if token != "" {
+				t.Errorf("received token %q, not expected none", token)
+			}
+		})
+	}
+}
+
+// Tests that parse errors of structurally intact tokens are
+// passed through as is.
+func Test_classifyParseError_Passthrough(t *testing.T) {
+	// given
+	token, err := getJwt(nil)
+	if err != nil {
+		t.Fatalf("failed to generate token: %s", err)
+	}
+	parseErr := errors.New("failed to verify signature")
+
+	// when
+	classified := classifyParseError(token, parseErr)
+
+	// then
+	if !errors.Is(classified, parseErr) {
+		t.Errorf("expected parse error to be wrapped, but got: %v", classified)
+	}
+
+	for _, typed := range []error{ErrMalformedToken, ErrMalformedEncoding, ErrMalformedJSON} {
+		if errors.Is(classified, typed) {
+			t.Errorf("unexpected classification as %q", typed)
+		}
+	}
+}
+
+// Tests that parseUnverified decodes the same claims as the JWS parser,
+// also if its buffers are reused, and falls back for tokens which are
+// not plain base64url-encoded JSON.
+func Test_parseUnverified(t *testing.T) {
+	// given
+	firstToken, firstErr := getJwt(map[string]interface{}{jwt.SubjectKey: "first", "scope": "read"})
+	secondToken, secondErr := getJwt(map[string]interface{}{jwt.SubjectKey: "second"})
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("failed to generate tokens: %v, %v", firstErr, secondErr)
+	}
+
+	expected, err := jwt.ParseString(firstToken)
+	if err != nil {
+		t.Fatalf("failed to parse token: %s", err)
+	}
+
+	validHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	validPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"foo"}`))
+
+	// when
+	first, firstOk := parseUnverified(firstToken)
+	_, secondOk := parseUnverified(secondToken)
+
+	// then
+	if !firstOk || !secondOk {
+		t.Fatalf("expected tokens to be parsed, but got %t, %t", firstOk, secondOk)
+	}
+
+	expectedClaims, _ := expected.AsMap(context.Background())
+	claims, _ := first.AsMap(context.Background())
+	if first.Subject() != "first" || len(claims) != len(expectedClaims) || claims["scope"] != expectedClaims["scope"] {
+		t.Errorf("expected claims %v, but got %v", expectedClaims, claims)
+	}
+
+	for name, token := range map[string]string{
+		"padded":     validHeader + "." + validPayload + "==.sig",
+		"bad header": "e30x." + validPayload + ".sig",
+		"bad json":   validHeader + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":`)) + ".sig",
+		"bad sig":    validHeader + "." + validPayload + ".$$$",
+	} {
+		if _, ok := parseUnverified(token); ok {
+			t.Errorf("expected %s token to fall back to the JWS parser", name)
+		}
+	}
+}
+
+// Tests that EnsureToken passes through tokens with a wrong segment
+// count, if RejectUnparsable is disabled.
+func Test_Cache_EnsureToken_Malformed_Passthrough(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (s string, e error) {
+			return "a.b.c.d", nil
+		}),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token != "a.b.c.d" {
+		t.Errorf("expected token %q, but got %q", "a.b.c.d", token)
+	}
+}
+
+// Tests that the segment count check correctly detects
+// wrong segment counts, without allocating.
+func Test_hasThreeSegments(t *testing.T) {
+	tests := map[string]bool{
+		"":        false,
+		"a":       false,
+		"a.b":     false,
+		"a.b.c":   true,
+		"..":      true,
+		"a.b.c.d": false,
+	}
+
+	for token, expected := range tests {
+		if actual := hasThreeSegments(token); actual != expected {
+			t.Errorf("expected %t for %q, but got %t", expected, token, actual)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { hasThreeSegments("a.b.c") }); allocs != 0 {
+		t.Errorf("expected no allocations, but got %f", allocs)
+	}
+}
+
+// Tests that NormalizeClaimKeys caches tokens of issuers which emit
+// registered claims with non-conforming casing, and that such tokens
+// are not cached without it.
+func Test_Cache_EnsureToken_NormalizeClaimKeys(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		normalize bool
+		cached    bool
+	}{
+		"normalized":     {normalize: true, cached: true},
+		"not normalized": {normalize: false, cached: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			exp := time.Now().Add(time.Hour).Truncate(time.Second)
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					return getJwt(map[string]interface{}{
+						"Exp": exp.Unix(),
+						"Iat": time.Now().Unix(),
+						"Sub": "legacy",
+					})
+				}),
+				NormalizeClaimKeys(test.normalize),
+			)
+
+			// when
+			firstToken, firstErr := cache.EnsureToken(context.Background())
+			secondToken, secondErr := cache.EnsureToken(context.Background())
+
+			// then
+			if firstErr != nil || secondErr != nil {
+				t.Fatalf("unexpected errors: %v, %v", firstErr, secondErr)
+			}
+
+			if cached := firstToken == secondToken; cached != test.cached {
+				t.Errorf("expected token cached to be %t, but was %t", test.cached, cached)
+			}
+
+			if !test.cached {
+				return
+			}
+
+			if expiresAt, ok := cache.Claim(jwt.ExpirationKey); !ok || !expiresAt.(time.Time).Equal(exp) {
+				t.Errorf("expected exp claim %s, but got %v", exp, expiresAt)
+			}
+
+			if subject, ok := cache.Claim(jwt.SubjectKey); !ok || subject != "legacy" {
+				t.Errorf("expected sub claim %q, but got %v", "legacy", subject)
+			}
+
+			if _, ok := cache.Claim("Exp"); ok {
+				t.Error("expected non-conforming claim to be removed")
+			}
+		})
+	}
+}
+
+// Tests that NormalizeClaimKeys does not override registered
+// claims, which are set with conforming casing.
+func Test_Cache_EnsureToken_NormalizeClaimKeys_Conforming(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.SubjectKey: "conforming",
+			"SUB":          "legacy",
+		})),
+		NormalizeClaimKeys(true),
+	)
+
+	// when
+	_, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if subject, _ := cache.Claim(jwt.SubjectKey); subject != "conforming" {
+		t.Errorf("expected sub claim %q, but got %v", "conforming", subject)
+	}
+
+	if subject, _ := cache.Claim("SUB"); subject != "legacy" {
+		t.Errorf("expected SUB claim %q, but got %v", "legacy", subject)
+	}
+}
+
+func getTokenFunctionSignedWithKeyID(keyID string, secret []byte) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		token := jwt.New()
+		if err := token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour).UTC()); err != nil {
+			return "", err
+		}
+
+		headers := jws.NewHeaders()
+		if err := headers.Set(jws.KeyIDKey, keyID); err != nil {
+			return "", err
+		}
+
+		signed, err := jwt.Sign(token, jwa.HS256, secret, jwt.WithHeaders(headers))
+		if err != nil {
+			return "", err
+		}
+
+		return string(signed), nil
+	}
+}
+
+func getSymmetricKeySet(t *testing.T, secrets map[string][]byte) jwk.Set {
+	set := jwk.NewSet()
+	for keyID, secret := range secrets {
+		key, err := jwk.New(secret)
+		if err != nil {
+			t.Fatalf("failed to create key: %s", err)
+		}
+
+		if err := key.Set(jwk.KeyIDKey, keyID); err != nil {
+			t.Fatalf("failed to set key ID: %s", err)
+		}
+
+		if err := key.Set(jwk.AlgorithmKey, jwa.HS256); err != nil {
+			t.Fatalf("failed to set algorithm: %s", err)
+		}
+
+		set.Add(key)
+	}
+
+	return set
+}
+
+// Tests that tokens signed with rotating symmetric keys are verified
+// with the key matching their kid, if a key set is passed via
+// ParseOptions - and that unknown kids or wrong keys are rejected.
+func Test_Cache_EnsureToken_SymmetricKeySet(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	set := getSymmetricKeySet(t, map[string][]byte{
+		"key-1": []byte("first-secret"),
+		"key-2": []byte("second-secret"),
+	})
+
+	tests := map[string]struct {
+		tokenFunc func(ctx context.Context) (string, error)
+		valid     bool
+	}{
+		"first key":   {tokenFunc: getTokenFunctionSignedWithKeyID("key-1", []byte("first-secret")), valid: true},
+		"second key":  {tokenFunc: getTokenFunctionSignedWithKeyID("key-2", []byte("second-secret")), valid: true},
+		"unknown kid": {tokenFunc: getTokenFunctionSignedWithKeyID("key-3", []byte("first-secret")), valid: false},
+		"wrong key":   {tokenFunc: getTokenFunctionSignedWithKeyID("key-1", []byte("second-secret")), valid: false},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(test.tokenFunc),
+				ParseOptions(jwt.WithKeySet(set)),
+				RejectUnparsable(true),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if test.valid && (err != nil || token == "") {
+				t.Errorf("expected valid token, but got error: %v", err)
+			}
+
+			if !test.valid && (err == nil || token != "") {
+				t.Error("expected token to be rejected")
+			}
+		})
+	}
+}
+
+// Tests that KeySet verifies tokens against the preloaded key set, and
+// that RefreshKeys reloads it - keeping the previous set on failure.
+func Test_Cache_EnsureToken_KeySet(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	secrets := map[string][]byte{"key-1": []byte("first-secret")}
+	var loadErr error
+	loads := 0
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionSignedWithKeyID("key-2", []byte("second-secret"))),
+		KeySet(func() (jwk.Set, error) {
+			loads++
+			if loadErr != nil {
+				return nil, loadErr
+			}
+			return getSymmetricKeySet(t, secrets), nil
+		}),
+		RejectUnparsable(true),
+	)
+
+	// when
+	_, unknownErr := cache.EnsureToken(context.Background())
+
+	secrets = map[string][]byte{"key-2": []byte("second-secret")}
+	refreshErr := cache.RefreshKeys()
+	token, refreshedErr := cache.EnsureToken(context.Background())
+
+	loadErr = errors.New("expected error")
+	failedRefreshErr := cache.RefreshKeys()
+	_, keptErr := cache.ForceRefresh(context.Background())
+
+	// then
+	if unknownErr == nil {
+		t.Error("expected token with unknown kid to be rejected")
+	}
+
+	if refreshErr != nil || refreshedErr != nil || token == "" {
+		t.Errorf("expected token after key refresh, but got errors: %v, %v", refreshErr, refreshedErr)
+	}
+
+	if failedRefreshErr != loadErr {
+		t.Errorf("expected load error, but got: %v", failedRefreshErr)
+	}
+
+	if keptErr != nil {
+		t.Errorf("expected previous key set to be kept, but got: %v", keptErr)
+	}
+
+	if loads != 3 {
+		t.Errorf("expected 3 key set loads, but got %d", loads)
+	}
+}
+
+// Tests that the key set of MapKeySet is shared by all keys, and
+// reloaded for all keys via RefreshKeys.
+func Test_CacheMap_EnsureToken_KeySet(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	loads := 0
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return getTokenFunctionSignedWithKeyID("key-1", []byte("first-secret"))(ctx)
+		}),
+		MapKeySet(func() (jwk.Set, error) {
+			loads++
+			return getSymmetricKeySet(t, map[string][]byte{"key-1": []byte("first-secret")}), nil
+		}),
+		MapRejectUnparsable(true),
+	)
+
+	// when
+	_, firstErr := cacheMap.EnsureToken(context.Background(), "a")
+	_, secondErr := cacheMap.EnsureToken(context.Background(), "b")
+	refreshErr := cacheMap.RefreshKeys()
+
+	// then
+	if firstErr != nil || secondErr != nil || refreshErr != nil {
+		t.Errorf("unexpected errors: %v, %v, %v", firstErr, secondErr, refreshErr)
+	}
+
+	if loads != 2 {
+		t.Errorf("expected 2 key set loads, but got %d", loads)
+	}
+}
+
+// Tests that caches sharing a key set via SharedKeySet load it only once,
+// concurrently, and that RefreshKeys of one cache reloads it for all.
+func Test_Cache_EnsureToken_SharedKeySet(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	var loads int32
+	secrets := map[string][]byte{"key-1": []byte("first-secret")}
+	keys := NewSharedKeys(func() (jwk.Set, error) {
+		atomic.AddInt32(&loads, 1)
+		return getSymmetricKeySet(t, secrets), nil
+	})
+
+	rotated := false
+	tokenFunc := func(ctx context.Context) (string, error) {
+		if rotated {
+			return getTokenFunctionSignedWithKeyID("key-2", []byte("second-secret"))(ctx)
+		}
+		return getTokenFunctionSignedWithKeyID("key-1", []byte("first-secret"))(ctx)
+	}
+
+	caches := []*Cache{
+		NewCache(
+			Logger(logger),
+			TokenFunction(tokenFunc),
+			SharedKeySet(keys),
+			RejectUnparsable(true),
+		),
+		NewCache(
+			Logger(logger),
+			TokenFunction(tokenFunc),
+			SharedKeySet(keys),
+			RejectUnparsable(true),
+		),
+	}
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(func(ctx context.Context, key string) (string, error) {
+			return getTokenFunctionSignedWithKeyID("key-1", []byte("first-secret"))(ctx)
+		}),
+		MapSharedKeySet(keys),
+		MapRejectUnparsable(true),
+	)
+
+	// when
+	var wg sync.WaitGroup
+	for _, cache := range caches {
+		cache := cache
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := cache.EnsureToken(context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, mapErr := cacheMap.EnsureToken(context.Background(), "a")
+	initialLoads := atomic.LoadInt32(&loads)
+
+	secrets = map[string][]byte{"key-1": []byte("first-secret"), "key-2": []byte("second-secret")}
+	refreshErr := caches[0].RefreshKeys()
+
+	rotated = true
+	_, rotatedErr := caches[1].ForceRefresh(context.Background())
+
+	// then
+	if mapErr != nil || refreshErr != nil {
+		t.Errorf("unexpected errors: %v, %v", mapErr, refreshErr)
+	}
+
+	if initialLoads != 1 {
+		t.Errorf("expected 1 key set load for all caches, but got %d", initialLoads)
+	}
+
+	if rotatedErr != nil {
+		t.Errorf("expected refreshed key set to apply to all caches, but got: %v", rotatedErr)
+	}
+
+	if loads := atomic.LoadInt32(&loads); loads != 2 {
+		t.Errorf("expected 2 key set loads, but got %d", loads)
+	}
+}
+
+// Tests that SharedKeys without loader fail with ErrNoKeySetLoader,
+// instead of panicking.
+func Test_Cache_EnsureToken_SharedKeySet_NoLoader(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]*SharedKeys{
+		"zero value": {},
+		"nil loader": NewSharedKeys(nil),
+	}
+
+	for name, keys := range tests {
+		keys := keys
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionSignedWithKeyID("key-1", []byte("first-secret"))),
+				SharedKeySet(keys),
+				RejectUnparsable(true),
+			)
+
+			// when
+			refreshErr := keys.Refresh()
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(refreshErr, ErrNoKeySetLoader) {
+				t.Errorf("expected ErrNoKeySetLoader, but got: %v", refreshErr)
+			}
+
+			if !errors.Is(err, ErrNoKeySetLoader) || token != "" {
+				t.Errorf("expected ErrNoKeySetLoader, but got %q, %v", token, err)
+			}
+		})
+	}
+}
+
+// Tests that RefreshKeys is a no-op without a key set.
+func Test_Cache_RefreshKeys_NoKeySet(t *testing.T) {
+	// given
+	cache := NewCache()
+	cacheMap := NewCacheMap()
+
+	// when
+	err := cache.RefreshKeys()
+	mapErr := cacheMap.RefreshKeys()
+
+	// then
+	if err != nil || mapErr != nil {
+		t.Errorf("unexpected errors: %v, %v", err, mapErr)
+	}
+}
+
+// Tests that MaxHeaderBytes and MaxPayloadBytes reject tokens with
+// oversized segments, before they are decoded.
+func Test_Cache_EnsureToken_SegmentSizes(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	token, err := getJwt(map[string]interface{}{
+		jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	segments := strings.Split(token, ".")
+	headerBytes, payloadBytes := len(segments[0]), len(segments[1])
+
+	tests := map[string]struct {
+		token    string
+		options  []Option
+		expected error
+	}{
+		"within limits": {
+			token:    token,
+			options:  []Option{MaxHeaderBytes(headerBytes), MaxPayloadBytes(payloadBytes)},
+			expected: nil,
+		},
+		"oversized header": {
+			token:    token,
+			options:  []Option{MaxHeaderBytes(headerBytes - 1)},
+			expected: ErrSegmentTooLarge,
+		},
+		"oversized payload": {
+			token:    token,
+			options:  []Option{MaxPayloadBytes(payloadBytes - 1)},
+			expected: ErrSegmentTooLarge,
+		},
+		"oversized undecodable payload": {
+			token:    segments[0] + "." + strings.Repeat("!", 1<<20) + "." + segments[2],
+			options:  []Option{MaxPayloadBytes(1 << 10)},
+			expected: ErrSegmentTooLarge,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(append([]Option{
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					return test.token, nil
+				}),
+			}, test.options...)...)
+
+			// when
+			actual, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (actual != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", actual)
+			}
+		})
+	}
+}
+
+// Tests that RefreshKeysOnVerificationFailure reloads the key set once,
+// if a token is signed with a rotated key.
+func Test_Cache_EnsureToken_RefreshKeysOnVerificationFailure(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		enabled       bool
+		rotatedKeys   map[string][]byte
+		expectedErr   bool
+		expectedLoads int
+	}{
+		"rotated key": {
+			enabled:       true,
+			rotatedKeys:   map[string][]byte{"key-2": []byte("second-secret")},
+			expectedErr:   false,
+			expectedLoads: 2,
+		},
+		"still unknown key": {
+			enabled:       true,
+			rotatedKeys:   map[string][]byte{"key-3": []byte("third-secret")},
+			expectedErr:   true,
+			expectedLoads: 2,
+		},
+		"disabled": {
+			enabled:       false,
+			rotatedKeys:   map[string][]byte{"key-2": []byte("second-secret")},
+			expectedErr:   true,
+			expectedLoads: 1,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			loads := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionSignedWithKeyID("key-2", []byte("second-secret"))),
+				KeySet(func() (jwk.Set, error) {
+					loads++
+					if loads == 1 {
+						return getSymmetricKeySet(t, map[string][]byte{"key-1": []byte("first-secret")}), nil
+					}
+					return getSymmetricKeySet(t, test.rotatedKeys), nil
+				}),
+				RefreshKeysOnVerificationFailure(test.enabled),
+				RejectUnparsable(true),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if (err != nil) != test.expectedErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if (token != "") == test.expectedErr {
+				t.Errorf("unexpected token %q", token)
+			}
+
+			if loads != test.expectedLoads {
+				t.Errorf("expected %d key set loads, but got %d", test.expectedLoads, loads)
+			}
+		})
+	}
+}
+
+// Tests that RefreshKeysOnVerificationFailure does not reload the key
+// set for structurally broken tokens.
+func Test_Cache_EnsureToken_RefreshKeysOnVerificationFailure_Malformed(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	loads := 0
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return "not.a.token", nil
+		}),
+		KeySet(func() (jwk.Set, error) {
+			loads++
+			return getSymmetricKeySet(t, map[string][]byte{"key-1": []byte("first-secret")}), nil
+		}),
+		RefreshKeysOnVerificationFailure(true),
+		RejectUnparsable(true),
+	)
+
+	// when
+	_, err := cache.EnsureToken(context.Background())
+
+	// then
+	if !errors.Is(err, ErrMalformedEncoding) && !errors.Is(err, ErrMalformedJSON) {
+		t.Errorf("expected malformed token error, but got: %v", err)
+	}
+
+	if loads != 1 {
+		t.Errorf("expected 1 key set load, but got %d", loads)
+	}
+}
+
+// Tests that VerifyWithKeyLookup verifies tokens with the key resolved for
+// the alg and kid of their header, and rejects unsigned tokens, tokens with
+// a disallowed algorithm, and tokens signed with another key.
+func Test_Cache_EnsureToken_VerifyWithKeyLookup(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	secret := []byte("supersecretpassphrase")
+	unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key-1"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"foo"}`))
+	lookupErr := errors.New("unknown key")
+
+	tests := map[string]struct {
+		tokenFunc   func(ctx context.Context) (string, error)
+		allowed     []jwa.SignatureAlgorithm
+		rejected    bool
+		expectedErr error
+	}{
+		"allowed": {
+			tokenFunc: getTokenFunctionSignedWithKeyID("key-1", secret),
+			allowed:   []jwa.SignatureAlgorithm{jwa.HS256},
+		},
+		"another key": {
+			tokenFunc: getTokenFunctionSignedWithKeyID("key-1", []byte("anothersecretpassphrase")),
+			allowed:   []jwa.SignatureAlgorithm{jwa.HS256},
+			rejected:  true,
+		},
+		"unknown key": {
+			tokenFunc:   getTokenFunctionSignedWithKeyID("key-2", secret),
+			allowed:     []jwa.SignatureAlgorithm{jwa.HS256},
+			rejected:    true,
+			expectedErr: lookupErr,
+		},
+		"disallowed algorithm": {
+			tokenFunc:   getTokenFunction(),
+			allowed:     []jwa.SignatureAlgorithm{jwa.HS256},
+			rejected:    true,
+			expectedErr: ErrAlgorithmNotAllowed,
+		},
+		"empty allowlist": {
+			tokenFunc:   getTokenFunctionSignedWithKeyID("key-1", secret),
+			rejected:    true,
+			expectedErr: ErrAlgorithmNotAllowed,
+		},
+		"unsigned": {
+			tokenFunc: func(ctx context.Context) (string, error) {
+				return unsignedHeader + "." + payload + ".", nil
+			},
+			allowed:     []jwa.SignatureAlgorithm{jwa.HS256, jwa.NoSignature},
+			rejected:    true,
+			expectedErr: ErrAlgorithmNotAllowed,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			var lookedUp []string
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(test.tokenFunc),
+				AllowedAlgorithms(test.allowed...),
+				RejectUnparsable(true),
+				VerifyWithKeyLookup(func(alg jwa.SignatureAlgorithm, kid string) (interface{}, error) {
+					lookedUp = append(lookedUp, alg.String()+"/"+kid)
+					if kid != "key-1" {
+						return nil, lookupErr
+					}
+					return secret, nil
+				}),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !test.rejected {
+				if err != nil || token == "" {
+					t.Fatalf("expected token, but got error: %v", err)
+				}
+
+				if len(lookedUp) != 1 || lookedUp[0] != "HS256/key-1" {
+					t.Errorf("expected key lookup for HS256/key-1, but got %v", lookedUp)
+				}
+				return
+			}
+
+			if err == nil || token != "" {
+				t.Fatalf("expected token to be rejected, but got %q", token)
+			}
+
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Errorf("expected error %v, but got: %v", test.expectedErr, err)
+			}
+		})
+	}
+}
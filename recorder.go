@@ -0,0 +1,43 @@
+package jwt
+
+import (
+	"time"
+)
+
+// RecorderContract defines the methods required to record metrics of a
+// cache, e.g. by adapting them to Prometheus, StatsD or OpenTelemetry.
+//
+// Methods are invoked synchronously on the goroutine calling the cache -
+// or on the timer goroutine for refreshes via EagerRefresh - so
+// implementations must be safe for concurrent use, and should return
+// quickly.
+type RecorderContract interface {
+	// IncHit is called when a cached token is returned.
+	IncHit()
+
+	// IncMiss is called when no servable token is cached.
+	IncMiss()
+
+	// ObserveRefresh is called after the token function successfully
+	// provided a new token, with the duration of the refresh.
+	ObserveRefresh(d time.Duration)
+
+	// IncError is called if a new token could not be provided.
+	IncError()
+}
+
+// NoopRecorder is a RecorderContract which does nothing.
+// It is the default recorder.
+type NoopRecorder struct{}
+
+// IncHit does nothing.
+func (NoopRecorder) IncHit() {}
+
+// IncMiss does nothing.
+func (NoopRecorder) IncMiss() {}
+
+// ObserveRefresh does nothing.
+func (NoopRecorder) ObserveRefresh(time.Duration) {}
+
+// IncError does nothing.
+func (NoopRecorder) IncError() {}
@@ -0,0 +1,134 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRecorder counts all calls it receives.
+type fakeRecorder struct {
+	mu        sync.Mutex
+	hits      int
+	misses    int
+	errors    int
+	refreshes []time.Duration
+}
+
+func (recorder *fakeRecorder) IncHit() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.hits++
+}
+
+func (recorder *fakeRecorder) IncMiss() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.misses++
+}
+
+func (recorder *fakeRecorder) ObserveRefresh(d time.Duration) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.refreshes = append(recorder.refreshes, d)
+}
+
+func (recorder *fakeRecorder) IncError() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.errors++
+}
+
+// Tests that the Recorder is notified about misses, refreshes and hits.
+func Test_Cache_EnsureToken_Recorder(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	recorder := &fakeRecorder{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Recorder(recorder),
+	)
+
+	// when
+	for i := 0; i < 3; i++ {
+		if _, err := cache.EnsureToken(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if recorder.misses != 1 || recorder.hits != 2 || recorder.errors != 0 {
+		t.Errorf("expected 1 miss and 2 hits, but got %d misses, %d hits and %d errors", recorder.misses, recorder.hits, recorder.errors)
+	}
+
+	if len(recorder.refreshes) != 1 || recorder.refreshes[0] < 0 {
+		t.Errorf("expected one observed refresh, but got %v", recorder.refreshes)
+	}
+}
+
+// Tests that the Recorder is notified about errors, without observing
+// the failed refresh.
+func Test_Cache_EnsureToken_Recorder_Error(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	recorder := &fakeRecorder{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return "", errors.New("expected error")
+		}),
+		Recorder(recorder),
+	)
+
+	// when
+	_, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err == nil {
+		t.Fatal("expected error, but got none")
+	}
+
+	if recorder.misses != 1 || recorder.errors != 1 || recorder.hits != 0 {
+		t.Errorf("expected 1 miss and 1 error, but got %d misses, %d hits and %d errors", recorder.misses, recorder.hits, recorder.errors)
+	}
+
+	if len(recorder.refreshes) != 0 {
+		t.Errorf("expected no observed refresh, but got %v", recorder.refreshes)
+	}
+}
+
+// Tests that the MapRecorder is shared by the caches of all keys.
+func Test_CacheMap_EnsureToken_Recorder(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	recorder := &fakeRecorder{}
+	cacheMap := NewCacheMap(
+		MapLogger(logger),
+		MapTokenFunction(getMapTokenFunction()),
+		MapRecorder(recorder),
+	)
+
+	// when
+	for _, key := range []string{"a", "b", "a"} {
+		if _, err := cacheMap.EnsureToken(context.Background(), key); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if recorder.misses != 2 || recorder.hits != 1 || len(recorder.refreshes) != 2 {
+		t.Errorf("expected 2 misses, 1 hit and 2 refreshes, but got %d misses, %d hits and %d refreshes", recorder.misses, recorder.hits, len(recorder.refreshes))
+	}
+}
@@ -0,0 +1,153 @@
+package jwt
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is a read-only, consistent view of a token as provided by
+// EnsureTokenSnapshot.
+type Snapshot struct {
+	// Token is the raw token.
+	Token string
+
+	// Claims is a copy of the claims of the token. It is nil, if the
+	// token could not be parsed.
+	Claims map[string]interface{}
+
+	// ExpiresAt is the exp claim of the token, or zero if not set.
+	ExpiresAt time.Time
+
+	// IssuedAt is the iat claim of the token, or zero if not set.
+	IssuedAt time.Time
+
+	// FromCache reports whether the token was served from the cache,
+	// instead of being freshly provided by the token function.
+	FromCache bool
+}
+
+// EnsureTokenSnapshot behaves like EnsureToken, but returns a Snapshot
+// of the token and its claims. All fields of the snapshot stem from the
+// same token, even if the cache is refreshed concurrently.
+func (jwtCache *Cache) EnsureTokenSnapshot(ctx context.Context) (Snapshot, error) {
+	state, err := jwtCache.ensure(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{
+		Token:     state.token,
+		FromCache: state.fromCache,
+	}
+
+	if parsed := jwtCache.parsedOf(state); parsed != nil {
+		claims, err := parsed.AsMap(ctx)
+		if err != nil {
+			return Snapshot{}, err
+		}
+
+		snapshot.Claims = copyClaim(claims).(map[string]interface{})
+		snapshot.ExpiresAt = parsed.Expiration()
+		snapshot.IssuedAt = parsed.IssuedAt()
+	}
+
+	return snapshot, nil
+}
+
+// NotCachedReason describes why a token was not cached.
+type NotCachedReason int
+
+const (
+	// ReasonCached means that the token was cached.
+	ReasonCached NotCachedReason = iota
+
+	// ReasonNoExpiry means that the token was not cached,
+	// as it has no exp claim.
+	ReasonNoExpiry
+
+	// ReasonUnparsable means that the token was not cached,
+	// as it could not be parsed.
+	ReasonUnparsable
+
+	// ReasonShouldCache means that the token was not cached,
+	// as it was rejected by the ShouldCache predicate.
+	ReasonShouldCache
+)
+
+// String returns a human readable representation of the reason.
+func (reason NotCachedReason) String() string {
+	switch reason {
+	case ReasonCached:
+		return "cached"
+	case ReasonNoExpiry:
+		return "no expiry"
+	case ReasonUnparsable:
+		return "unparsable"
+	case ReasonShouldCache:
+		return "rejected by predicate"
+	default:
+		return "unknown"
+	}
+}
+
+// Meta describes how a token returned by EnsureTokenWithMeta was handled.
+type Meta struct {
+	// FromCache reports whether the token was served from the cache,
+	// instead of being freshly provided by the token function.
+	FromCache bool
+
+	// NotCached reports why a freshly provided token was not cached,
+	// or ReasonCached if it was.
+	NotCached NotCachedReason
+}
+
+// EnsureTokenWithMeta behaves like EnsureToken, but additionally reports
+// how the token was handled. This surfaces the otherwise silent decision
+// to not cache a token (e.g. due to a missing exp claim), so that callers
+// can log or alert on it.
+func (jwtCache *Cache) EnsureTokenWithMeta(ctx context.Context) (string, Meta, error) {
+	state, err := jwtCache.ensure(ctx)
+	if err != nil {
+		return "", Meta{}, err
+	}
+
+	return state.token, Meta{FromCache: state.fromCache, NotCached: state.notCached}, nil
+}
+
+// EnsureTokenWithRefresher behaves like EnsureToken, but additionally
+// returns a function which forces a refresh via ForceRefresh. This allows
+// passing the capability to refresh the token downstream, without passing
+// the cache itself. The function is returned even if an error occurred.
+func (jwtCache *Cache) EnsureTokenWithRefresher(ctx context.Context) (string, func(ctx context.Context) (string, error), error) {
+	token, err := jwtCache.EnsureToken(ctx)
+	return token, jwtCache.ForceRefresh, err
+}
+
+// EnsureTokenWithRevoke behaves like EnsureToken, but additionally returns
+// a function which drops the returned token from the cache, e.g. after it
+// was rejected by the server with a 401. The next call then fetches a new
+// token, which is recorded with the refresh reason RefreshRejected. If the
+// cache already holds another token, calling the function has no effect,
+// so that a late revocation does not drop a fresh token.
+// The function is returned even if an error occurred, but is a no-op then.
+func (jwtCache *Cache) EnsureTokenWithRevoke(ctx context.Context) (string, func(), error) {
+	token, err := jwtCache.EnsureToken(ctx)
+	if err != nil {
+		return "", func() {}, err
+	}
+
+	return token, func() {
+		jwtCache.lockState()
+		revoked := jwtCache.jwt == token
+		if revoked {
+			jwtCache.invalidateLocked()
+			jwtCache.invalidated = false
+			jwtCache.rejected = true
+		}
+		jwtCache.unlockState()
+
+		if revoked {
+			jwtCache.stopEagerRefresh()
+		}
+	}, nil
+}
@@ -0,0 +1,350 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Tests that EnsureTokenSnapshot returns consistent snapshots,
+// for both freshly fetched and cached tokens.
+func Test_Cache_EnsureTokenSnapshot(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	now := time.Now().Truncate(time.Second)
+	iat := now.Add(-time.Hour)
+	exp := now.Add(time.Hour)
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return getJwt(map[string]interface{}{
+				jwt.IssuedAtKey:   iat.UTC(),
+				jwt.ExpirationKey: exp.UTC(),
+				jwt.SubjectKey:    "some-subject",
+			})
+		}),
+	)
+
+	// when
+	first, firstErr := cache.EnsureTokenSnapshot(context.Background())
+	second, secondErr := cache.EnsureTokenSnapshot(context.Background())
+
+	// then
+	if firstErr != nil {
+		t.Errorf("error while first token function invocation: %s", firstErr)
+	}
+
+	if secondErr != nil {
+		t.Errorf("error while second token function invocation: %s", secondErr)
+	}
+
+	if first.FromCache {
+		t.Error("expected first snapshot to be freshly fetched")
+	}
+
+	if !second.FromCache {
+		t.Error("expected second snapshot to be served from cache")
+	}
+
+	for _, snapshot := range []Snapshot{first, second} {
+		if snapshot.Token == "" || snapshot.Token != first.Token {
+			t.Errorf("unexpected token %q", snapshot.Token)
+		}
+
+		if !snapshot.ExpiresAt.Equal(exp) {
+			t.Errorf("expected expiry %s, but got %s", exp, snapshot.ExpiresAt)
+		}
+
+		if !snapshot.IssuedAt.Equal(iat) {
+			t.Errorf("expected issued at %s, but got %s", iat, snapshot.IssuedAt)
+		}
+
+		if sub := snapshot.Claims[jwt.SubjectKey]; sub != "some-subject" {
+			t.Errorf("expected subject claim %q, but got %v", "some-subject", sub)
+		}
+	}
+
+	// Claims must be a copy
+	first.Claims[jwt.SubjectKey] = "tampered"
+	if third, _ := cache.EnsureTokenSnapshot(context.Background()); third.Claims[jwt.SubjectKey] != "some-subject" {
+		t.Error("snapshot claims are not a copy")
+	}
+}
+
+// Tests that EnsureTokenSnapshot returns a snapshot without claims,
+// if the token cannot be parsed.
+func Test_Cache_EnsureTokenSnapshot_Unparsable(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			return "not-a-valid-token", nil
+		}),
+	)
+
+	// when
+	snapshot, err := cache.EnsureTokenSnapshot(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if snapshot.Token != "not-a-valid-token" || snapshot.FromCache {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	if snapshot.Claims != nil || !snapshot.ExpiresAt.IsZero() || !snapshot.IssuedAt.IsZero() {
+		t.Errorf("expected snapshot without claims, but got %+v", snapshot)
+	}
+}
+
+// Tests that EnsureTokenWithMeta reports why a token was not cached.
+func Test_Cache_EnsureTokenWithMeta(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		tokenFunc func(ctx context.Context) (string, error)
+		expected  NotCachedReason
+	}{
+		"cached": {
+			tokenFunc: getTokenFunction(),
+			expected:  ReasonCached,
+		},
+		"no expiry": {
+			tokenFunc: getTokenFunctionWithoutExp(),
+			expected:  ReasonNoExpiry,
+		},
+		"unparsable": {
+			tokenFunc: func(ctx context.Context) (string, error) {
+				return "not-a-valid-token", nil
+			},
+			expected: ReasonUnparsable,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(test.tokenFunc),
+			)
+
+			// when
+			token, meta, err := cache.EnsureTokenWithMeta(context.Background())
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if token == "" {
+				t.Error("expected token, but got none")
+			}
+
+			if meta.FromCache {
+				t.Error("expected freshly fetched token")
+			}
+
+			if meta.NotCached != test.expected {
+				t.Errorf("expected reason %q, but got %q", test.expected, meta.NotCached)
+			}
+		})
+	}
+}
+
+// Tests that EnsureTokenWithMeta reports cache hits.
+func Test_Cache_EnsureTokenWithMeta_FromCache(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	_, _, _ = cache.EnsureTokenWithMeta(context.Background())
+	_, meta, err := cache.EnsureTokenWithMeta(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if !meta.FromCache || meta.NotCached != ReasonCached {
+		t.Errorf("expected cached token from cache, but got %+v", meta)
+	}
+}
+
+// Tests that the reasons render human readable.
+func Test_NotCachedReason_String(t *testing.T) {
+	tests := map[NotCachedReason]string{
+		ReasonCached:        "cached",
+		ReasonNoExpiry:      "no expiry",
+		ReasonUnparsable:    "unparsable",
+		ReasonShouldCache:   "rejected by predicate",
+		NotCachedReason(42): "unknown",
+	}
+
+	for reason, expected := range tests {
+		if actual := reason.String(); actual != expected {
+			t.Errorf("expected %q, but got %q", expected, actual)
+		}
+	}
+}
+
+// Tests that EnsureTokenWithRefresher returns the cached token, and a
+// function which forces a refresh of the cache.
+func Test_Cache_EnsureTokenWithRefresher(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	token, refreshNow, err := cache.EnsureTokenWithRefresher(context.Background())
+	refreshedToken, refreshErr := refreshNow(context.Background())
+	cachedToken, _ := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil || refreshErr != nil {
+		t.Errorf("unexpected errors: %v, %v", err, refreshErr)
+	}
+
+	if token == "" || refreshedToken == "" {
+		t.Error("expected tokens, but got none")
+	}
+
+	if token == refreshedToken {
+		t.Error("expected refresh function to fetch a new token")
+	}
+
+	if cachedToken != refreshedToken {
+		t.Error("expected refreshed token to be cached")
+	}
+}
+
+// Tests that EnsureTokenWithRefresher returns the refresh function,
+// even if fetching the token failed.
+func Test_Cache_EnsureTokenWithRefresher_TokenError(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	fail := true
+	tokenFunc := getTokenFunction()
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(func(ctx context.Context) (string, error) {
+			if fail {
+				return "", errors.New("expected error")
+			}
+			return tokenFunc(ctx)
+		}),
+	)
+
+	// when
+	_, refreshNow, err := cache.EnsureTokenWithRefresher(context.Background())
+	fail = false
+	refreshedToken, refreshErr := refreshNow(context.Background())
+
+	// then
+	if err == nil {
+		t.Error("expected error, but got none")
+	}
+
+	if refreshErr != nil {
+		t.Errorf("unexpected error: %s", refreshErr)
+	}
+
+	if refreshedToken == "" {
+		t.Error("expected token, but got none")
+	}
+}
+
+// Tests that the function returned by EnsureTokenWithRevoke forces
+// a refresh, but only as long as the revoked token is cached.
+func Test_Cache_EnsureTokenWithRevoke(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+	)
+
+	// when
+	token, revoke, err := cache.EnsureTokenWithRevoke(context.Background())
+	revoke()
+	refreshedToken, refreshErr := cache.EnsureToken(context.Background())
+	refreshReason, _ := cache.LastRefreshReason()
+
+	// late revocation of the already replaced token
+	revoke()
+	cachedToken, cachedErr := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil || refreshErr != nil || cachedErr != nil {
+		t.Errorf("unexpected errors: %v, %v, %v", err, refreshErr, cachedErr)
+	}
+
+	if token == refreshedToken {
+		t.Error("expected revoke to force a refresh")
+	}
+
+	if refreshReason != RefreshRejected {
+		t.Errorf("expected refresh reason %s, but got %s", RefreshRejected, refreshReason)
+	}
+
+	if cachedToken != refreshedToken {
+		t.Error("expected late revoke to keep the fresh token")
+	}
+
+	if count := cache.RefreshCount(); count != 2 {
+		t.Errorf("expected 2 refreshes, but got %d", count)
+	}
+}
+
+// Tests that EnsureTokenWithRevoke returns a no-op function,
+// if fetching the token failed.
+func Test_Cache_EnsureTokenWithRevoke_TokenError(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+	)
+
+	// when
+	token, revoke, err := cache.EnsureTokenWithRevoke(context.Background())
+
+	// then
+	if err != ErrNotImplemented || token != "" {
+		t.Errorf("expected ErrNotImplemented, but got: %v", err)
+	}
+
+	revoke() // must not panic
+}
@@ -0,0 +1,473 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingScopes is returned if a token does not carry all scopes
+	// required via the RequiredScopes option.
+	ErrMissingScopes = errors.New("token is missing required scopes")
+
+	// ErrKeyIDNotAllowed is returned if the kid header of a token is not
+	// one of the key IDs allowed via the AllowedKeyIDs option.
+	ErrKeyIDNotAllowed = errors.New("token key ID is not allowed")
+
+	// ErrAlgorithmNotAllowed is returned if the alg header of a token is
+	// not one of the algorithms allowed via the AllowedAlgorithms option.
+	ErrAlgorithmNotAllowed = errors.New("token algorithm is not allowed")
+
+	// ErrNonceReused is returned if the nonce claim of a token repeats
+	// the nonce of the previous token, and NonceReject is configured.
+	ErrNonceReused = errors.New("token nonce was reused")
+
+	// ErrUnexpectedSubject is returned if the sub claim of a token does not
+	// match the subject expected via the ExpectedSubject option.
+	ErrUnexpectedSubject = errors.New("token subject is not the expected subject")
+
+	// ErrUnexpectedAudience is returned if the aud claim of a token does
+	// not contain the audiences expected via the ExpectedAudience option.
+	ErrUnexpectedAudience = errors.New("token audience is not the expected audience")
+
+	// ErrIssuerNotAllowed is returned if the iss claim of a token is not
+	// allowed via the AllowedIssuers option.
+	ErrIssuerNotAllowed = errors.New("token issuer is not allowed")
+
+	// ErrMissingExpiry is returned if a token has no exp claim,
+	// and StrictExpiry is enabled.
+	ErrMissingExpiry = errors.New("token has no expiry")
+
+	// ErrInvalidExpiry is returned if the exp claim of a token is not
+	// positive, and StrictExpiry is enabled.
+	ErrInvalidExpiry = errors.New("token expiry is not positive")
+
+	// ErrExpiryBeforeIssuedAt is returned if the exp claim of a token is
+	// not after its iat claim, and StrictExpiry is enabled.
+	ErrExpiryBeforeIssuedAt = errors.New("token expiry is not after its issued at")
+
+	// ErrExpiryTooFar is returned if the exp claim of a token is further
+	// in the future than the maximum TTL given to StrictExpiry.
+	ErrExpiryTooFar = errors.New("token expiry is too far in the future")
+
+	// ErrTokenTooOld is returned if the iat claim of a token is older
+	// than allowed via the MaxTokenAge option.
+	ErrTokenTooOld = errors.New("token is too old")
+
+	// ErrIssuedBeforeCutoff is returned if the iat claim of a token
+	// predates the cutoff set via the NotBeforeIssuedAt option.
+	ErrIssuedBeforeCutoff = errors.New("token issued before cutoff")
+
+	// ErrTokenNotAccepted is returned if a token was rejected by the
+	// function set via the AcceptFunc option.
+	ErrTokenNotAccepted = errors.New("token was not accepted")
+)
+
+// NoncePolicy defines how a cache handles tokens with a reused nonce.
+type NoncePolicy int
+
+const (
+	// NonceIgnore does not track nonces at all.
+	NonceIgnore NoncePolicy = iota
+
+	// NonceReport logs tokens with a reused nonce, but accepts them.
+	NonceReport
+
+	// NonceReject rejects tokens with a reused nonce with ErrNonceReused.
+	NonceReject
+)
+
+// ClaimValidator checks the claims of a parsed token, and returns an
+// error if the token must not be accepted. See ClaimValidators.
+type ClaimValidator func(token jwt.Token) error
+
+// ValidationErrors holds all failures of the claim validators, if
+// AggregateValidationErrors is enabled.
+type ValidationErrors []error
+
+// Error returns all failures, in the order of the validators.
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf("token failed %d validators: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the failures matches the target,
+// for use with errors.Is.
+func (errs ValidationErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks the parsed token against the configured validation
+// rules, before it is accepted by the cache.
+func (jwtCache *Cache) validate(token jwt.Token) error {
+	if len(jwtCache.requiredScopes) > 0 {
+		if err := validateScopes(token, jwtCache.scopeClaim, jwtCache.requiredScopes); err != nil {
+			return err
+		}
+	}
+
+	if jwtCache.expectedSubject != "" && token.Subject() != jwtCache.expectedSubject {
+		return fmt.Errorf("%w: %q", ErrUnexpectedSubject, token.Subject())
+	}
+
+	if len(jwtCache.expectedAudiences) > 0 {
+		if err := validateAudience(token, jwtCache.expectedAudiences, jwtCache.requireAllAudiences); err != nil {
+			return err
+		}
+	}
+
+	if len(jwtCache.allowedIssuers) > 0 {
+		if err := validateIssuer(token, jwtCache.allowedIssuers); err != nil {
+			return err
+		}
+	}
+
+	if jwtCache.strictExpiry {
+		if err := validateExpiry(token, jwtCache.now(), jwtCache.maxTTL); err != nil {
+			return err
+		}
+	}
+
+	if jwtCache.maxTokenAge > 0 {
+		if err := validateTokenAge(token, jwtCache.now(), jwtCache.maxTokenAge); err != nil {
+			return err
+		}
+	}
+
+	if !jwtCache.issuedAfter.IsZero() {
+		if iat := token.IssuedAt(); iat.Before(jwtCache.issuedAfter) {
+			return fmt.Errorf("%w: issued at %s", ErrIssuedBeforeCutoff, iat)
+		}
+	}
+
+	if err := jwtCache.validateClaims(token); err != nil {
+		return err
+	}
+
+	return jwtCache.accept(token)
+}
+
+// revalidate parses and validates the given cached token again, if
+// RevalidateOnEveryAccess is enabled. A token failing revalidation is
+// dropped from the cache.
+func (jwtCache *Cache) revalidate(state tokenState) bool {
+	if !jwtCache.revalidateOnAccess {
+		return true
+	}
+
+	parsedToken, err := jwtCache.parse(state.token)
+	if err == nil {
+		err = jwtCache.validate(parsedToken)
+	}
+
+	if err == nil {
+		return true
+	}
+
+	jwtCache.logger.Infof("Cached %s failed revalidation, dropping it: %s", jwtCache.name, err)
+
+	jwtCache.lockState()
+	dropped := jwtCache.jwt == state.token
+	if dropped {
+		jwtCache.invalidateLocked()
+		jwtCache.invalidated = false
+		jwtCache.rejected = true
+	}
+	jwtCache.unlockState()
+
+	if dropped {
+		jwtCache.stopEagerRefresh()
+	}
+
+	return false
+}
+
+// validateClaims invokes the registered claim validators in order.
+func (jwtCache *Cache) validateClaims(token jwt.Token) error {
+	var errs ValidationErrors
+	for _, validator := range jwtCache.claimValidators {
+		if err := validator(token); err != nil {
+			if !jwtCache.aggregateValidation {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// accept consults the AcceptFunc, if set, as the final gate of validation.
+func (jwtCache *Cache) accept(token jwt.Token) error {
+	if jwtCache.acceptFunc == nil {
+		return nil
+	}
+
+	accepted, err := jwtCache.acceptFunc(token)
+	if err != nil {
+		return err
+	}
+
+	if !accepted {
+		return ErrTokenNotAccepted
+	}
+
+	return nil
+}
+
+// validateScopes ensures that the scope claim of the given token
+// contains all required scopes.
+func validateScopes(token jwt.Token, scopeClaim string, requiredScopes []string) error {
+	claim, _ := token.Get(scopeClaim)
+	scopes := parseScopes(claim)
+
+	present := make(map[string]struct{}, len(scopes))
+	for _, scope := range scopes {
+		present[scope] = struct{}{}
+	}
+
+	var missing []string
+	for _, scope := range requiredScopes {
+		if _, ok := present[scope]; !ok {
+			missing = append(missing, scope)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingScopes, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// validateIssuer ensures that the iss claim of the given token
+// is one of the allowed issuers.
+func validateIssuer(token jwt.Token, allowedIssuers []string) error {
+	for _, issuer := range allowedIssuers {
+		if token.Issuer() == issuer {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrIssuerNotAllowed, token.Issuer())
+}
+
+// validateAudience ensures that the aud claim of the given token contains
+// any of the expected audiences, or all of them if requireAll is set.
+func validateAudience(token jwt.Token, expectedAudiences []string, requireAll bool) error {
+	present := make(map[string]struct{}, len(token.Audience()))
+	for _, audience := range token.Audience() {
+		present[audience] = struct{}{}
+	}
+
+	var missing []string
+	for _, audience := range expectedAudiences {
+		if _, ok := present[audience]; !ok {
+			missing = append(missing, audience)
+		} else if !requireAll {
+			return nil
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q, missing %s", ErrUnexpectedAudience, token.Audience(), strings.Join(missing, ", "))
+}
+
+// validateExpiry strictly validates the exp claim of the given token.
+func validateExpiry(token jwt.Token, now time.Time, maxTTL time.Duration) error {
+	exp := token.Expiration()
+	if exp.IsZero() {
+		return ErrMissingExpiry
+	}
+
+	if exp.Unix() <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidExpiry, exp.Unix())
+	}
+
+	if iat := token.IssuedAt(); !iat.IsZero() && !exp.After(iat) {
+		return fmt.Errorf("%w: expires %s, issued %s", ErrExpiryBeforeIssuedAt, exp, iat)
+	}
+
+	if ttl := exp.Sub(now); maxTTL > 0 && ttl > maxTTL {
+		return fmt.Errorf("%w: expires in %s, allowed are %s", ErrExpiryTooFar, ttl.Round(time.Second), maxTTL)
+	}
+
+	return nil
+}
+
+// validateTokenAge ensures that the given token was not issued longer
+// than the maximum token age ago.
+func validateTokenAge(token jwt.Token, now time.Time, maxTokenAge time.Duration) error {
+	iat := token.IssuedAt()
+	if iat.IsZero() {
+		return nil
+	}
+
+	if age := now.Sub(iat); age > maxTokenAge {
+		return fmt.Errorf("%w: issued %s ago, allowed are %s", ErrTokenTooOld, age.Round(time.Second), maxTokenAge)
+	}
+
+	return nil
+}
+
+// parseScopes extracts the scopes of a scope claim, which may either be
+// encoded as a space-delimited string (RFC 8693), or as an array of strings.
+func parseScopes(claim interface{}) []string {
+	switch scopes := claim.(type) {
+	case string:
+		return strings.Fields(scopes)
+	case []string:
+		return scopes
+	case []interface{}:
+		result := make([]string, 0, len(scopes))
+		for _, scope := range scopes {
+			if s, ok := scope.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// tokenHeader holds the header fields of a token, which are checked
+// before parsing.
+type tokenHeader struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+}
+
+// decodeHeader decodes only the header segment of the given raw token.
+func decodeHeader(token string) (tokenHeader, error) {
+	header := token
+	if i := strings.IndexByte(token, '.'); i >= 0 {
+		header = token[:i]
+	}
+
+	var parsedHeader tokenHeader
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header, "="))
+	if err != nil {
+		return parsedHeader, fmt.Errorf("failed to decode header: %s", err)
+	}
+
+	if err := json.Unmarshal(decoded, &parsedHeader); err != nil {
+		return parsedHeader, fmt.Errorf("failed to decode header: %s", err)
+	}
+
+	return parsedHeader, nil
+}
+
+// validateHeader checks the kid and alg headers of the given raw token
+// against the key IDs and algorithms allowed via AllowedKeyIDs and
+// AllowedAlgorithms. Only the header segment is decoded, and only once
+// for both checks.
+func (jwtCache *Cache) validateHeader(token string) error {
+	if len(jwtCache.allowedKeyIDs) == 0 && len(jwtCache.allowedAlgorithms) == 0 {
+		return nil
+	}
+
+	header, err := decodeHeader(token)
+	if err != nil {
+		if len(jwtCache.allowedKeyIDs) > 0 {
+			return fmt.Errorf("%w: %s", ErrKeyIDNotAllowed, err)
+		}
+		return fmt.Errorf("%w: %s", ErrAlgorithmNotAllowed, err)
+	}
+
+	if len(jwtCache.allowedKeyIDs) > 0 {
+		if err := validateKeyID(header, jwtCache.allowedKeyIDs); err != nil {
+			return err
+		}
+	}
+
+	if len(jwtCache.allowedAlgorithms) > 0 {
+		if err := validateAlgorithm(header, jwtCache.allowedAlgorithms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateKeyID ensures that the kid header of the given decoded header
+// is one of the allowed key IDs.
+func validateKeyID(header tokenHeader, allowedKeyIDs []string) error {
+	for _, keyID := range allowedKeyIDs {
+		if header.KeyID == keyID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrKeyIDNotAllowed, header.KeyID)
+}
+
+// validateAlgorithm ensures that the alg header of the given decoded header
+// is one of the allowed algorithms. Unsigned tokens (alg "none") are always
+// rejected.
+func validateAlgorithm(header tokenHeader, allowedAlgorithms []jwa.SignatureAlgorithm) error {
+	if !strings.EqualFold(header.Algorithm, jwa.NoSignature.String()) {
+		for _, algorithm := range allowedAlgorithms {
+			if header.Algorithm == algorithm.String() {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrAlgorithmNotAllowed, header.Algorithm)
+}
+
+// checkNonce compares the nonce claim of the given token with the nonce
+// of the previous token, according to the configured nonce policy.
+func (jwtCache *Cache) checkNonce(token jwt.Token, logName string) error {
+	if jwtCache.noncePolicy == NonceIgnore {
+		return nil
+	}
+
+	claim, _ := token.Get("nonce")
+	nonce, _ := claim.(string)
+	if nonce == "" {
+		return nil
+	}
+
+	jwtCache.lockState()
+	reused := nonce == jwtCache.lastNonce
+	jwtCache.lastNonce = nonce
+	jwtCache.unlockState()
+
+	if !reused {
+		return nil
+	}
+
+	if jwtCache.noncePolicy == NonceReject {
+		return fmt.Errorf("%w: %q", ErrNonceReused, nonce)
+	}
+
+	jwtCache.logger.Infof("New %s received with reused nonce %q", logName, nonce)
+	return nil
+}
@@ -0,0 +1,1065 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func getTokenFunctionWithClaims(claims map[string]interface{}) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		merged := map[string]interface{}{
+			jwt.ExpirationKey: time.Now().Add(time.Hour).UTC(),
+		}
+		for k, v := range claims {
+			merged[k] = v
+		}
+
+		return getJwt(merged)
+	}
+}
+
+// Tests that RequiredScopes accepts tokens which carry all required
+// scopes, for both the string and array encoding of the scope claim.
+func Test_Cache_EnsureToken_RequiredScopes(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]interface{}{
+		"string": "read write admin",
+		"array":  []string{"read", "write", "admin"},
+	}
+
+	for name, scope := range tests {
+		scope := scope
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{"scope": scope})),
+				RequiredScopes("read", "write"),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if token == "" {
+				t.Error("expected token, but got none")
+			}
+		})
+	}
+}
+
+// Tests that RequiredScopes rejects tokens which are missing
+// required scopes, and names the missing scopes.
+func Test_Cache_EnsureToken_RequiredScopes_Missing(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{"scope": "read"})),
+		RequiredScopes("read", "write", "admin"),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if !errors.Is(err, ErrMissingScopes) {
+		t.Errorf("expected missing scopes error, but got: %v", err)
+	}
+
+	if expected := "token is missing required scopes: write, admin"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, but got %q", expected, err)
+	}
+
+	if token != "" {
+		t.Errorf("received token %q, not expected none", token)
+	}
+
+	if cache.jwt != "" {
+		t.Error("rejected token was cached")
+	}
+}
+
+func getTokenFunctionWithKeyID(keyID string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		token := jwt.New()
+		if err := token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour).UTC()); err != nil {
+			return "", err
+		}
+
+		headers := jws.NewHeaders()
+		if err := headers.Set(jws.KeyIDKey, keyID); err != nil {
+			return "", err
+		}
+
+		signed, err := jwt.Sign(token, jwa.HS256, []byte("supersecretpassphrase"), jwt.WithHeaders(headers))
+		if err != nil {
+			return "", err
+		}
+
+		return string(signed), nil
+	}
+}
+
+// Tests that AllowedKeyIDs accepts tokens with an allowed kid header.
+func Test_Cache_EnsureToken_AllowedKeyIDs(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithKeyID("key-2")),
+		AllowedKeyIDs("key-1", "key-2"),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token == "" {
+		t.Error("expected token, but got none")
+	}
+}
+
+// Tests that AllowedKeyIDs rejects tokens with an unknown kid header,
+// or tokens with a header which cannot be decoded.
+func Test_Cache_EnsureToken_AllowedKeyIDs_Disallowed(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]func(ctx context.Context) (string, error){
+		"unknown kid": getTokenFunctionWithKeyID("key-3"),
+		"missing kid": getTokenFunction(),
+		"broken header": func(ctx context.Context) (string, error) {
+			return "$$$.payload.signature", nil
+		},
+	}
+
+	for name, tokenFunc := range tests {
+		tokenFunc := tokenFunc
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(tokenFunc),
+				AllowedKeyIDs("key-1", "key-2"),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, ErrKeyIDNotAllowed) {
+				t.Errorf("expected key ID error, but got: %v", err)
+			}
+
+			if token != "" {
+				t.Errorf("received token %q, not expected none", token)
+			}
+		})
+	}
+}
+
+// Tests that RequiredScopes reads the scopes from the claim
+// configured via ScopeClaim.
+func Test_Cache_EnsureToken_RequiredScopes_ScopeClaim(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		claim  string
+		claims map[string]interface{}
+	}{
+		"scp as array": {
+			claim:  "scp",
+			claims: map[string]interface{}{"scp": []string{"read", "write"}, "scope": "other"},
+		},
+		"scope as string": {
+			claim:  "scope",
+			claims: map[string]interface{}{"scope": "read write", "scp": []string{"other"}},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(test.claims)),
+				RequiredScopes("read", "write"),
+				ScopeClaim(test.claim),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if token == "" {
+				t.Error("expected token, but got none")
+			}
+		})
+	}
+}
+
+func getTokenFunctionWithNonces(nonces ...string) func(ctx context.Context) (string, error) {
+	i := 0
+
+	return func(ctx context.Context) (string, error) {
+		nonce := nonces[i%len(nonces)]
+		i++
+
+		return getTokenFunctionWithClaims(map[string]interface{}{"nonce": nonce})(ctx)
+	}
+}
+
+// Tests that NonceReject accepts tokens with unique nonces.
+func Test_Cache_ForceRefresh_NonceReject_Unique(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithNonces("nonce-1", "nonce-2", "nonce-3")),
+		NonceTracking(NonceReject),
+	)
+
+	for i := 0; i < 3; i++ {
+		// when
+		_, err := cache.ForceRefresh(context.Background())
+
+		// then
+		if err != nil {
+			t.Errorf("unexpected error for refresh %d: %s", i, err)
+		}
+	}
+}
+
+// Tests that NonceReject rejects a token repeating the previous nonce,
+// and keeps the previously cached token.
+func Test_Cache_ForceRefresh_NonceReject_Reused(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithNonces("nonce-1")),
+		NonceTracking(NonceReject),
+	)
+
+	expected, err := cache.EnsureToken(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	token, err := cache.ForceRefresh(context.Background())
+
+	// then
+	if !errors.Is(err, ErrNonceReused) {
+		t.Errorf("expected nonce error, but got: %v", err)
+	}
+
+	if token != "" {
+		t.Errorf("received token %q, not expected none", token)
+	}
+
+	if cached, _ := cache.EnsureToken(context.Background()); cached != expected {
+		t.Error("expected previously cached token to be kept")
+	}
+}
+
+// Tests that NonceReport accepts a token repeating the previous nonce,
+// but logs it.
+func Test_Cache_ForceRefresh_NonceReport_Reused(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithNonces("nonce-1")),
+		NonceTracking(NonceReport),
+	)
+
+	if _, err := cache.ForceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if count := len(hook.AllEntries()); count != 0 {
+		t.Fatalf("expected no log entry for a unique nonce, but got %d", count)
+	}
+
+	// when
+	token, err := cache.ForceRefresh(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token == "" {
+		t.Error("expected token, but got none")
+	}
+
+	if entry := hook.LastEntry(); entry == nil || entry.Level != logrus.InfoLevel {
+		t.Errorf("expected info log entry for reused nonce, but got %v", entry)
+	}
+}
+
+// Tests that nonces are not tracked by default.
+func Test_Cache_ForceRefresh_NonceIgnore(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithNonces("nonce-1")),
+	)
+
+	for i := 0; i < 2; i++ {
+		// when
+		_, err := cache.ForceRefresh(context.Background())
+
+		// then
+		if err != nil {
+			t.Errorf("unexpected error for refresh %d: %s", i, err)
+		}
+	}
+}
+
+// Tests that MaxTokenAge rejects tokens issued longer ago than
+// allowed, and accepts tokens up to the exact boundary.
+func Test_Cache_EnsureToken_MaxTokenAge(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		age      time.Duration
+		expected error
+	}{
+		"younger":    {age: 10*time.Minute - time.Second, expected: nil},
+		"boundary":   {age: 10 * time.Minute, expected: nil},
+		"older":      {age: 10*time.Minute + time.Second, expected: ErrTokenTooOld},
+		"much older": {age: 24 * time.Hour, expected: ErrTokenTooOld},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			now := time.Now().Truncate(time.Second)
+			iat := now.Add(-test.age)
+			clock := &fakeClock{now: now}
+
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{jwt.IssuedAtKey: iat.UTC()})),
+				Clock(clock.Now),
+				MaxTokenAge(10*time.Minute),
+			)
+
+			// when
+			_, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+// Tests that MaxTokenAge does not check tokens without an iat claim.
+func Test_Cache_EnsureToken_MaxTokenAge_NoIat(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithoutIat()),
+		MaxTokenAge(time.Minute),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token == "" {
+		t.Error("expected token, but got none")
+	}
+}
+
+// Tests that ClaimValidators invokes all validators in order, and
+// returns the first failure without invoking the remaining validators.
+func Test_Cache_EnsureToken_ClaimValidators(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	errIssuer := errors.New("unexpected issuer")
+	errAudience := errors.New("unexpected audience")
+
+	var calls []string
+	validator := func(name string, err error) ClaimValidator {
+		return func(token jwt.Token) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		ClaimValidators(validator("scope", nil), validator("issuer", errIssuer)),
+		ClaimValidators(validator("audience", errAudience)),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != errIssuer {
+		t.Errorf("expected issuer error, but got: %v", err)
+	}
+
+	if token != "" {
+		t.Errorf("received token %q, not expected none", token)
+	}
+
+	if len(calls) != 2 || calls[0] != "scope" || calls[1] != "issuer" {
+		t.Errorf("unexpected validator calls %v", calls)
+	}
+}
+
+// Tests that AggregateValidationErrors invokes all validators, and
+// returns all failures.
+func Test_Cache_EnsureToken_ClaimValidators_Aggregate(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	errIssuer := errors.New("unexpected issuer")
+	errAudience := errors.New("unexpected audience")
+
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		ClaimValidators(
+			func(token jwt.Token) error { return errIssuer },
+			func(token jwt.Token) error { return nil },
+			func(token jwt.Token) error { return errAudience },
+		),
+		AggregateValidationErrors(true),
+	)
+
+	// when
+	_, err := cache.EnsureToken(context.Background())
+
+	// then
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors, but got: %v", err)
+	}
+
+	if len(errs) != 2 || !errors.Is(err, errIssuer) || !errors.Is(err, errAudience) {
+		t.Errorf("unexpected validation errors %v", errs)
+	}
+
+	expected := "token failed 2 validators: unexpected issuer; unexpected audience"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, but got %q", expected, err)
+	}
+}
+
+// Tests that ClaimValidators accepts tokens passing all validators.
+func Test_Cache_EnsureToken_ClaimValidators_Pass(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		ClaimValidators(
+			func(token jwt.Token) error { return nil },
+			func(token jwt.Token) error { return nil },
+		),
+		AggregateValidationErrors(true),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token == "" {
+		t.Error("expected token, but got none")
+	}
+}
+
+// Tests that AllowedAlgorithms accepts tokens signed with one of the
+// allowed algorithms.
+func Test_Cache_EnsureToken_AllowedAlgorithms(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		AllowedAlgorithms(jwa.RS256, jwa.HS512),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if token == "" {
+		t.Error("expected token, but got none")
+	}
+}
+
+// Tests that AllowedAlgorithms rejects tokens with another algorithm,
+// unsigned tokens (even if listed), and undecodable headers.
+func Test_Cache_EnsureToken_AllowedAlgorithms_Disallowed(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"foo"}`))
+
+	tests := map[string]func(ctx context.Context) (string, error){
+		"other algorithm": getTokenFunctionWithKeyID("key-1"),
+		"unsigned": func(ctx context.Context) (string, error) {
+			return unsignedHeader + "." + payload + ".", nil
+		},
+		"broken header": func(ctx context.Context) (string, error) {
+			return "$$$.payload.signature", nil
+		},
+	}
+
+	for name, tokenFunc := range tests {
+		tokenFunc := tokenFunc
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(tokenFunc),
+				AllowedAlgorithms(jwa.HS512, jwa.NoSignature),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, ErrAlgorithmNotAllowed) {
+				t.Errorf("expected algorithm error, but got: %v", err)
+			}
+
+			if token != "" {
+				t.Errorf("received token %q, not expected none", token)
+			}
+		})
+	}
+}
+
+// Tests that AllowedKeyIDs and AllowedAlgorithms are both checked
+// against the same header, if combined.
+func Test_Cache_EnsureToken_AllowedKeyIDsAndAlgorithms(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		keyID     string
+		algorithm jwa.SignatureAlgorithm
+		expected  error
+	}{
+		"both allowed":         {keyID: "key-1", algorithm: jwa.HS256, expected: nil},
+		"key ID not allowed":   {keyID: "key-3", algorithm: jwa.HS256, expected: ErrKeyIDNotAllowed},
+		"algorithm disallowed": {keyID: "key-1", algorithm: jwa.HS512, expected: ErrAlgorithmNotAllowed},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithKeyID(test.keyID)),
+				AllowedKeyIDs("key-1", "key-2"),
+				AllowedAlgorithms(test.algorithm),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+		})
+	}
+}
+
+// Tests that RevalidateOnEveryAccess validates cached tokens on every
+// access, and only once after fetching otherwise.
+func Test_Cache_EnsureToken_RevalidateOnEveryAccess(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		revalidate bool
+		expected   int
+	}{
+		"enabled":  {revalidate: true, expected: 4},
+		"disabled": {revalidate: false, expected: 1},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			validations := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunction()),
+				ParseOptions(jwt.WithVerify(jwa.HS512, []byte("supersecretpassphrase"))),
+				ClaimValidators(func(token jwt.Token) error {
+					validations++
+					return nil
+				}),
+				RevalidateOnEveryAccess(test.revalidate),
+			)
+
+			// when
+			for i := 0; i < 4; i++ {
+				if _, err := cache.EnsureToken(context.Background()); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			// then
+			if validations != test.expected {
+				t.Errorf("expected %d validations, but got %d", test.expected, validations)
+			}
+		})
+	}
+}
+
+// Tests that RevalidateOnEveryAccess drops a cached token failing
+// revalidation, and fetches a new token.
+func Test_Cache_EnsureToken_RevalidateOnEveryAccess_Failure(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	revoked := ""
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		ClaimValidators(func(token jwt.Token) error {
+			if value, _ := token.Get("breaker"); revoked != "" && fmt.Sprint(value) == revoked {
+				return errors.New("token revoked")
+			}
+			return nil
+		}),
+		RevalidateOnEveryAccess(true),
+	)
+
+	firstToken, _ := cache.EnsureToken(context.Background())
+	breaker, _ := cache.Claim("breaker")
+
+	// when
+	revoked = fmt.Sprint(breaker)
+	secondToken, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if firstToken == secondToken {
+		t.Error("expected revoked token to be replaced")
+	}
+
+	if reason, _ := cache.LastRefreshReason(); reason != RefreshRejected {
+		t.Errorf("expected reason %q, but got %q", RefreshRejected, reason)
+	}
+}
+
+// Tests that ExpectedSubject accepts tokens for the expected subject,
+// and rejects tokens for another or no subject.
+func Test_Cache_EnsureToken_ExpectedSubject(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		"matching":    {claims: map[string]interface{}{jwt.SubjectKey: "billing-service"}, expected: nil},
+		"mismatching": {claims: map[string]interface{}{jwt.SubjectKey: "admin-service"}, expected: ErrUnexpectedSubject},
+		"missing":     {claims: map[string]interface{}{}, expected: ErrUnexpectedSubject},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(test.claims)),
+				ExpectedSubject("billing-service"),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+		})
+	}
+}
+
+// Tests that StrictExpiry rejects tokens violating any of the expiry
+// sanity checks with the specific error, and accepts sane tokens.
+func Test_Cache_EnsureToken_StrictExpiry(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	now := time.Now()
+
+	tests := map[string]struct {
+		tokenFunc func(ctx context.Context) (string, error)
+		expected  error
+	}{
+		"valid": {
+			tokenFunc: getTokenFunction(),
+			expected:  nil,
+		},
+		"missing": {
+			tokenFunc: getTokenFunctionWithoutExp(),
+			expected:  ErrMissingExpiry,
+		},
+		"not positive": {
+			tokenFunc: getTokenFunctionWithClaims(map[string]interface{}{jwt.ExpirationKey: -5}),
+			expected:  ErrInvalidExpiry,
+		},
+		"before iat": {
+			tokenFunc: getTokenFunctionWithClaims(map[string]interface{}{
+				jwt.IssuedAtKey:   now.Add(2 * time.Hour).UTC(),
+				jwt.ExpirationKey: now.Add(time.Hour).UTC(),
+			}),
+			expected: ErrExpiryBeforeIssuedAt,
+		},
+		"too far": {
+			tokenFunc: getTokenFunctionWithClaims(map[string]interface{}{
+				jwt.ExpirationKey: now.Add(48 * time.Hour).UTC(),
+			}),
+			expected: ErrExpiryTooFar,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(test.tokenFunc),
+				StrictExpiry(true, 24*time.Hour),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+		})
+	}
+}
+
+// Tests that StrictExpiry does not limit the expiry, if no max TTL is given.
+func Test_Cache_EnsureToken_StrictExpiry_NoMaxTTL(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{
+			jwt.ExpirationKey: time.Now().Add(365 * 24 * time.Hour).UTC(),
+		})),
+		StrictExpiry(true, 0),
+	)
+
+	// when
+	_, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Tests that NotBeforeIssuedAt rejects tokens issued before the cutoff.
+func Test_Cache_EnsureToken_NotBeforeIssuedAt(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	cutoff := time.Now().Truncate(time.Second).Add(-time.Hour)
+
+	tests := map[string]struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		"issued after":  {claims: map[string]interface{}{jwt.IssuedAtKey: cutoff.Add(time.Minute).UTC()}, expected: nil},
+		"issued at":     {claims: map[string]interface{}{jwt.IssuedAtKey: cutoff.UTC()}, expected: nil},
+		"issued before": {claims: map[string]interface{}{jwt.IssuedAtKey: cutoff.Add(-time.Minute).UTC()}, expected: ErrIssuedBeforeCutoff},
+		"no iat":        {claims: map[string]interface{}{}, expected: ErrIssuedBeforeCutoff},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(test.claims)),
+				NotBeforeIssuedAt(cutoff),
+			)
+
+			// when
+			_, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+// Tests that AllowedIssuers accepts tokens of the allowed issuers only.
+func Test_Cache_EnsureToken_AllowedIssuers(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		"first allowed":  {claims: map[string]interface{}{jwt.IssuerKey: "https://tenant-a.example.com"}, expected: nil},
+		"second allowed": {claims: map[string]interface{}{jwt.IssuerKey: "https://tenant-b.example.com"}, expected: nil},
+		"disallowed":     {claims: map[string]interface{}{jwt.IssuerKey: "https://evil.example.com"}, expected: ErrIssuerNotAllowed},
+		"missing":        {claims: map[string]interface{}{}, expected: ErrIssuerNotAllowed},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(test.claims)),
+				AllowedIssuers("https://tenant-a.example.com", "https://tenant-b.example.com"),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+		})
+	}
+}
+
+// Tests that ExpectedAudience accepts tokens containing any of the expected
+// audiences, and RequireAllAudiences tokens containing all of them.
+func Test_Cache_EnsureToken_ExpectedAudience(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := map[string]struct {
+		audience   interface{}
+		requireAll bool
+		expected   error
+	}{
+		"single match":             {audience: "api-a", expected: nil},
+		"array partial match":      {audience: []string{"api-a", "other"}, expected: nil},
+		"array full match":         {audience: []string{"api-b", "api-a"}, expected: nil},
+		"array no match":           {audience: []string{"other", "another"}, expected: ErrUnexpectedAudience},
+		"missing":                  {audience: nil, expected: ErrUnexpectedAudience},
+		"require all partial":      {audience: []string{"api-a", "other"}, requireAll: true, expected: ErrUnexpectedAudience},
+		"require all full match":   {audience: []string{"api-b", "other", "api-a"}, requireAll: true, expected: nil},
+		"require all single value": {audience: "api-a", requireAll: true, expected: ErrUnexpectedAudience},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			claims := map[string]interface{}{}
+			if test.audience != nil {
+				claims[jwt.AudienceKey] = test.audience
+			}
+
+			// given
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(claims)),
+				ExpectedAudience("api-a", "api-b"),
+				RequireAllAudiences(test.requireAll),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+		})
+	}
+}
+
+// Tests that AcceptFunc acts as final gate: Accepted tokens are cached,
+// rejected tokens fail with ErrTokenNotAccepted, and errors are passed through.
+func Test_Cache_EnsureToken_AcceptFunc(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	errEntitlement := errors.New("entitlement lookup failed")
+
+	tests := map[string]struct {
+		accepted bool
+		err      error
+		expected error
+	}{
+		"accept": {accepted: true, expected: nil},
+		"reject": {accepted: false, expected: ErrTokenNotAccepted},
+		"error":  {accepted: true, err: errEntitlement, expected: errEntitlement},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			calls := 0
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(getTokenFunctionWithClaims(map[string]interface{}{"entitlement": "premium"})),
+				AcceptFunc(func(token jwt.Token) (bool, error) {
+					calls++
+
+					if entitlement, _ := token.Get("entitlement"); entitlement != "premium" {
+						t.Errorf("expected parsed token, but got entitlement %v", entitlement)
+					}
+
+					return test.accepted, test.err
+				}),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, but got: %v", test.expected, err)
+			}
+
+			if (token != "") != (test.expected == nil) {
+				t.Errorf("unexpected token %q", token)
+			}
+
+			if cache.HasToken() != (test.expected == nil) {
+				t.Errorf("expected token to be cached only if accepted")
+			}
+
+			if calls != 1 {
+				t.Errorf("expected accept function to be called once, but got %d calls", calls)
+			}
+		})
+	}
+}
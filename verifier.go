@@ -0,0 +1,53 @@
+package jwt
+
+import (
+	"github.com/lestrrat-go/jwx/jwa"
+
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSignatureInvalid is returned if a token is rejected by the
+// verifier set via the Verifier option.
+var ErrSignatureInvalid = errors.New("token signature is invalid")
+
+// VerifierContract defines the method required to verify the signature
+// of a token. This allows delegating the verification to an external
+// service, such as a KMS or HSM, which does not expose its keys.
+type VerifierContract interface {
+	// Verify verifies the signature over the signing input (the encoded
+	// header and payload, separated by a dot) for the given algorithm,
+	// as denoted by the alg header.
+	Verify(signingInput, signature []byte, alg string) error
+}
+
+// verifySignature verifies the signature of the given token via
+// the given verifier. Unsigned tokens are always rejected.
+func verifySignature(token string, verifier VerifierContract) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSignatureInvalid, ErrMalformedToken)
+	}
+
+	header, err := decodeHeader(token)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+
+	if header.Algorithm == "" || strings.EqualFold(header.Algorithm, jwa.NoSignature.String()) {
+		return fmt.Errorf("%w: unsigned token", ErrSignatureInvalid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSignatureInvalid, ErrMalformedEncoding)
+	}
+
+	if err := verifier.Verify([]byte(token[:i]), signature, header.Algorithm); err != nil {
+		return fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package jwt
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// fakeVerifier verifies HS512 signatures with the secret of getJwt,
+// as a stand-in for a KMS.
+type fakeVerifier struct {
+	calls int
+	alg   string
+}
+
+func (verifier *fakeVerifier) Verify(signingInput, signature []byte, alg string) error {
+	verifier.calls++
+	verifier.alg = alg
+
+	mac := hmac.New(sha512.New, []byte("supersecretpassphrase"))
+	mac.Write(signingInput)
+
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("signature mismatch")
+	}
+
+	return nil
+}
+
+// Tests that the Verifier verifies the signature of fetched tokens.
+func Test_Cache_EnsureToken_Verifier(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// given
+	verifier := &fakeVerifier{}
+	cache := NewCache(
+		Logger(logger),
+		TokenFunction(getTokenFunction()),
+		Verifier(verifier),
+		RejectUnparsable(true),
+	)
+
+	// when
+	token, err := cache.EnsureToken(context.Background())
+
+	// then
+	if err != nil || token == "" {
+		t.Errorf("expected token, but got error: %v", err)
+	}
+
+	if verifier.calls != 1 || verifier.alg != "HS512" {
+		t.Errorf("expected verifier to be called once for HS512, but got %d calls for %q", verifier.calls, verifier.alg)
+	}
+}
+
+// Tests that tokens rejected by the Verifier are not returned.
+func Test_Cache_EnsureToken_Verifier_Invalid(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	tests := map[string]struct {
+		tamper        func(token string) string
+		verifierCalls int
+	}{
+		"tampered signature": {
+			tamper: func(token string) string {
+				return token[:strings.LastIndexByte(token, '.')+1] + base64.RawURLEncoding.EncodeToString([]byte("forged"))
+			},
+			verifierCalls: 1,
+		},
+		"unsigned": {
+			tamper: func(token string) string {
+				segments := strings.Split(token, ".")
+				return unsignedHeader + "." + segments[1] + "."
+			},
+			verifierCalls: 0,
+		},
+		"malformed signature": {
+			tamper: func(token string) string {
+				return token + "!"
+			},
+			verifierCalls: 0,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			// given
+			tokenFunc := getTokenFunction()
+			verifier := &fakeVerifier{}
+			cache := NewCache(
+				Logger(logger),
+				TokenFunction(func(ctx context.Context) (string, error) {
+					token, err := tokenFunc(ctx)
+					return test.tamper(token), err
+				}),
+				Verifier(verifier),
+				RejectUnparsable(true),
+			)
+
+			// when
+			token, err := cache.EnsureToken(context.Background())
+
+			// then
+			if !errors.Is(err, ErrSignatureInvalid) {
+				t.Errorf("expected ErrSignatureInvalid, but got: %v", err)
+			}
+
+			if token != "" {
+				t.Errorf("expected no token, but got %q", token)
+			}
+
+			if verifier.calls != test.verifierCalls {
+				t.Errorf("expected %d verifier calls, but got %d", test.verifierCalls, verifier.calls)
+			}
+		})
+	}
+}